@@ -0,0 +1,387 @@
+package pingtunnel
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/network"
+)
+
+// BIND replies carry "listen ADDR", "accept PEER" or "error MSG" in Data.
+const (
+	BIND_LISTEN = "listen"
+	BIND_ACCEPT = "accept"
+	BIND_ERROR  = "error"
+)
+
+func parseBindReply(data []byte) (string, string) {
+	kind, arg, _ := strings.Cut(string(data), " ")
+	return kind, arg
+}
+
+// bindPeerExpected tells whether remote is the peer a BIND request named. An
+// unspecified address accepts any peer and a name any of its addresses. The
+// port is not checked, the peer connects from one of its own.
+func bindPeerExpected(expect string, remote net.IP, lookup func(host string) ([]net.IP, error)) bool {
+	host, _, err := net.SplitHostPort(expect)
+	if err != nil {
+		host = expect
+	}
+	if host == "" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsUnspecified() || ip.Equal(remote)
+	}
+	ips, err := lookup(host)
+	if err != nil {
+		loggo.Info("bind lookup expected peer %s fail: %s", host, err)
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(remote) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServerBind is a one-shot listener opened for a SOCKS5 BIND request.
+type ServerBind struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	id       string
+	listener *net.TCPListener
+	addr     string
+	expect   string // the peer the client expects, only it is accepted
+
+	tcpmode_buffersize    int
+	tcpmode_maxwin        int
+	tcpmode_resend_timems int
+	tcpmode_compress      int
+	tcpmode_stat          int
+	timeout               int
+
+	peer sharedPeer
+}
+
+func (p *Server) processBindPacket(packet *Packet) {
+
+	id := packet.my.Id
+
+	if p.getServerConnById(id) != nil {
+		// already accepted, the request was resent
+		return
+	}
+
+	if v, ok := p.bindMap.Load(id); ok {
+		b := v.(*ServerBind)
+		peer := b.peer.Load()
+		peer.echoId = packet.echoId
+		peer.echoSeq = packet.echoSeq
+		peer.key = (int)(packet.my.Key)
+		peer.crypto = packet.crypto
+		b.peer.Store(peer)
+		p.bindReply(b, BIND_LISTEN+" "+b.addr)
+		return
+	}
+
+	b := &ServerBind{
+		id:                    id,
+		expect:                packet.my.Target,
+		tcpmode_buffersize:    (int)(packet.my.TcpmodeBuffersize),
+		tcpmode_maxwin:        (int)(packet.my.TcpmodeMaxwin),
+		tcpmode_resend_timems: (int)(packet.my.TcpmodeResendTimems),
+		tcpmode_compress:      (int)(packet.my.TcpmodeCompress),
+		tcpmode_stat:          (int)(packet.my.TcpmodeStat),
+		timeout:               (int)(packet.my.Timeout),
+	}
+	b.peer.Store(packetPeer(packet))
+
+	if p.settings.Load().BindAllow <= 0 {
+		loggo.Info("bind not allowed %s %s", packet.src.String(), id)
+		p.bindReply(b, BIND_ERROR+" denied")
+		return
+	}
+	if p.draining.Load() {
+		loggo.Info("shutting down, server bind fail %s", id)
+		p.bindReply(b, BIND_ERROR+" shutting down")
+		return
+	}
+	if maxconn := p.settings.Load().MaxConn; maxconn > 0 && (int)(p.localConnMapSize.Load()) >= maxconn {
+		loggo.Info("too many connections %d, server bind fail %s", p.localConnMapSize.Load(), id)
+		p.bindReply(b, BIND_ERROR+" too many connections")
+		return
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	if err != nil {
+		loggo.Error("Error listening for bind %s %s", id, err.Error())
+		p.bindReply(b, BIND_ERROR+" "+err.Error())
+		return
+	}
+	b.listener = listener
+	b.addr = listener.Addr().String()
+	b.ctx, b.cancel = context.WithCancel(p.ctx)
+	p.bindMap.Store(id, b)
+
+	loggo.Info("start bind listen %s %s expect %s", id, b.addr, packet.my.Target)
+	p.bindReply(b, BIND_LISTEN+" "+b.addr)
+
+	go p.AcceptBind(b)
+}
+
+func (p *Server) bindReply(b *ServerBind, data string) {
+	peer := b.peer.Load()
+	sendICMP(peer.echoId, peer.echoSeq, *p.conn, peer.src, "", b.id, (uint32)(MyMsg_BIND), []byte(data),
+		peer.rproto, -1, peer.key,
+		0, 0, 0, 0, 0, 0,
+		0, peer.crypto)
+}
+
+func (p *Server) AcceptBind(b *ServerBind) {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	defer p.bindMap.Delete(b.id)
+	defer b.listener.Close()
+	defer b.cancel()
+
+	deadline := time.Now().Add(time.Second * time.Duration(b.timeout))
+	for b.ctx.Err() == nil {
+		if time.Now().After(deadline) {
+			loggo.Info("bind accept timeout %s %s", b.id, b.addr)
+			p.bindReply(b, BIND_ERROR+" accept timeout")
+			return
+		}
+
+		b.listener.SetDeadline(time.Now().Add(time.Millisecond * 1000))
+		conn, err := b.listener.AcceptTCP()
+		if err != nil {
+			nerr, ok := err.(net.Error)
+			if !ok || !nerr.Timeout() {
+				loggo.Info("Error accept bind %s %s", b.id, err)
+				p.bindReply(b, BIND_ERROR+" "+err.Error())
+				return
+			}
+			continue
+		}
+
+		if !bindPeerExpected(b.expect, conn.RemoteAddr().(*net.TCPAddr).IP, p.resolver.LookupIP) {
+			loggo.Info("bind refuse unexpected peer %s %s expect %s", b.id, conn.RemoteAddr().String(), b.expect)
+			conn.Close()
+			continue
+		}
+
+		fm := network.NewFrameMgr(FRAME_MAX_SIZE, FRAME_MAX_ID, b.tcpmode_buffersize, b.tcpmode_maxwin, b.tcpmode_resend_timems, b.tcpmode_compress,
+			b.tcpmode_stat)
+
+		localConn := &ServerConn{timeout: b.timeout, tcpconn: conn, tcpaddrTarget: conn.RemoteAddr().(*net.TCPAddr), id: b.id,
+			fm: fm, clock: newFrameClock(b.tcpmode_resend_timems), tcpmode: 1, activity: make(chan struct{}, 1)}
+
+		peer := b.peer.Load()
+		p.addServerConn(b.id, localConn, peer)
+		loggo.Info("server accept new bind tcp %s %s", b.id, conn.RemoteAddr().String())
+
+		// the reply is not retransmitted, send it a few times against icmp loss
+		for i := 0; i < 3; i++ {
+			p.bindReply(b, BIND_ACCEPT+" "+conn.RemoteAddr().String())
+		}
+
+		localConn.fm.Connect()
+		go p.RecvTCP(localConn, b.id, peer.src)
+		return
+	}
+}
+
+func (p *Server) closeBind() {
+	p.bindMap.Range(func(key, value interface{}) bool {
+		b := value.(*ServerBind)
+		b.cancel()
+		b.listener.Close()
+		return true
+	})
+}
+
+func (p *Client) processBindReply(packet *Packet) {
+	v, ok := p.bindPending.Load(packet.my.Id)
+	if !ok {
+		return
+	}
+	select {
+	case v.(chan string) <- string(packet.my.Data):
+	default:
+	}
+}
+
+// AcceptSock5BindConn relays a SOCKS5 BIND: the server listens, the first
+// reply reports where, the second one who connected.
+func (p *Client) AcceptSock5BindConn(conn *net.TCPConn, expectAddr string, server *net.IPAddr) {
+
+	tcpsrcaddr := conn.RemoteAddr().(*net.TCPAddr)
+	settings := p.settings.Load()
+
+	if settings.MaxConn > 0 && (int)(p.localIdToConnMapSize.Load()) >= settings.MaxConn {
+		loggo.Info("too many connections %d, client accept new sock5 bind fail %s", p.localIdToConnMapSize.Load(), tcpsrcaddr.String())
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, "0.0.0.0:0")
+		conn.Close()
+		return
+	}
+
+	uuid := common.UniqueId()
+	ch := make(chan string, 8)
+	p.bindPending.Store(uuid, ch)
+	defer p.bindPending.Delete(uuid)
+
+	// the server side connects, this side only answers
+	fm := network.NewFrameMgr(FRAME_MAX_SIZE, FRAME_MAX_ID, p.tcpmode_buffersize, p.tcpmode_maxwin, p.tcpmode_resend_timems, p.tcpmode_compress, p.tcpmode_stat)
+	clientConn := &ClientConn{tcpaddr: tcpsrcaddr, id: uuid, tcpmode: 1,
+		activity: make(chan struct{}, 1),
+		server:   server,
+		fm:       fm,
+		clock:    newFrameClock(p.tcpmode_resend_timems)}
+	p.addClientConn(uuid, "bind|"+uuid, clientConn)
+	loggo.Info("client accept new sock5 bind %s %s expect %s", uuid, tcpsrcaddr.String(), expectAddr)
+
+	listenAddr := ""
+	for i := 0; i < 5 && listenAddr == "" && clientConn.ctx.Err() == nil; i++ {
+		sendICMP(p.id, p.nextSequence(), *p.conn, p.connServer(clientConn), expectAddr, uuid, (uint32)(MyMsg_BIND), nil,
+			SEND_PROTO, RECV_PROTO, settings.Key,
+			1, p.tcpmode_buffersize, p.tcpmode_maxwin, p.tcpmode_resend_timems, p.tcpmode_compress, p.tcpmode_stat,
+			settings.Timeout, p.cryptoConfig.Load())
+
+		select {
+		case reply := <-ch:
+			kind, arg := parseBindReply([]byte(reply))
+			if kind == BIND_LISTEN {
+				listenAddr = arg
+			} else if kind == BIND_ERROR {
+				loggo.Info("sock5 bind fail %s %s", uuid, arg)
+				i = 5
+			}
+		case <-time.After(time.Second):
+		}
+	}
+	if listenAddr == "" {
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, "0.0.0.0:0")
+		conn.Close()
+		p.close(clientConn)
+		return
+	}
+
+	// the server reports its wildcard listen address, clients need the address they reach it on
+	if tcpaddr, err := net.ResolveTCPAddr("tcp", listenAddr); err == nil && (tcpaddr.IP == nil || tcpaddr.IP.IsUnspecified()) {
+		tcpaddr.IP = p.connServer(clientConn).IP
+		listenAddr = tcpaddr.String()
+	}
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, listenAddr); err != nil {
+		loggo.Error("send bind listen reply: %s", err)
+		conn.Close()
+		p.close(clientConn)
+		p.remoteError(uuid)
+		return
+	}
+	loggo.Info("sock5 bind listen %s %s", uuid, listenAddr)
+
+	peerAddr, ok := p.waitBindAccept(clientConn, ch)
+	if !ok {
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, "0.0.0.0:0")
+		conn.Close()
+		p.close(clientConn)
+		return
+	}
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, peerAddr); err != nil {
+		loggo.Error("send bind accept reply: %s", err)
+		conn.Close()
+		p.close(clientConn)
+		p.remoteError(uuid)
+		return
+	}
+	loggo.Info("sock5 bind accept %s %s", uuid, peerAddr)
+
+	p.transferTcpConn(conn, clientConn, "")
+}
+
+// waitBindAccept waits until the server reports the inbound connection. The
+// frame manager stays idle until then, the server side connects first. If the
+// replies are lost, its first frame is enough.
+func (p *Client) waitBindAccept(clientConn *ClientConn, ch chan string) (string, bool) {
+	deadline := time.Now().Add(time.Second * time.Duration(p.settings.Load().Timeout))
+	for clientConn.ctx.Err() == nil {
+		if time.Now().After(deadline) {
+			loggo.Info("sock5 bind accept timeout %s", clientConn.id)
+			p.remoteError(clientConn.id)
+			return "", false
+		}
+
+		select {
+		case reply := <-ch:
+			kind, arg := parseBindReply([]byte(reply))
+			if kind == BIND_ACCEPT {
+				return arg, true
+			} else if kind == BIND_ERROR {
+				loggo.Info("sock5 bind fail %s %s", clientConn.id, arg)
+				return "", false
+			}
+		case <-clientConn.activity:
+			return "0.0.0.0:0", true
+		case <-time.After(time.Second):
+		}
+	}
+	return "", false
+}
+
+// AcceptDirectBindConn serves a BIND routed direct with a local listener.
+func (p *Client) AcceptDirectBindConn(conn *net.TCPConn, expectAddr string) {
+
+	listenIP := net.IP(nil)
+	if localAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		listenIP = localAddr.IP
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: listenIP})
+	if err != nil {
+		loggo.Info("direct bind listen fail: %s", err.Error())
+		writeSocks5Reply(conn, socks5ReplyGeneralFailure, "0.0.0.0:0")
+		conn.Close()
+		return
+	}
+	defer listener.Close()
+
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, listener.Addr().String()); err != nil {
+		conn.Close()
+		return
+	}
+	loggo.Info("client direct bind listen %s expect %s", listener.Addr().String(), expectAddr)
+
+	listener.SetDeadline(time.Now().Add(time.Second * time.Duration(p.settings.Load().Timeout)))
+	var peer *net.TCPConn
+	for peer == nil {
+		peer, err = listener.AcceptTCP()
+		if err != nil {
+			loggo.Info("direct bind accept fail: %s", err.Error())
+			writeSocks5Reply(conn, socks5ReplyGeneralFailure, "0.0.0.0:0")
+			conn.Close()
+			return
+		}
+		if !bindPeerExpected(expectAddr, peer.RemoteAddr().(*net.TCPAddr).IP, net.LookupIP) {
+			loggo.Info("direct bind refuse unexpected peer %s expect %s", peer.RemoteAddr().String(), expectAddr)
+			peer.Close()
+			peer = nil
+		}
+	}
+	if err := writeSocks5Reply(conn, socks5ReplySucceeded, peer.RemoteAddr().String()); err != nil {
+		peer.Close()
+		conn.Close()
+		return
+	}
+
+	go p.transfer(conn, peer, conn.RemoteAddr().String(), peer.RemoteAddr().String())
+	go p.transfer(peer, conn, peer.RemoteAddr().String(), conn.RemoteAddr().String())
+}
@@ -0,0 +1,147 @@
+package pingtunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseBindReply(t *testing.T) {
+	tests := []struct {
+		data string
+		kind string
+		arg  string
+	}{
+		{"listen [::]:40019", BIND_LISTEN, "[::]:40019"},
+		{"accept 1.2.3.4:5678", BIND_ACCEPT, "1.2.3.4:5678"},
+		{"error accept timeout", BIND_ERROR, "accept timeout"},
+		{"listen", BIND_LISTEN, ""},
+		{"", "", ""},
+	}
+
+	for _, tt := range tests {
+		kind, arg := parseBindReply([]byte(tt.data))
+		if kind != tt.kind || arg != tt.arg {
+			t.Errorf("parseBindReply(%q) = %q, %q, want %q, %q", tt.data, kind, arg, tt.kind, tt.arg)
+		}
+	}
+}
+
+func TestBindPeerExpected(t *testing.T) {
+	// failed lookups are logged, keep the log files out of the tree
+	t.Chdir(t.TempDir())
+	lookup := func(host string) ([]net.IP, error) {
+		if host == "peer.test" {
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}, nil
+		}
+		return nil, errors.New("not found")
+	}
+
+	tests := []struct {
+		expect string
+		remote string
+		want   bool
+	}{
+		{"1.2.3.4:21", "1.2.3.4", true},
+		{"1.2.3.4:21", "1.2.3.5", false},
+		{"1.2.3.4:0", "::ffff:1.2.3.4", true},
+		{"0.0.0.0:0", "5.6.7.8", true},
+		{"[::]:0", "5.6.7.8", true},
+		{"", "5.6.7.8", true},
+		{"peer.test:21", "fd00::1", true},
+		{"peer.test:21", "10.0.0.2", false},
+		{"other.test:21", "10.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		got := bindPeerExpected(tt.expect, net.ParseIP(tt.remote), lookup)
+		if got != tt.want {
+			t.Errorf("bindPeerExpected(%q, %s) = %v, want %v", tt.expect, tt.remote, got, tt.want)
+		}
+	}
+}
+
+func readTestSocks5Reply(t *testing.T, r io.Reader) (byte, string) {
+	t.Helper()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("read socks5 reply: %v", err)
+	}
+	addr, err := readSocks5AddressFromReader(r, header[3])
+	if err != nil {
+		t.Fatalf("read socks5 reply address: %v", err)
+	}
+	return header[1], addr
+}
+
+func TestDirectBindRefusesUnexpectedPeer(t *testing.T) {
+	t.Chdir(t.TempDir())
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	c := &Client{}
+	c.settings.Store(&ClientSettings{Timeout: 5})
+	go func() {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			return
+		}
+		c.AcceptDirectBindConn(conn, "127.0.0.1:0")
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	rep, listenAddr := readTestSocks5Reply(t, conn)
+	if rep != socks5ReplySucceeded {
+		t.Fatalf("bind listen reply %d", rep)
+	}
+
+	// another loopback address is not the expected peer
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	other, err := d.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatalf("dial from 127.0.0.2: %v", err)
+	}
+	defer other.Close()
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := other.Read(make([]byte, 1)); err == nil {
+		t.Fatal("unexpected peer was accepted")
+	}
+
+	peer, err := net.Dial("tcp", listenAddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer peer.Close()
+	rep, peerAddr := readTestSocks5Reply(t, conn)
+	if rep != socks5ReplySucceeded || peerAddr != peer.LocalAddr().String() {
+		t.Fatalf("bind accept reply %d %s, want %s", rep, peerAddr, peer.LocalAddr())
+	}
+
+	// the relay logs when it ends, let it end before the directory is restored
+	peer.Close()
+	io.Copy(io.Discard, conn)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		logs, _ := filepath.Glob("default_INFO_*.log")
+		if len(logs) > 0 {
+			if data, _ := os.ReadFile(logs[0]); bytes.Count(data, []byte("client end transfer")) == 2 {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
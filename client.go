@@ -1,15 +1,20 @@
 package pingtunnel
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/loggo"
 	"github.com/esrrhs/gohome/network"
+	"github.com/esrrhs/gohome/thread"
 	"golang.org/x/net/icmp"
 	"google.golang.org/protobuf/proto"
 	"io"
 	"math"
 	"math/rand"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -19,26 +24,44 @@ import (
 const (
 	SEND_PROTO int = 8
 	RECV_PROTO int = 0
+
+	// a suite is dropped when the server has not answered a ping in it
+	// for this long
+	SUITE_PONG_TIMEOUT = 3 * time.Second
 )
 
 func NewClient(addr string, server string, target string, timeout int, key int, icmpAddr string,
 	tcpmode int, tcpmode_buffersize int, tcpmode_maxwin int, tcpmode_resend_timems int, tcpmode_compress int,
 	tcpmode_stat int, open_sock5 int, maxconn int, sock5_filter *func(addr string) bool, cryptoConfig *CryptoConfig,
-	sock5_user string, sock5_pass string) (*Client, error) {
+	sock5_user string, sock5_pass string, reverse []*ReverseConfig,
+	open_http int, http_user string, http_pass string, transparent string, tun *TunConfig,
+	dns *DnsConfig, route *RouteTable, sock5_confirm int, sock5_fullcone int, listeners []*ListenerConfig,
+	maxprocessthread int, maxprocessbuffer int, decryptthread int) (*Client, error) {
 
 	var ipaddr *net.UDPAddr
 	var tcpaddr *net.TCPAddr
 	var err error
 
-	if tcpmode > 0 {
-		tcpaddr, err = net.ResolveTCPAddr("tcp", addr)
-		if err != nil {
-			return nil, err
+	if err := ValidateListeners(listeners); err != nil {
+		return nil, err
+	}
+	for _, l := range listeners {
+		if addr != "" && l.Listen == addr && (l.Type == LISTENER_UDP) == (tcpmode == 0) {
+			return nil, fmt.Errorf("listener %s uses the -l address", l)
 		}
-	} else {
-		ipaddr, err = net.ResolveUDPAddr("udp", addr)
-		if err != nil {
-			return nil, err
+	}
+
+	if addr != "" {
+		if tcpmode > 0 {
+			tcpaddr, err = net.ResolveTCPAddr("tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			ipaddr, err = net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -50,18 +73,13 @@ func NewClient(addr string, server string, target string, timeout int, key int,
 	rand.Seed(time.Now().UnixNano())
 	now := time.Now()
 	c := &Client{
-		exit:                  false,
-		rtt:                   0,
 		id:                    rand.Intn(math.MaxInt16),
 		ipaddr:                ipaddr,
 		tcpaddr:               tcpaddr,
 		addr:                  addr,
-		ipaddrServer:          ipaddrServer,
 		addrServer:            server,
 		targetAddr:            target,
 		icmpAddr:              icmpAddr,
-		timeout:               timeout,
-		key:                   key,
 		tcpmode:               tcpmode,
 		tcpmode_buffersize:    tcpmode_buffersize,
 		tcpmode_maxwin:        tcpmode_maxwin,
@@ -69,32 +87,78 @@ func NewClient(addr string, server string, target string, timeout int, key int,
 		tcpmode_compress:      tcpmode_compress,
 		tcpmode_stat:          tcpmode_stat,
 		open_sock5:            open_sock5,
-		maxconn:               maxconn,
-		pongTime:              now,
+		maxprocessthread:      maxprocessthread,
+		maxprocessbuffer:      maxprocessbuffer,
+		decryptthread:         decryptthread,
 		sock5_filter:          sock5_filter,
-		sock5_user:            sock5_user,
-		sock5_pass:            sock5_pass,
-		cryptoConfig:          cryptoConfig,
+		sock5_fullcone:        sock5_fullcone,
+		open_http:             open_http,
+		transparent:           transparent,
+		cryptoSuites:          []*CryptoConfig{cryptoConfig},
+		suitePongTime:         make(map[EncryptionMode]time.Time),
+		reverse:               reverse,
+		reverseOwner:          common.UniqueId(),
+		tun:                   tun,
+		dns:                   dns,
+		dnsWorker:             make(chan struct{}, DNS_MAX_WORKERS),
 		nextResolveAt:         now,
 		resolveRetryBackoff:   2 * time.Second,
 	}
+	for _, l := range listeners {
+		c.listeners = append(c.listeners, &clientListener{config: l})
+	}
+	if cryptoConfig != nil {
+		c.cryptoSuites = cryptoConfig.Suites()
+	}
+	cacheSize := 0
+	if dns != nil {
+		cacheSize = dns.CacheSize
+	}
+	c.dnsCache = newDnsCache(cacheSize)
+	c.frag = newFragAssembler(UDP_FRAG_MAX_BUFFER)
 	c.lastActivityUnixNano.Store(now.UnixNano())
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.ipaddrServer.Store(ipaddrServer)
+	c.cryptoConfig.Store(cryptoConfig)
+	c.pongTime.Store(now)
+	c.settings.Store(&ClientSettings{
+		Key:          key,
+		MaxConn:      maxconn,
+		Timeout:      timeout,
+		Sock5User:    sock5_user,
+		Sock5Pass:    sock5_pass,
+		Sock5Confirm: sock5_confirm,
+		HttpUser:     http_user,
+		HttpPass:     http_pass,
+		Route:        route,
+	})
+
+	if maxprocessthread > 0 {
+		c.processtp = thread.NewThreadPool(maxprocessthread, maxprocessbuffer, func(v interface{}) {
+			packet := v.(*Packet)
+			c.processSessionPacket(packet)
+		})
+	}
+
 	return c, nil
 }
 
 type Client struct {
-	exit           bool
-	rtt            time.Duration
-	workResultLock sync.WaitGroup
-	maxconn        int
+	ctx              context.Context
+	cancel           context.CancelFunc
+	draining         atomic.Bool
+	settings         atomic.Pointer[ClientSettings] // replaced whole by Reload
+	rtt              atomic.Int64                   // ns
+	workResultLock   sync.WaitGroup
+	maxprocessthread int
+	maxprocessbuffer int
+	decryptthread    int
 
 	id       int
-	sequence int
+	sequence atomic.Int64
 
-	timeout               int
 	sproto                int
 	rproto                int
-	key                   int
 	tcpmode               int
 	tcpmode_buffersize    int
 	tcpmode_maxwin        int
@@ -102,17 +166,39 @@ type Client struct {
 	tcpmode_compress      int
 	tcpmode_stat          int
 
-	open_sock5   int
-	sock5_filter *func(addr string) bool
-	sock5_user   string
-	sock5_pass   string
-	cryptoConfig *CryptoConfig
+	open_sock5     int
+	sock5_filter   *func(addr string) bool
+	sock5_fullcone int
+	open_http      int
+	transparent    string
+	cryptoConfig   atomic.Pointer[CryptoConfig] // the suite packets are sent in
+	cryptoSuites   []*CryptoConfig              // every suite this side accepts, strongest first
+	suitePongTime  map[EncryptionMode]time.Time
+
+	reverse           []*ReverseConfig
+	reverseOwner      string // sent with the registrations, binds them to this client
+	reverseRegistered sync.Map
+	reverseClosed     sync.Map // id of a closed reverse session -> close time
+
+	tun    *TunConfig
+	tunDev *os.File
+
+	dns            *DnsConfig
+	dnsCache       *dnsCache
+	dnsPending     sync.Map
+	dnsUdpConn     *net.UDPConn
+	dnsTcpListener *net.TCPListener
+	dnsWorker      chan struct{}
+
+	bindPending sync.Map
+
+	frag *fragAssembler
 
 	ipaddr  *net.UDPAddr
 	tcpaddr *net.TCPAddr
 	addr    string
 
-	ipaddrServer *net.IPAddr
+	ipaddrServer atomic.Pointer[net.IPAddr] // refreshed from addrServer
 	addrServer   string
 
 	targetAddr string
@@ -122,40 +208,62 @@ type Client struct {
 	conn          *icmp.PacketConn
 	listenConn    *net.UDPConn
 	tcplistenConn *net.TCPListener
+	listeners     []*clientListener
 
 	localAddrToConnMap sync.Map
 	localIdToConnMap   sync.Map
 
-	sendPacket             uint64
-	recvPacket             uint64
-	sendPacketSize         uint64
-	recvPacketSize         uint64
-	localAddrToConnMapSize int
-	localIdToConnMapSize   int
+	sendPacket             atomic.Uint64
+	recvPacket             atomic.Uint64
+	sendPacketSize         atomic.Uint64
+	recvPacketSize         atomic.Uint64
+	localAddrToConnMapSize atomic.Int64
+	localIdToConnMapSize   atomic.Int64
 
-	recvcontrol chan int
+	processtp *thread.ThreadPool
 
-	pongTime             time.Time
+	pongTime             atomicTime
 	lastActivityUnixNano atomic.Int64
 	nextResolveAt        time.Time
 	resolveRetryBackoff  time.Duration
 }
 
 type ClientConn struct {
-	exit           bool
+	ctx            context.Context
+	cancel         context.CancelFunc
+	closeOnce      sync.Once
 	ipaddr         *net.UDPAddr
 	tcpaddr        *net.TCPAddr
 	id             string
 	addrKey        string
 	tcpmode        int
-	activeRecvTime time.Time
-	activeSendTime time.Time
-	close          bool
+	activeRecvTime atomicTime
+	activeSendTime atomicTime
+	close          atomic.Bool
 	udpRelayConn   *net.UDPConn
 	udpTargetAddr  string
 	activity       chan struct{}
+	reverseId      string // the reverse tunnel the server opened the session for
+	reverseConn    *net.UDPConn
+	tproxyConn     *net.UDPConn
+	directConn     *net.UDPConn
+	listenConn     *net.UDPConn // the udp listener the flow came in on
+	server         *net.IPAddr
+	kickReason     int
+
+	// connectReply, if set, sends the held proxy reply once the server has
+	// connected the target or failed to.
+	connectReply func(connected bool, reason int) error
+
+	fm    *network.FrameMgr
+	clock *frameClock
+}
 
-	fm *network.FrameMgr
+// clientListener is an extra listener of the config file, next to -l.
+type clientListener struct {
+	config      *ListenerConfig
+	tcpListener *net.TCPListener
+	udpConn     *net.UDPConn
 }
 
 func (p *Client) Addr() string {
@@ -175,7 +283,7 @@ func (p *Client) ICMPAddr() string {
 }
 
 func (p *Client) ServerIPAddr() *net.IPAddr {
-	return p.ipaddrServer
+	return p.ipaddrServer.Load()
 }
 
 func (p *Client) ServerAddr() string {
@@ -183,31 +291,36 @@ func (p *Client) ServerAddr() string {
 }
 
 func (p *Client) RTT() time.Duration {
-	return p.rtt
+	return time.Duration(p.rtt.Load())
 }
 
 func (p *Client) RecvPacketSize() uint64 {
-	return p.recvPacketSize
+	return p.recvPacketSize.Load()
 }
 
 func (p *Client) SendPacketSize() uint64 {
-	return p.sendPacketSize
+	return p.sendPacketSize.Load()
 }
 
 func (p *Client) RecvPacket() uint64 {
-	return p.recvPacket
+	return p.recvPacket.Load()
 }
 
 func (p *Client) SendPacket() uint64 {
-	return p.sendPacket
+	return p.sendPacket.Load()
 }
 
 func (p *Client) LocalIdToConnMapSize() int {
-	return p.localIdToConnMapSize
+	return (int)(p.localIdToConnMapSize.Load())
 }
 
 func (p *Client) LocalAddrToConnMapSize() int {
-	return p.localAddrToConnMapSize
+	return (int)(p.localAddrToConnMapSize.Load())
+}
+
+// nextSequence returns the echo sequence of the next packet sent.
+func (p *Client) nextSequence() int {
+	return (int)(p.sequence.Add(1))
 }
 
 func (p *Client) touchActivity() {
@@ -236,7 +349,7 @@ func (p *Client) nextPingInterval(now time.Time) time.Duration {
 		hotActivityWindow  = 5 * time.Second
 		warmActivityWindow = 30 * time.Second
 	)
-	if p.activeConnCount() > 0 || now.Sub(p.lastActivity()) <= hotActivityWindow {
+	if p.activeConnCount() > 0 || len(p.reverse) > 0 || p.tun != nil || now.Sub(p.lastActivity()) <= hotActivityWindow {
 		return time.Second
 	}
 	if now.Sub(p.lastActivity()) <= warmActivityWindow {
@@ -264,13 +377,13 @@ func (p *Client) maybeRefreshServerAddr(now time.Time) {
 		return
 	}
 
-	if p.ipaddrServer == nil || p.ipaddrServer.String() != ipaddrServer.String() {
-		loggo.Info("server ip refreshed %v -> %v", p.ipaddrServer, ipaddrServer)
-		p.ipaddrServer = ipaddrServer
+	if old := p.ipaddrServer.Load(); old == nil || old.String() != ipaddrServer.String() {
+		loggo.Info("server ip refreshed %v -> %v", old, ipaddrServer)
+		p.ipaddrServer.Store(ipaddrServer)
 	}
 
 	p.resolveRetryBackoff = 2 * time.Second
-	if now.Sub(p.pongTime) > 3*time.Second {
+	if now.Sub(p.pongTime.Load()) > 3*time.Second {
 		p.nextResolveAt = now.Add(5 * time.Second)
 		return
 	}
@@ -286,31 +399,82 @@ func (p *Client) Run() error {
 	}
 	p.conn = conn
 
-	if p.tcpmode > 0 {
-		tcplistenConn, err := net.ListenTCP("tcp", p.tcpaddr)
-		if err != nil {
-			loggo.Error("Error listening for tcp packets: %s", err.Error())
+	if p.addr != "" {
+		if p.tcpmode > 0 {
+			var tcplistenConn *net.TCPListener
+			if p.transparent == TRANSPARENT_TPROXY {
+				tcplistenConn, err = listenTransparentTCP(p.tcpaddr)
+			} else {
+				tcplistenConn, err = net.ListenTCP("tcp", p.tcpaddr)
+			}
+			if err != nil {
+				loggo.Error("Error listening for tcp packets: %s", err.Error())
+				return err
+			}
+			p.tcplistenConn = tcplistenConn
+		} else {
+			var listener *net.UDPConn
+			if p.transparent == TRANSPARENT_TPROXY {
+				listener, err = listenTransparentUDP(p.ipaddr)
+			} else {
+				listener, err = net.ListenUDP("udp", p.ipaddr)
+			}
+			if err != nil {
+				loggo.Error("Error listening for udp packets: %s", err.Error())
+				return err
+			}
+			p.listenConn = listener
+		}
+
+		if p.tcpmode > 0 {
+			go p.AcceptTcp()
+		} else if p.transparent == TRANSPARENT_TPROXY {
+			go p.AcceptTransparentUdp()
+		} else {
+			go p.Accept()
+		}
+	}
+
+	for _, l := range p.listeners {
+		if err := p.startListener(l); err != nil {
+			loggo.Error("Error listening %s: %s", l.config, err.Error())
 			return err
 		}
-		p.tcplistenConn = tcplistenConn
-	} else {
-		listener, err := net.ListenUDP("udp", p.ipaddr)
+	}
+
+	if p.tun != nil {
+		tunDev, err := openTunDevice(p.tun, p.ipaddrServer.Load().String())
 		if err != nil {
-			loggo.Error("Error listening for udp packets: %s", err.Error())
+			loggo.Error("Error open tun: %s", err.Error())
 			return err
 		}
-		p.listenConn = listener
+		p.tunDev = tunDev
+		go p.AcceptTun()
 	}
 
-	if p.tcpmode > 0 {
-		go p.AcceptTcp()
-	} else {
-		go p.Accept()
+	if p.dns != nil && p.dns.ListenAddr != "" {
+		udpaddr, err := net.ResolveUDPAddr("udp", p.dns.ListenAddr)
+		if err == nil {
+			p.dnsUdpConn, err = net.ListenUDP("udp", udpaddr)
+		}
+		if err != nil {
+			loggo.Error("Error listening for dns udp: %s", err.Error())
+			return err
+		}
+		tcpaddr, err := net.ResolveTCPAddr("tcp", p.dns.ListenAddr)
+		if err == nil {
+			p.dnsTcpListener, err = net.ListenTCP("tcp", tcpaddr)
+		}
+		if err != nil {
+			loggo.Error("Error listening for dns tcp: %s", err.Error())
+			return err
+		}
+		go p.AcceptDnsUdp()
+		go p.AcceptDnsTcp()
 	}
 
 	recv := make(chan *Packet, 10000)
-	p.recvcontrol = make(chan int, 1)
-	go recvICMP(&p.workResultLock, &p.exit, *p.conn, recv, p.cryptoConfig)
+	go recvICMP(p.ctx, &p.workResultLock, *p.conn, recv, p.cryptoConfig.Load(), p.decryptthread)
 
 	go func() {
 		defer common.CrashLog()
@@ -322,17 +486,28 @@ func (p *Client) Run() error {
 		defer ticker.Stop()
 
 		nextPingAt := time.Now()
-		for !p.exit {
+		nextRouteStatAt := nextPingAt.Add(time.Minute)
+		for {
 			p.checkTimeoutConn()
+			p.checkTimeoutReverse()
 			p.showNet()
 
 			now := time.Now()
 			if !now.Before(nextPingAt) {
 				p.ping()
+				p.registerReverse()
 				nextPingAt = now.Add(p.nextPingInterval(now))
 			}
+			if route := p.settings.Load().Route; route != nil && !now.Before(nextRouteStatAt) {
+				route.ShowHits()
+				nextRouteStatAt = now.Add(time.Minute)
+			}
 			p.maybeRefreshServerAddr(now)
-			<-ticker.C
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-ticker.C:
+			}
 		}
 	}()
 
@@ -342,9 +517,9 @@ func (p *Client) Run() error {
 		p.workResultLock.Add(1)
 		defer p.workResultLock.Done()
 
-		for !p.exit {
+		for {
 			select {
-			case <-p.recvcontrol:
+			case <-p.ctx.Done():
 				return
 			case r := <-recv:
 				p.processPacket(r)
@@ -356,9 +531,11 @@ func (p *Client) Run() error {
 }
 
 func (p *Client) Stop() {
-	p.exit = true
-	p.recvcontrol <- 1
+	p.cancel()
 	p.workResultLock.Wait()
+	if p.processtp != nil {
+		p.processtp.Stop()
+	}
 	p.conn.Close()
 	if p.tcplistenConn != nil {
 		p.tcplistenConn.Close()
@@ -366,21 +543,138 @@ func (p *Client) Stop() {
 	if p.listenConn != nil {
 		p.listenConn.Close()
 	}
+	for _, l := range p.listeners {
+		if l.tcpListener != nil {
+			l.tcpListener.Close()
+		}
+		if l.udpConn != nil {
+			l.udpConn.Close()
+		}
+	}
+	if p.tunDev != nil {
+		closeTunDevice(p.tun, p.tunDev, p.ipaddrServer.Load().String())
+	}
+	if p.dnsUdpConn != nil {
+		p.dnsUdpConn.Close()
+	}
+	if p.dnsTcpListener != nil {
+		p.dnsTcpListener.Close()
+	}
+}
+
+// Shutdown stops taking new sessions and ends the live ones through the
+// tunnel so the server learns they are gone: tcp sessions send their queued
+// data and a close frame, udp flows are kicked. It waits up to drain for them
+// to finish and then stops the client.
+func (p *Client) Shutdown(drain time.Duration) ShutdownStats {
+	begin := time.Now()
+	p.draining.Store(true)
+	if p.tcplistenConn != nil {
+		p.tcplistenConn.Close()
+	}
+	for _, l := range p.listeners {
+		if l.tcpListener != nil {
+			l.tcpListener.Close()
+		}
+	}
+
+	stats := ShutdownStats{}
+	p.localIdToConnMap.Range(func(key, value interface{}) bool {
+		clientConn := value.(*ClientConn)
+		stats.Sessions++
+		if clientConn.tcpmode > 0 {
+			// transferTcpConn sees draining and closes the frame manager
+			notifyActivity(clientConn.activity)
+			return true
+		}
+		p.remoteError(clientConn.id)
+		p.close(clientConn)
+		return true
+	})
+	loggo.Info("client draining %d sessions", stats.Sessions)
+
+	stats.Remaining = waitDrained(drain, p.activeConnCount)
+	// a half closed peer may never finish, kick what is left so the server
+	// does not wait for its own timeout
+	p.localIdToConnMap.Range(func(key, value interface{}) bool {
+		clientConn := value.(*ClientConn)
+		p.remoteError(clientConn.id)
+		p.close(clientConn)
+		return true
+	})
+	p.Stop()
+	stats.Elapsed = time.Since(begin)
+	return stats
 }
 
 func (p *Client) AcceptTcp() error {
+	return p.acceptTcp(p.tcplistenConn, func(conn *net.TCPConn) {
+		if p.open_sock5 > 0 {
+			p.AcceptSock5Conn(conn)
+		} else if p.open_http > 0 {
+			p.AcceptHttpConn(conn)
+		} else if p.transparent != "" {
+			p.AcceptTransparentConn(conn)
+		} else {
+			p.AcceptTcpConn(conn, p.targetAddr, nil)
+		}
+	})
+}
+
+// startListener opens an extra listener and serves it like -l with the
+// matching mode.
+func (p *Client) startListener(l *clientListener) error {
+	if l.config.Type == LISTENER_UDP {
+		udpaddr, err := net.ResolveUDPAddr("udp", l.config.Listen)
+		if err != nil {
+			return err
+		}
+		l.udpConn, err = net.ListenUDP("udp", udpaddr)
+		if err != nil {
+			return err
+		}
+		loggo.Info("client listen %s", l.config)
+		go p.acceptUdp(l.udpConn, l.config.Target)
+		return nil
+	}
+
+	tcpaddr, err := net.ResolveTCPAddr("tcp", l.config.Listen)
+	if err != nil {
+		return err
+	}
+	l.tcpListener, err = net.ListenTCP("tcp", tcpaddr)
+	if err != nil {
+		return err
+	}
+	loggo.Info("client listen %s", l.config)
+
+	switch l.config.Type {
+	case LISTENER_SOCKS5:
+		go p.acceptTcp(l.tcpListener, p.AcceptSock5Conn)
+	case LISTENER_HTTP:
+		go p.acceptTcp(l.tcpListener, p.AcceptHttpConn)
+	default:
+		target := l.config.Target
+		go p.acceptTcp(l.tcpListener, func(conn *net.TCPConn) {
+			p.AcceptTcpConn(conn, target, nil)
+		})
+	}
+	return nil
+}
+
+func (p *Client) acceptTcp(listener *net.TCPListener, handle func(conn *net.TCPConn)) error {
 
 	defer common.CrashLog()
 
 	p.workResultLock.Add(1)
 	defer p.workResultLock.Done()
 
-	loggo.Info("client waiting local accept tcp")
+	loggo.Info("client waiting local accept tcp %s", listener.Addr())
 
-	for !p.exit {
-		p.tcplistenConn.SetDeadline(time.Now().Add(time.Millisecond * 1000))
+	for p.ctx.Err() == nil && !p.draining.Load() {
+		listener.SetDeadline(time.Now().Add(time.Millisecond * 1000))
 
-		conn, err := p.tcplistenConn.AcceptTCP()
+		conn, err := listener.AcceptTCP()
 		if err != nil {
 			nerr, ok := err.(net.Error)
 			if !ok || !nerr.Timeout() {
@@ -390,17 +684,17 @@ func (p *Client) AcceptTcp() error {
 		}
 
 		if conn != nil {
-			if p.open_sock5 > 0 {
-				go p.AcceptSock5Conn(conn)
-			} else {
-				go p.AcceptTcpConn(conn, p.targetAddr)
-			}
+			go handle(conn)
 		}
 	}
 	return nil
 }
 
-func (p *Client) AcceptTcpConn(conn *net.TCPConn, targetAddr string) {
+func (p *Client) AcceptTcpConn(conn net.Conn, targetAddr string, server *net.IPAddr) {
+	p.acceptTcpConn(conn, targetAddr, server, nil)
+}
+
+func (p *Client) acceptTcpConn(conn net.Conn, targetAddr string, server *net.IPAddr, reply func(connected bool, reason int) error) {
 
 	defer common.CrashLog()
 
@@ -409,8 +703,21 @@ func (p *Client) AcceptTcpConn(conn *net.TCPConn, targetAddr string) {
 
 	tcpsrcaddr := conn.RemoteAddr().(*net.TCPAddr)
 
-	if p.maxconn > 0 && p.localIdToConnMapSize >= p.maxconn {
-		loggo.Info("too many connections %d, client accept new local tcp fail %s", p.localIdToConnMapSize, tcpsrcaddr.String())
+	if p.draining.Load() {
+		loggo.Info("shutting down, client refuse new local tcp %s", tcpsrcaddr.String())
+		if reply != nil {
+			reply(false, KICK_REASON_SHUTDOWN)
+		}
+		conn.Close()
+		return
+	}
+
+	if maxconn := p.settings.Load().MaxConn; maxconn > 0 && (int)(p.localIdToConnMapSize.Load()) >= maxconn {
+		loggo.Info("too many connections %d, client accept new local tcp fail %s", p.localIdToConnMapSize.Load(), tcpsrcaddr.String())
+		if reply != nil {
+			reply(false, KICK_REASON_TOO_MANY)
+			conn.Close()
+		}
 		return
 	}
 
@@ -418,86 +725,107 @@ func (p *Client) AcceptTcpConn(conn *net.TCPConn, targetAddr string) {
 
 	fm := network.NewFrameMgr(FRAME_MAX_SIZE, FRAME_MAX_ID, p.tcpmode_buffersize, p.tcpmode_maxwin, p.tcpmode_resend_timems, p.tcpmode_compress, p.tcpmode_stat)
 
-	now := time.Now()
-	clientConn := &ClientConn{exit: false, tcpaddr: tcpsrcaddr, id: uuid, tcpmode: p.tcpmode, activeRecvTime: now, activeSendTime: now, close: false,
-		activity: make(chan struct{}, 1),
-		fm:       fm}
+	// tcp listeners of the config file work even when -l is udp
+	tcpmode := p.tcpmode
+	if tcpmode == 0 {
+		tcpmode = 1
+	}
+
+	clientConn := &ClientConn{tcpaddr: tcpsrcaddr, id: uuid, tcpmode: tcpmode,
+		activity:     make(chan struct{}, 1),
+		server:       server,
+		connectReply: reply,
+		fm:           fm,
+		clock:        newFrameClock(p.tcpmode_resend_timems)}
 	p.addClientConn(uuid, tcpsrcaddr.String(), clientConn)
 	loggo.Info("client accept new local tcp %s %s", uuid, tcpsrcaddr.String())
 	p.touchActivity()
 
 	loggo.Info("start connect remote tcp %s %s", uuid, tcpsrcaddr.String())
 	clientConn.fm.Connect()
-	startConnectTime := common.GetNowUpdateInSecond()
-	connectWait := newAdaptiveLoopWait(2*time.Millisecond, 80*time.Millisecond)
-	for !p.exit && !clientConn.exit {
+
+	p.transferTcpConn(conn, clientConn, targetAddr)
+}
+
+func (p *Client) transferTcpConn(conn net.Conn, clientConn *ClientConn, targetAddr string) {
+
+	uuid := clientConn.id
+	tcpsrcaddr := clientConn.tcpaddr
+	// a reloaded timeout applies to the next session, a reloaded key to the
+	// next frame since the server may stop accepting the old one
+	settings := p.settings.Load()
+
+	// the loops wake on frames from the server, local data and the frame
+	// manager's timers
+	defer clientConn.clock.stop()
+
+	startConnectTime := time.Now()
+	for clientConn.ctx.Err() == nil {
 		if clientConn.fm.IsConnected() {
 			break
 		}
 		clientConn.fm.Update()
 		sendlist := clientConn.fm.GetSendList()
+		clientConn.clock.sent(sendlist, time.Now())
 		hadWork := sendlist.Len() > 0
 		for e := sendlist.Front(); e != nil; e = e.Next() {
 			f := e.Value.(*network.Frame)
 			mb, _ := clientConn.fm.MarshalFrame(f)
-			p.sequence++
-			sendICMP(p.id, p.sequence, *p.conn, p.ipaddrServer, targetAddr, clientConn.id, (uint32)(MyMsg_DATA), mb,
-				SEND_PROTO, RECV_PROTO, p.key,
-				p.tcpmode, p.tcpmode_buffersize, p.tcpmode_maxwin, p.tcpmode_resend_timems, p.tcpmode_compress, p.tcpmode_stat,
-				p.timeout, p.cryptoConfig)
-			p.sendPacket++
-			p.sendPacketSize += (uint64)(len(mb))
-		}
-		now := common.GetNowUpdateInSecond()
+			sendICMP(p.id, p.nextSequence(), *p.conn, p.connServer(clientConn), targetAddr, clientConn.id, (uint32)(MyMsg_DATA), mb,
+				SEND_PROTO, RECV_PROTO, p.settings.Load().Key,
+				clientConn.tcpmode, p.tcpmode_buffersize, p.tcpmode_maxwin, p.tcpmode_resend_timems, p.tcpmode_compress, p.tcpmode_stat,
+				settings.Timeout, p.cryptoConfig.Load())
+			p.sendPacket.Add(1)
+			p.sendPacketSize.Add((uint64)(len(mb)))
+		}
+		now := time.Now()
 		diffclose := now.Sub(startConnectTime)
 		if diffclose > time.Second*5 {
 			loggo.Info("can not connect remote tcp %s %s", uuid, tcpsrcaddr.String())
+			p.replyConnect(conn, clientConn, false, KICK_REASON_TIMEOUT)
 			p.close(clientConn)
 			return
 		}
 		if hadWork {
-			connectWait.hit()
 			continue
 		}
-		wait := connectWait.miss()
 		select {
+		case <-clientConn.ctx.Done():
 		case <-clientConn.activity:
-			connectWait.hit()
-		case <-time.After(wait):
+		case <-clientConn.clock.after(time.Now()):
 		}
 	}
 
-	if !clientConn.exit {
+	if clientConn.ctx.Err() == nil {
 		loggo.Info("connected remote tcp %s %s", uuid, tcpsrcaddr.String())
+		p.replyConnect(conn, clientConn, true, KICK_REASON_NONE)
+	} else {
+		p.replyConnect(conn, clientConn, false, clientConn.kickReason)
 	}
 
 	bytes := make([]byte, 10240)
 
-	tcpActiveRecvUnix := atomic.Int64{}
-	tcpActiveRecvUnix.Store(common.GetNowUpdateInSecond().UnixNano())
-	tcpActiveSendTime := common.GetNowUpdateInSecond()
+	var tcpActiveRecvTime atomicTime
+	tcpActiveRecvTime.Store(time.Now())
+	tcpActiveSendTime := time.Now()
 	readErr := make(chan error, 1)
 	stopRead := make(chan struct{})
+	// the send buffer only drains in Update, which signals room on sendSpace
+	sendSpace := make(chan struct{}, 1)
 
 	go func() {
 		defer common.CrashLog()
 
-		readWait := newAdaptiveLoopWait(2*time.Millisecond, 80*time.Millisecond)
-		for !p.exit && !clientConn.exit {
+		for clientConn.ctx.Err() == nil {
 			left := common.MinOfInt(clientConn.fm.GetSendBufferLeft(), len(bytes))
 			if left <= 0 {
-				wait := readWait.miss()
 				select {
 				case <-stopRead:
 					return
-				case <-clientConn.activity:
-					readWait.hit()
-					continue
-				case <-time.After(wait):
+				case <-sendSpace:
 					continue
 				}
 			}
-			readWait.hit()
 
 			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
 			n, err := conn.Read(bytes[0:left])
@@ -517,25 +845,45 @@ func (p *Client) AcceptTcpConn(conn *net.TCPConn, targetAddr string) {
 			}
 
 			clientConn.fm.WriteSendBuffer(bytes[:n])
-			tcpActiveRecvUnix.Store(common.GetNowUpdateInSecond().UnixNano())
+			tcpActiveRecvTime.Store(time.Now())
 			p.touchActivity()
 			notifyActivity(clientConn.activity)
 		}
 	}()
 
-	loopWait := newAdaptiveLoopWait(2*time.Millisecond, 250*time.Millisecond)
+	// a clean EOF from either side only closes that direction, the session
+	// ends once both are done
+	localEOF := false
+	remoteEOF := false
+	onReadErr := func(err error) bool {
+		if err == io.EOF && !remoteEOF {
+			loggo.Info("half closed by local conn %s %s", uuid, tcpsrcaddr.String())
+			localEOF = true
+			clientConn.fm.Close()
+			return false
+		}
+		if err != io.EOF {
+			loggo.Info("Error read tcp %s %s %s", uuid, tcpsrcaddr.String(), err)
+		}
+		clientConn.fm.Close()
+		return true
+	}
 
 mainLoop:
-	for !p.exit && !clientConn.exit {
-		now := common.GetNowUpdateInSecond()
+	for clientConn.ctx.Err() == nil {
+		now := time.Now()
 		hadWork := false
 
 		clientConn.fm.Update()
+		if clientConn.fm.GetSendBufferLeft() > 0 {
+			notifyActivity(sendSpace)
+		}
 
 		sendlist := clientConn.fm.GetSendList()
+		clientConn.clock.sent(sendlist, time.Now())
 		if sendlist.Len() > 0 {
 			hadWork = true
-			clientConn.activeSendTime = now
+			clientConn.activeSendTime.Store(now)
 			for e := sendlist.Front(); e != nil; e = e.Next() {
 				f := e.Value.(*network.Frame)
 				mb, err := clientConn.fm.MarshalFrame(f)
@@ -543,13 +891,12 @@ mainLoop:
 					loggo.Error("Error tcp Marshal %s %s %s", uuid, tcpsrcaddr.String(), err)
 					continue
 				}
-				p.sequence++
-				sendICMP(p.id, p.sequence, *p.conn, p.ipaddrServer, targetAddr, clientConn.id, (uint32)(MyMsg_DATA), mb,
-					SEND_PROTO, RECV_PROTO, p.key,
-					p.tcpmode, 0, 0, 0, 0, 0,
-					0, p.cryptoConfig)
-				p.sendPacket++
-				p.sendPacketSize += (uint64)(len(mb))
+				sendICMP(p.id, p.nextSequence(), *p.conn, p.connServer(clientConn), targetAddr, clientConn.id, (uint32)(MyMsg_DATA), mb,
+					SEND_PROTO, RECV_PROTO, p.settings.Load().Key,
+					clientConn.tcpmode, 0, 0, 0, 0, 0,
+					0, p.cryptoConfig.Load())
+				p.sendPacket.Add(1)
+				p.sendPacketSize.Add((uint64)(len(mb)))
 			}
 			p.touchActivity()
 		}
@@ -576,69 +923,71 @@ mainLoop:
 
 		select {
 		case err := <-readErr:
-			if err != nil {
-				loggo.Info("Error read tcp %s %s %s", uuid, tcpsrcaddr.String(), err)
-				clientConn.fm.Close()
+			if err != nil && onReadErr(err) {
 				break mainLoop
 			}
 		default:
 		}
 
-		diffrecv := now.Sub(clientConn.activeRecvTime)
-		diffsend := now.Sub(clientConn.activeSendTime)
-		tcpdiffrecv := now.Sub(time.Unix(0, tcpActiveRecvUnix.Load()))
+		if p.draining.Load() {
+			loggo.Info("shutting down, close conn %s %s", clientConn.id, clientConn.tcpaddr.String())
+			break
+		}
+
+		diffrecv := now.Sub(clientConn.activeRecvTime.Load())
+		diffsend := now.Sub(clientConn.activeSendTime.Load())
+		tcpdiffrecv := now.Sub(tcpActiveRecvTime.Load())
 		tcpdiffsend := now.Sub(tcpActiveSendTime)
-		if diffrecv > time.Second*(time.Duration(p.timeout)) || diffsend > time.Second*(time.Duration(p.timeout)) ||
-			(tcpdiffrecv > time.Second*(time.Duration(p.timeout)) && tcpdiffsend > time.Second*(time.Duration(p.timeout))) {
+		if diffrecv > time.Second*(time.Duration(settings.Timeout)) || diffsend > time.Second*(time.Duration(settings.Timeout)) ||
+			(tcpdiffrecv > time.Second*(time.Duration(settings.Timeout)) && tcpdiffsend > time.Second*(time.Duration(settings.Timeout))) {
 			loggo.Info("close inactive conn %s %s", clientConn.id, clientConn.tcpaddr.String())
 			clientConn.fm.Close()
 			break
 		}
 
-		if clientConn.fm.IsRemoteClosed() {
-			loggo.Info("closed by remote conn %s %s", clientConn.id, clientConn.tcpaddr.String())
-			clientConn.fm.Close()
-			break
+		if clientConn.fm.IsRemoteClosed() && clientConn.fm.GetRecvBufferSize() == 0 && !remoteEOF {
+			if localEOF || !closeWrite(conn) {
+				loggo.Info("closed by remote conn %s %s", clientConn.id, clientConn.tcpaddr.String())
+				clientConn.fm.Close()
+				break
+			}
+			loggo.Info("half closed by remote conn %s %s", clientConn.id, clientConn.tcpaddr.String())
+			remoteEOF = true
 		}
 
 		if !hadWork {
-			wait := loopWait.miss()
 			select {
+			case <-clientConn.ctx.Done():
 			case <-clientConn.activity:
-				loopWait.hit()
 			case err := <-readErr:
-				if err != nil {
-					loggo.Info("Error read tcp %s %s %s", uuid, tcpsrcaddr.String(), err)
-					clientConn.fm.Close()
+				if err != nil && onReadErr(err) {
 					break mainLoop
 				}
-			case <-time.After(wait):
+			case <-clientConn.clock.after(time.Now()):
 			}
-		} else {
-			loopWait.hit()
 		}
 	}
 	close(stopRead)
 
 	clientConn.fm.Close()
 
-	startCloseTime := common.GetNowUpdateInSecond()
-	for !p.exit && !clientConn.exit {
-		now := common.GetNowUpdateInSecond()
+	startCloseTime := time.Now()
+	for clientConn.ctx.Err() == nil {
+		now := time.Now()
 
 		clientConn.fm.Update()
 
 		sendlist := clientConn.fm.GetSendList()
+		clientConn.clock.sent(sendlist, time.Now())
 		for e := sendlist.Front(); e != nil; e = e.Next() {
 			f := e.Value.(*network.Frame)
 			mb, _ := clientConn.fm.MarshalFrame(f)
-			p.sequence++
-			sendICMP(p.id, p.sequence, *p.conn, p.ipaddrServer, targetAddr, clientConn.id, (uint32)(MyMsg_DATA), mb,
-				SEND_PROTO, RECV_PROTO, p.key,
-				p.tcpmode, 0, 0, 0, 0, 0,
-				0, p.cryptoConfig)
-			p.sendPacket++
-			p.sendPacketSize += (uint64)(len(mb))
+			sendICMP(p.id, p.nextSequence(), *p.conn, p.connServer(clientConn), targetAddr, clientConn.id, (uint32)(MyMsg_DATA), mb,
+				SEND_PROTO, RECV_PROTO, p.settings.Load().Key,
+				clientConn.tcpmode, 0, 0, 0, 0, 0,
+				0, p.cryptoConfig.Load())
+			p.sendPacket.Add(1)
+			p.sendPacketSize.Add((uint64)(len(mb)))
 		}
 
 		nodatarecv := true
@@ -664,7 +1013,13 @@ mainLoop:
 			break
 		}
 
-		time.Sleep(time.Millisecond * 100)
+		if clientConn.fm.GetRecvBufferSize() == 0 {
+			select {
+			case <-clientConn.ctx.Done():
+			case <-clientConn.activity:
+			case <-clientConn.clock.after(time.Now()):
+			}
+		}
 	}
 
 	loggo.Info("close tcp conn %s %s", clientConn.id, clientConn.tcpaddr.String())
@@ -672,20 +1027,41 @@ mainLoop:
 	p.close(clientConn)
 }
 
+// replyConnect sends the held reply of a session, a failed session is closed.
+func (p *Client) replyConnect(conn net.Conn, clientConn *ClientConn, connected bool, reason int) {
+	reply := clientConn.connectReply
+	if reply == nil {
+		return
+	}
+	clientConn.connectReply = nil
+	if err := reply(connected, reason); err != nil {
+		loggo.Info("send connect reply fail %s %s", clientConn.id, err)
+		conn.Close()
+		return
+	}
+	if !connected {
+		conn.Close()
+	}
+}
+
 func (p *Client) Accept() error {
+	return p.acceptUdp(p.listenConn, p.targetAddr)
+}
+
+func (p *Client) acceptUdp(listenConn *net.UDPConn, targetAddr string) error {
 
 	defer common.CrashLog()
 
 	p.workResultLock.Add(1)
 	defer p.workResultLock.Done()
 
-	loggo.Info("client waiting local accept udp")
+	loggo.Info("client waiting local accept udp %s", listenConn.LocalAddr())
 
-	bytes := make([]byte, 10240)
+	bytes := make([]byte, UDP_FRAG_MAX_DATAGRAM)
 
-	for !p.exit {
-		p.listenConn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
-		n, srcaddr, err := p.listenConn.ReadFromUDP(bytes)
+	for p.ctx.Err() == nil {
+		listenConn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, srcaddr, err := listenConn.ReadFromUDP(bytes)
 		if err != nil {
 			nerr, ok := err.(net.Error)
 			if !ok || !nerr.Timeout() {
@@ -697,29 +1073,35 @@ func (p *Client) Accept() error {
 			continue
 		}
 
-		now := common.GetNowUpdateInSecond()
-		clientConn := p.getClientConnByAddr(srcaddr.String())
+		now := time.Now()
+		settings := p.settings.Load()
+		addrKey := srcaddr.String()
+		if listenConn != p.listenConn {
+			// the same source may talk to several listeners
+			addrKey = listenConn.LocalAddr().String() + "|" + addrKey
+		}
+		clientConn := p.getClientConnByAddr(addrKey)
 		if clientConn == nil {
-			if p.maxconn > 0 && p.localIdToConnMapSize >= p.maxconn {
-				loggo.Info("too many connections %d, client accept new local udp fail %s", p.localIdToConnMapSize, srcaddr.String())
+			if p.draining.Load() {
+				continue
+			}
+			if settings.MaxConn > 0 && (int)(p.localIdToConnMapSize.Load()) >= settings.MaxConn {
+				loggo.Info("too many connections %d, client accept new local udp fail %s", p.localIdToConnMapSize.Load(), srcaddr.String())
 				continue
 			}
 			uuid := common.UniqueId()
-			clientConn = &ClientConn{exit: false, ipaddr: srcaddr, id: uuid, tcpmode: 0, activeRecvTime: now, activeSendTime: now, close: false}
-			p.addClientConn(uuid, srcaddr.String(), clientConn)
+			clientConn = &ClientConn{ipaddr: srcaddr, id: uuid, tcpmode: 0,
+				listenConn: listenConn}
+			p.addClientConn(uuid, addrKey, clientConn)
 			loggo.Info("client accept new local udp %s %s", uuid, srcaddr.String())
 		}
 
-		clientConn.activeSendTime = now
-		sendICMP(p.id, p.sequence, *p.conn, p.ipaddrServer, p.targetAddr, clientConn.id, (uint32)(MyMsg_DATA), bytes[:n],
-			SEND_PROTO, RECV_PROTO, p.key,
-			clientConn.tcpmode, 0, 0, 0, 0, 0,
-			p.timeout, p.cryptoConfig)
-
-		p.sequence++
+		clientConn.activeSendTime.Store(now)
+		sendICMPUDP(p.id, p.nextSequence(), *p.conn, p.ipaddrServer.Load(), targetAddr, clientConn.id, bytes[:n],
+			SEND_PROTO, RECV_PROTO, settings.Key, settings.Timeout, UDP_MODE_CONNECTED, p.cryptoConfig.Load())
 
-		p.sendPacket++
-		p.sendPacketSize += (uint64)(n)
+		p.sendPacket.Add(1)
+		p.sendPacketSize.Add((uint64)(n))
 		p.touchActivity()
 	}
 	return nil
@@ -731,45 +1113,96 @@ func (p *Client) processPacket(packet *Packet) {
 		return
 	}
 
-	if packet.my.Key != (int32)(p.key) {
+	if settings := p.settings.Load(); !acceptKey(packet.my.Key, settings.Key, settings.AcceptKeys) {
 		return
 	}
 
-	if !icmpDatagram && packet.echoId != p.id {
+	if !icmpDatagram.Load() && packet.echoId != p.id {
 		return
 	}
 
+	if packet.my.FragCount > 1 {
+		data := p.frag.add(packet.my.Id, packet.my.FragId, (int)(packet.my.FragIndex), (int)(packet.my.FragCount), packet.my.Data, time.Now())
+		if data == nil {
+			return
+		}
+		packet.my.Data = data
+	}
+
 	if packet.my.Type == (int32)(MyMsg_PING) {
 		t := time.Time{}
 		t.UnmarshalBinary(packet.my.Data)
 		now := time.Now()
 		d := now.Sub(t)
 		loggo.Info("pong from %s %s", packet.src.String(), d.String())
-		p.rtt = d
-		p.pongTime = now
+		p.rtt.Store((int64)(d))
+		p.pongTime.Store(now)
+		p.pickSuite(packet.crypto, now)
 		return
 	}
 
-	if packet.my.Type == (int32)(MyMsg_KICK) {
-		clientConn := p.getClientConnById(packet.my.Id)
-		if clientConn != nil {
-			p.close(clientConn)
-			loggo.Info("remote kick local %s", packet.my.Id)
-		}
+	if packet.my.Type == (int32)(MyMsg_REVERSE) {
+		p.processReverseReply(packet)
+		return
+	}
+
+	if packet.my.Type == (int32)(MyMsg_TUN) {
+		p.processTunPacket(packet)
+		return
+	}
+
+	if packet.my.Type == (int32)(MyMsg_DNS) {
+		p.processDnsReply(packet)
 		return
 	}
 
+	// a session's KICK and BIND replies go through its shard like its data,
+	// behind the frames that came before them
+	if p.maxprocessthread > 0 {
+		p.processtp.AddJob((int)(common.HashString(packet.my.Id)), packet)
+	} else {
+		p.processSessionPacket(packet)
+	}
+}
+
+func (p *Client) processSessionPacket(packet *Packet) {
+	switch packet.my.Type {
+	case (int32)(MyMsg_BIND):
+		p.processBindReply(packet)
+	case (int32)(MyMsg_KICK):
+		p.processKick(packet)
+	default:
+		p.processDataPacket(packet)
+	}
+}
+
+func (p *Client) processKick(packet *Packet) {
+	clientConn := p.getClientConnById(packet.my.Id)
+	if clientConn != nil {
+		clientConn.kickReason = parseKickReason(packet.my.Data)
+		p.close(clientConn)
+		loggo.Info("remote kick local %s %s", packet.my.Id, kickReasonString(clientConn.kickReason))
+	}
+}
+
+func (p *Client) processDataPacket(packet *Packet) {
+
 	loggo.Debug("processPacket %s %s %d", packet.my.Id, packet.src.String(), len(packet.my.Data))
 
 	clientConn := p.getClientConnById(packet.my.Id)
 	if clientConn == nil {
-		loggo.Debug("processPacket no conn %s ", packet.my.Id)
-		p.remoteError(packet.my.Id)
-		return
+		if r := p.getReverseConfigById(packet.my.Target); r != nil {
+			clientConn = p.acceptReverse(packet, r)
+		} else {
+			loggo.Debug("processPacket no conn %s ", packet.my.Id)
+			p.remoteError(packet.my.Id)
+		}
+		if clientConn == nil {
+			return
+		}
 	}
 
-	now := common.GetNowUpdateInSecond()
-	clientConn.activeRecvTime = now
+	clientConn.activeRecvTime.Store(time.Now())
 
 	if clientConn.tcpmode > 0 {
 		f := &network.Frame{}
@@ -779,6 +1212,7 @@ func (p *Client) processPacket(packet *Packet) {
 			return
 		}
 
+		clientConn.clock.received(f)
 		clientConn.fm.OnRecvFrame(f)
 		notifyActivity(clientConn.activity)
 	} else {
@@ -795,42 +1229,63 @@ func (p *Client) processPacket(packet *Packet) {
 			udpPacket, packetErr := buildSocks5UDPDatagram(udpTargetAddr, packet.my.Data)
 			if packetErr != nil {
 				loggo.Info("build socks5 udp datagram error %s", packetErr)
-				clientConn.close = true
+				clientConn.close.Store(true)
 				return
 			}
 			_, err = clientConn.udpRelayConn.WriteToUDP(udpPacket, addr)
+		} else if clientConn.reverseConn != nil {
+			_, err = clientConn.reverseConn.Write(packet.my.Data)
+		} else if clientConn.tproxyConn != nil {
+			_, err = clientConn.tproxyConn.WriteToUDP(packet.my.Data, addr)
+		} else if clientConn.listenConn != nil {
+			_, err = clientConn.listenConn.WriteToUDP(packet.my.Data, addr)
 		} else {
 			_, err = p.listenConn.WriteToUDP(packet.my.Data, addr)
 		}
 		if err != nil {
 			loggo.Info("WriteToUDP Error read udp %s", err)
-			clientConn.close = true
+			clientConn.close.Store(true)
 			return
 		}
 	}
 
-	p.recvPacket++
-	p.recvPacketSize += (uint64)(len(packet.my.Data))
+	p.recvPacket.Add(1)
+	p.recvPacketSize.Add((uint64)(len(packet.my.Data)))
 	if packet.my.Type == (int32)(MyMsg_DATA) && len(packet.my.Data) > 0 {
 		p.touchActivity()
 	}
 }
 
 func (p *Client) close(clientConn *ClientConn) {
-	if clientConn == nil || clientConn.exit {
+	if clientConn == nil {
 		return
 	}
-	clientConn.exit = true
-	if clientConn.id != "" {
-		p.localIdToConnMap.Delete(clientConn.id)
-	}
-	if clientConn.addrKey != "" {
-		p.localAddrToConnMap.Delete(clientConn.addrKey)
-	}
+	clientConn.closeOnce.Do(func() {
+		clientConn.cancel()
+		if clientConn.reverseId != "" {
+			p.reverseClosed.Store(clientConn.id, time.Now())
+		}
+		if clientConn.reverseConn != nil {
+			clientConn.reverseConn.Close()
+		}
+		if clientConn.tproxyConn != nil {
+			clientConn.tproxyConn.Close()
+		}
+		if clientConn.directConn != nil {
+			clientConn.directConn.Close()
+		}
+		if clientConn.id != "" {
+			p.localIdToConnMap.Delete(clientConn.id)
+		}
+		if clientConn.addrKey != "" {
+			p.localAddrToConnMap.Delete(clientConn.addrKey)
+		}
+	})
 }
 
 func (p *Client) checkTimeoutConn() {
 
+	timeout := time.Second * time.Duration(p.settings.Load().Timeout)
 	tmp := make(map[string]*ClientConn)
 	p.localIdToConnMap.Range(func(key, value interface{}) bool {
 		id := key.(string)
@@ -839,15 +1294,15 @@ func (p *Client) checkTimeoutConn() {
 		return true
 	})
 
-	now := common.GetNowUpdateInSecond()
+	now := time.Now()
 	for _, conn := range tmp {
 		if conn.tcpmode > 0 {
 			continue
 		}
-		diffrecv := now.Sub(conn.activeRecvTime)
-		diffsend := now.Sub(conn.activeSendTime)
-		if diffrecv > time.Second*(time.Duration(p.timeout)) || diffsend > time.Second*(time.Duration(p.timeout)) {
-			conn.close = true
+		diffrecv := now.Sub(conn.activeRecvTime.Load())
+		diffsend := now.Sub(conn.activeSendTime.Load())
+		if diffrecv > timeout || diffsend > timeout {
+			conn.close.Store(true)
 		}
 	}
 
@@ -855,7 +1310,7 @@ func (p *Client) checkTimeoutConn() {
 		if conn.tcpmode > 0 {
 			continue
 		}
-		if conn.close {
+		if conn.close.Load() {
 			addr := conn.addrKey
 			if conn.ipaddr != nil {
 				addr = conn.ipaddr.String()
@@ -867,36 +1322,46 @@ func (p *Client) checkTimeoutConn() {
 }
 
 func (p *Client) ping() {
+	key := p.settings.Load().Key
 	now := time.Now()
 	b, _ := now.MarshalBinary()
-	sendICMP(p.id, p.sequence, *p.conn, p.ipaddrServer, "", "", (uint32)(MyMsg_PING), b,
-		SEND_PROTO, RECV_PROTO, p.key,
-		0, 0, 0, 0, 0, 0,
-		0, p.cryptoConfig)
-	loggo.Info("ping %s %s %d %d %d %d", p.addrServer, now.String(), p.sproto, p.rproto, p.id, p.sequence)
-	p.sequence++
-	if now.Sub(p.pongTime) > time.Second*3 {
-		p.rtt = 0
+	// ping in every suite, the pongs tell which ones the server accepts
+	for _, suite := range p.cryptoSuites {
+		sequence := p.nextSequence()
+		sendICMP(p.id, sequence, *p.conn, p.ipaddrServer.Load(), "", "", (uint32)(MyMsg_PING), b,
+			SEND_PROTO, RECV_PROTO, key,
+			0, 0, 0, 0, 0, 0,
+			0, suite)
+		loggo.Info("ping %s %s %d %d %d %d", p.addrServer, now.String(), p.sproto, p.rproto, p.id, sequence)
+	}
+	if now.Sub(p.pongTime.Load()) > time.Second*3 {
+		p.rtt.Store(0)
+	}
+}
+
+// pickSuite sends in the strongest suite the server answered a ping in
+// lately. Until the first pong the strongest configured suite is used.
+func (p *Client) pickSuite(suite *CryptoConfig, now time.Time) {
+	if suite == nil || len(p.cryptoSuites) <= 1 {
+		return
+	}
+	p.suitePongTime[suite.Mode] = now
+	for _, s := range p.cryptoSuites {
+		if now.Sub(p.suitePongTime[s.Mode]) <= SUITE_PONG_TIMEOUT {
+			if old := p.cryptoConfig.Swap(s); old != s {
+				loggo.Info("encryption suite %s", s.Mode)
+			}
+			return
+		}
 	}
 }
 
 func (p *Client) showNet() {
-	p.localAddrToConnMapSize = 0
-	p.localIdToConnMap.Range(func(key, value interface{}) bool {
-		p.localAddrToConnMapSize++
-		return true
-	})
-	p.localIdToConnMapSize = 0
-	p.localIdToConnMap.Range(func(key, value interface{}) bool {
-		p.localIdToConnMapSize++
-		return true
-	})
+	count := (int64)(p.activeConnCount())
+	p.localAddrToConnMapSize.Store(count)
+	p.localIdToConnMapSize.Store(count)
 	loggo.Info("send %dPacket/s %dKB/s recv %dPacket/s %dKB/s %d/%dConnections",
-		p.sendPacket, p.sendPacketSize/1024, p.recvPacket, p.recvPacketSize/1024, p.localAddrToConnMapSize, p.localIdToConnMapSize)
-	p.sendPacket = 0
-	p.recvPacket = 0
-	p.sendPacketSize = 0
-	p.recvPacketSize = 0
+		p.sendPacket.Swap(0), p.sendPacketSize.Swap(0)/1024, p.recvPacket.Swap(0), p.recvPacketSize.Swap(0)/1024, count, count)
 }
 
 func (p *Client) AcceptSock5Conn(conn *net.TCPConn) {
@@ -906,8 +1371,25 @@ func (p *Client) AcceptSock5Conn(conn *net.TCPConn) {
 	p.workResultLock.Add(1)
 	defer p.workResultLock.Done()
 
+	settings := p.settings.Load()
+
+	ver := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ver); err != nil {
+		loggo.Error("read socks version: %s", err)
+		conn.Close()
+		return
+	}
+	r := io.MultiReader(bytes.NewReader(ver), conn)
+	if ver[0] == socks4Version {
+		p.AcceptSock4Conn(conn, r)
+		return
+	}
+
 	var err error = nil
-	if err = network.Sock5HandshakeBy(conn, p.sock5_user, p.sock5_pass); err != nil {
+	if err = network.Sock5HandshakeBy(struct {
+		io.Reader
+		io.Writer
+	}{r, conn}, settings.Sock5User, settings.Sock5Pass); err != nil {
 		loggo.Error("socks handshake: %s", err)
 		conn.Close()
 		return
@@ -922,6 +1404,26 @@ func (p *Client) AcceptSock5Conn(conn *net.TCPConn) {
 
 	switch req.Command {
 	case socks5CmdConnect:
+		action, server := p.routeDecision("tcp", req.Address)
+		if action == ROUTE_ACTION_REJECT {
+			loggo.Info("reject sock5 tcp conn: %s", req.Address)
+			writeSocks5Reply(conn, socks5ReplyConnectionNotAllowed, "0.0.0.0:0")
+			conn.Close()
+			return
+		}
+
+		if settings.Sock5Confirm != 0 {
+			loggo.Info("accept new sock5 tcp conn: %s", req.Address)
+			p.dispatchTcpConnReply(conn, req.Address, action, server, func(connected bool, reason int) error {
+				if connected {
+					return writeSocks5Reply(conn, socks5ReplySucceeded, "0.0.0.0:0")
+				}
+				loggo.Info("sock5 tcp conn fail: %s %s", req.Address, kickReasonString(reason))
+				return writeSocks5Reply(conn, kickReasonSocks5Reply(reason), "0.0.0.0:0")
+			})
+			return
+		}
+
 		// Sending connection established message immediately to client.
 		// This some round trip time for creating socks connection with the client.
 		// But if connection failed, the client will get connection reset error.
@@ -934,14 +1436,18 @@ func (p *Client) AcceptSock5Conn(conn *net.TCPConn) {
 
 		loggo.Info("accept new sock5 tcp conn: %s", req.Address)
 
-		if p.sock5_filter == nil {
-			p.AcceptTcpConn(conn, req.Address)
-		} else {
-			if (*p.sock5_filter)(req.Address) {
-				p.AcceptTcpConn(conn, req.Address)
-				return
-			}
-			p.AcceptDirectTcpConn(conn, req.Address)
+		p.dispatchTcpConn(conn, req.Address, action, server)
+	case socks5CmdBind:
+		action, server := p.routeDecision("tcp", req.Address)
+		switch action {
+		case ROUTE_ACTION_REJECT:
+			loggo.Info("reject sock5 bind: %s", req.Address)
+			writeSocks5Reply(conn, socks5ReplyConnectionNotAllowed, "0.0.0.0:0")
+			conn.Close()
+		case ROUTE_ACTION_DIRECT:
+			p.AcceptDirectBindConn(conn, req.Address)
+		default:
+			p.AcceptSock5BindConn(conn, req.Address, server)
 		}
 	case socks5CmdUDPAssociate:
 		p.AcceptSock5UDPConn(conn, req.Address)
@@ -952,6 +1458,115 @@ func (p *Client) AcceptSock5Conn(conn *net.TCPConn) {
 	}
 }
 
+// AcceptSock4Conn serves a SOCKS4 or SOCKS4a CONNECT on the sock5 listener.
+func (p *Client) AcceptSock4Conn(conn *net.TCPConn, r io.Reader) {
+	settings := p.settings.Load()
+	req, err := readSocks4Request(r)
+	if err != nil {
+		loggo.Error("error getting socks4 request: %s", err)
+		writeSocks4Reply(conn, socks4ReplyRejected)
+		conn.Close()
+		return
+	}
+
+	if !checkSocks4Auth(req.UserId, settings.Sock5User, settings.Sock5Pass) {
+		loggo.Info("socks4 auth fail %s", conn.RemoteAddr().String())
+		writeSocks4Reply(conn, socks4ReplyRejected)
+		conn.Close()
+		return
+	}
+
+	if req.Command != socks4CmdConnect {
+		loggo.Info("unsupported socks4 command: %d", req.Command)
+		writeSocks4Reply(conn, socks4ReplyRejected)
+		conn.Close()
+		return
+	}
+
+	action, server := p.routeDecision("tcp", req.Address)
+	if action == ROUTE_ACTION_REJECT {
+		loggo.Info("reject socks4 tcp conn: %s", req.Address)
+		writeSocks4Reply(conn, socks4ReplyRejected)
+		conn.Close()
+		return
+	}
+
+	if settings.Sock5Confirm != 0 {
+		loggo.Info("accept new socks4 tcp conn: %s", req.Address)
+		p.dispatchTcpConnReply(conn, req.Address, action, server, func(connected bool, reason int) error {
+			if connected {
+				return writeSocks4Reply(conn, socks4ReplyGranted)
+			}
+			loggo.Info("socks4 tcp conn fail: %s %s", req.Address, kickReasonString(reason))
+			return writeSocks4Reply(conn, socks4ReplyRejected)
+		})
+		return
+	}
+
+	err = writeSocks4Reply(conn, socks4ReplyGranted)
+	if err != nil {
+		loggo.Error("send socks4 connection confirmation: %s", err)
+		conn.Close()
+		return
+	}
+
+	loggo.Info("accept new socks4 tcp conn: %s", req.Address)
+
+	p.dispatchTcpConn(conn, req.Address, action, server)
+}
+
+// routeDecision picks how a session to targetAddr is carried, from the route
+// table if one is loaded, otherwise from the sock5 filter.
+func (p *Client) routeDecision(network string, targetAddr string) (string, *net.IPAddr) {
+	if route := p.settings.Load().Route; route != nil {
+		r := route.Match(network, targetAddr, p.ResolveHost)
+		if r == nil {
+			return ROUTE_ACTION_TUNNEL, nil
+		}
+		loggo.Debug("route %s %s match line %d %s", network, targetAddr, r.Line, r.String())
+		return r.Action, r.Server
+	}
+	if network == "tcp" && p.sock5_filter != nil && !(*p.sock5_filter)(targetAddr) {
+		return ROUTE_ACTION_DIRECT, nil
+	}
+	return ROUTE_ACTION_TUNNEL, nil
+}
+
+// routeTcpConn sends conn through the tunnel, dials it directly or rejects it, as decided by routeDecision.
+func (p *Client) routeTcpConn(conn net.Conn, targetAddr string) {
+	action, server := p.routeDecision("tcp", targetAddr)
+	p.dispatchTcpConn(conn, targetAddr, action, server)
+}
+
+func (p *Client) dispatchTcpConn(conn net.Conn, targetAddr string, action string, server *net.IPAddr) {
+	p.dispatchTcpConnReply(conn, targetAddr, action, server, nil)
+}
+
+// dispatchTcpConnReply is dispatchTcpConn for sessions whose proxy reply is
+// held until the target is connected, reply is called once either way.
+func (p *Client) dispatchTcpConnReply(conn net.Conn, targetAddr string, action string, server *net.IPAddr, reply func(connected bool, reason int) error) {
+	switch action {
+	case ROUTE_ACTION_DIRECT:
+		p.acceptDirectTcpConn(conn, targetAddr, reply)
+	case ROUTE_ACTION_REJECT:
+		loggo.Info("reject tcp conn: %s", targetAddr)
+		if reply != nil {
+			reply(false, KICK_REASON_DENIED)
+		}
+		conn.Close()
+	default:
+		p.acceptTcpConn(conn, targetAddr, server, reply)
+	}
+}
+
+// connServer returns the server a session is tunneled to.
+func (p *Client) connServer(clientConn *ClientConn) *net.IPAddr {
+	if clientConn.server != nil {
+		return clientConn.server
+	}
+	return p.ipaddrServer.Load()
+}
+
 func (p *Client) AcceptSock5UDPConn(conn *net.TCPConn, associateAddr string) {
 	relayBind := &net.UDPAddr{}
 	if p.tcpaddr != nil {
@@ -996,7 +1611,7 @@ func (p *Client) AcceptSock5UDPConn(conn *net.TCPConn, associateAddr string) {
 	}()
 
 	ctrlBuf := make([]byte, 1)
-	for !p.exit {
+	for p.ctx.Err() == nil {
 		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
 		_, err := conn.Read(ctrlBuf)
 		if err != nil {
@@ -1025,8 +1640,9 @@ func (p *Client) recvSock5UDP(relayConn *net.UDPConn, expectedIP net.IP, expecte
 
 	bytes := make([]byte, 65535)
 	var sourceAddr *net.UDPAddr
+	routes := make(map[string]sock5UDPRoute)
 
-	for !p.exit {
+	for p.ctx.Err() == nil {
 		relayConn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
 		n, srcaddr, err := relayConn.ReadFromUDP(bytes)
 		if err != nil {
@@ -1034,7 +1650,7 @@ func (p *Client) recvSock5UDP(relayConn *net.UDPConn, expectedIP net.IP, expecte
 			if ok && nerr.Timeout() {
 				continue
 			}
-			if !p.exit {
+			if p.ctx.Err() == nil {
 				loggo.Info("Error read sock5 udp %s", err)
 			}
 			return
@@ -1054,44 +1670,139 @@ func (p *Client) recvSock5UDP(relayConn *net.UDPConn, expectedIP net.IP, expecte
 			continue
 		}
 
-		now := common.GetNowUpdateInSecond()
+		now := time.Now()
+		settings := p.settings.Load()
 		connKey := p.sock5UDPConnKey(relayConn, srcaddr, targetAddr)
+		fullCone := false
+		var route sock5UDPRoute
+		if p.sock5_fullcone != 0 {
+			// every datagram is routed, only tunneled ones share the full-cone session
+			var ok bool
+			route, ok = routes[targetAddr]
+			if !ok {
+				route.action, route.server = p.routeDecision("udp", targetAddr)
+				if len(routes) >= UDP_FULLCONE_ROUTE_CACHE {
+					routes = make(map[string]sock5UDPRoute)
+				}
+				routes[targetAddr] = route
+			}
+			if route.action == ROUTE_ACTION_REJECT {
+				loggo.Debug("reject sock5 udp %s -> %s", srcaddr.String(), targetAddr)
+				continue
+			}
+			if route.action != ROUTE_ACTION_DIRECT {
+				fullCone = true
+				connKey = p.sock5FullConeKey(relayConn, srcaddr, route.server)
+			}
+		}
 		clientConn := p.getClientConnByAddr(connKey)
 		if clientConn == nil {
-			if p.maxconn > 0 && p.localIdToConnMapSize >= p.maxconn {
-				loggo.Info("too many connections %d, client accept new sock5 udp fail %s", p.localIdToConnMapSize, srcaddr.String())
+			if p.draining.Load() {
+				continue
+			}
+			if settings.MaxConn > 0 && (int)(p.localIdToConnMapSize.Load()) >= settings.MaxConn {
+				loggo.Info("too many connections %d, client accept new sock5 udp fail %s", p.localIdToConnMapSize.Load(), srcaddr.String())
 				continue
 			}
+			action, server := route.action, route.server
+			if p.sock5_fullcone == 0 {
+				action, server = p.routeDecision("udp", targetAddr)
+			}
+			if action == ROUTE_ACTION_REJECT {
+				loggo.Debug("reject sock5 udp %s -> %s", srcaddr.String(), targetAddr)
+				continue
+			}
+
 			uuid := common.UniqueId()
 			clientConn = &ClientConn{
-				exit:           false,
-				ipaddr:         copyUDPAddr(srcaddr),
-				id:             uuid,
-				tcpmode:        0,
-				activeRecvTime: now,
-				activeSendTime: now,
-				close:          false,
-				udpRelayConn:   relayConn,
-				udpTargetAddr:  targetAddr,
+				ipaddr:        copyUDPAddr(srcaddr),
+				id:            uuid,
+				tcpmode:       0,
+				udpRelayConn:  relayConn,
+				udpTargetAddr: targetAddr,
+				server:        server,
 			}
+
+			if action == ROUTE_ACTION_DIRECT {
+				directConn, err := dialDirectUDP(targetAddr)
+				if err != nil {
+					loggo.Info("direct local udp dial fail: %s %s", targetAddr, err.Error())
+					continue
+				}
+				clientConn.directConn = directConn
+			}
+
 			p.addClientConn(uuid, connKey, clientConn)
-			loggo.Info("client accept new sock5 udp %s %s -> %s", uuid, srcaddr.String(), targetAddr)
+			loggo.Info("client accept new sock5 udp %s %s -> %s %s", uuid, srcaddr.String(), targetAddr, action)
+
+			if clientConn.directConn != nil {
+				go p.recvSock5DirectUDP(clientConn)
+			}
 		}
 
-		clientConn.activeSendTime = now
+		clientConn.activeSendTime.Store(now)
 
-		sendICMP(p.id, p.sequence, *p.conn, p.ipaddrServer, targetAddr, clientConn.id, (uint32)(MyMsg_DATA), payload,
-			SEND_PROTO, RECV_PROTO, p.key,
-			0, 0, 0, 0, 0, 0,
-			p.timeout, p.cryptoConfig)
+		if clientConn.directConn != nil {
+			_, err := clientConn.directConn.Write(payload)
+			if err != nil {
+				loggo.Info("direct local udp write fail: %s %s", targetAddr, err.Error())
+			}
+			continue
+		}
+
+		udpmode := UDP_MODE_CONNECTED
+		if fullCone {
+			udpmode = UDP_MODE_FULLCONE
+		}
+		sendICMPUDP(p.id, p.nextSequence(), *p.conn, p.connServer(clientConn), targetAddr, clientConn.id, payload,
+			SEND_PROTO, RECV_PROTO, settings.Key, settings.Timeout, udpmode, p.cryptoConfig.Load())
 
-		p.sequence++
-		p.sendPacket++
-		p.sendPacketSize += (uint64)(len(payload))
+		p.sendPacket.Add(1)
+		p.sendPacketSize.Add((uint64)(len(payload)))
 		p.touchActivity()
 	}
 }
 
+func dialDirectUDP(targetAddr string) (*net.UDPConn, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP("udp", nil, udpaddr)
+}
+
+// recvSock5DirectUDP relays the replies of a directly routed sock5 udp flow back to the socks client.
+func (p *Client) recvSock5DirectUDP(clientConn *ClientConn) {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	bytes := make([]byte, 65535)
+
+	for clientConn.ctx.Err() == nil {
+		clientConn.directConn.SetReadDeadline(time.Now().Add(time.Millisecond * 1000))
+		n, err := clientConn.directConn.Read(bytes)
+		if err != nil {
+			nerr, ok := err.(net.Error)
+			if ok && nerr.Timeout() {
+				continue
+			}
+			break
+		}
+
+		clientConn.activeRecvTime.Store(time.Now())
+
+		udpPacket, err := buildSocks5UDPDatagram(clientConn.udpTargetAddr, bytes[:n])
+		if err != nil {
+			loggo.Info("build socks5 udp datagram error %s", err)
+			break
+		}
+		clientConn.udpRelayConn.WriteToUDP(udpPacket, clientConn.ipaddr)
+	}
+}
+
 func (p *Client) allowSock5UDPSource(srcaddr *net.UDPAddr, expectedIP net.IP, expectedPort int, sourceAddr **net.UDPAddr) bool {
 	if expectedIP != nil && !expectedIP.Equal(srcaddr.IP) {
 		return false
@@ -1158,6 +1869,10 @@ func parseSock5UDPAssociateHint(addr string) (net.IP, int) {
 
 func (p *Client) addClientConn(uuid string, addr string, clientConn *ClientConn) {
 
+	now := time.Now()
+	clientConn.ctx, clientConn.cancel = context.WithCancel(p.ctx)
+	clientConn.activeRecvTime.Store(now)
+	clientConn.activeSendTime.Store(now)
 	clientConn.addrKey = addr
 	p.localAddrToConnMap.Store(addr, clientConn)
 	p.localIdToConnMap.Store(uuid, clientConn)
@@ -1180,13 +1895,17 @@ func (p *Client) getClientConnById(uuid string) *ClientConn {
 }
 
 func (p *Client) remoteError(uuid string) {
-	sendICMP(p.id, p.sequence, *p.conn, p.ipaddrServer, "", uuid, (uint32)(MyMsg_KICK), []byte{},
-		SEND_PROTO, RECV_PROTO, p.key,
+	sendICMP(p.id, (int)(p.sequence.Load()), *p.conn, p.ipaddrServer.Load(), "", uuid, (uint32)(MyMsg_KICK), []byte{},
+		SEND_PROTO, RECV_PROTO, p.settings.Load().Key,
 		0, 0, 0, 0, 0, 0,
-		0, p.cryptoConfig)
+		0, p.cryptoConfig.Load())
 }
 
-func (p *Client) AcceptDirectTcpConn(conn *net.TCPConn, targetAddr string) {
+func (p *Client) AcceptDirectTcpConn(conn net.Conn, targetAddr string) {
+	p.acceptDirectTcpConn(conn, targetAddr, nil)
+}
+
+func (p *Client) acceptDirectTcpConn(conn net.Conn, targetAddr string, reply func(connected bool, reason int) error) {
 
 	defer common.CrashLog()
 
@@ -1200,15 +1919,31 @@ func (p *Client) AcceptDirectTcpConn(conn *net.TCPConn, targetAddr string) {
 	tcpaddrTarget, err := net.ResolveTCPAddr("tcp", targetAddr)
 	if err != nil {
 		loggo.Info("direct local tcp ResolveTCPAddr fail: %s %s", targetAddr, err.Error())
+		if reply != nil {
+			reply(false, KICK_REASON_DNS)
+			conn.Close()
+		}
 		return
 	}
 
 	targetconn, err := net.DialTCP("tcp", nil, tcpaddrTarget)
 	if err != nil {
 		loggo.Info("direct local tcp DialTCP fail: %s %s", targetAddr, err.Error())
+		if reply != nil {
+			reply(false, dialErrorReason(err))
+			conn.Close()
+		}
 		return
 	}
 
+	if reply != nil {
+		if err := reply(true, KICK_REASON_NONE); err != nil {
+			targetconn.Close()
+			conn.Close()
+			return
+		}
+	}
+
 	go p.transfer(conn, targetconn, conn.RemoteAddr().String(), targetconn.RemoteAddr().String())
 	go p.transfer(targetconn, conn, targetconn.RemoteAddr().String(), conn.RemoteAddr().String())
 
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/esrrhs/pingtunnel"
+	"os"
+)
+
+// genkey prints a random key for -encrypt-key, or with -kdf a spec for
+// -encrypt-kdf with a random salt, for deployments that keep a passphrase.
+func genkey(args []string) {
+	fs := flag.NewFlagSet("genkey", flag.ExitOnError)
+	encryption := fs.String("encrypt", "chacha20", "encryption mode the key is for: aes128, aes256, chacha20, xchacha20, aes128-gcm-siv, aes256-gcm-siv")
+	kdf := fs.String("kdf", "", "print a -encrypt-kdf spec with a random salt instead: pbkdf2, argon2id, scrypt")
+	fs.Parse(args)
+
+	if len(*kdf) > 0 {
+		spec, err := pingtunnel.NewKdfSpec(*kdf)
+		if err != nil {
+			fmt.Printf("Invalid kdf: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(spec)
+		return
+	}
+
+	mode, err := pingtunnel.ParseEncryptionMode(*encryption)
+	if err != nil {
+		fmt.Printf("Invalid encryption mode: %v\n", err)
+		os.Exit(1)
+	}
+	key, err := pingtunnel.GenerateKey(mode)
+	if err != nil {
+		fmt.Printf("Failed to generate key: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(key)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/pingtunnel"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// serverReloadable and clientReloadable are the flags a reload applies in
+// place, everything else needs a restart. That includes -s5ftfile: lookups
+// read the GeoIP database without a lock, it cannot be swapped under them.
+var serverReloadable = map[string]bool{
+	"key": true, "key-file": true, "maxconn": true, "conntt": true, "reverse_allow": true, "bind_allow": true,
+	"forward": true, "route": true, "upstream": true, "no_proxy": true,
+}
+
+// fileLabels name the files behind a flag in a reload report, when the file
+// changed but the flag did not.
+var fileLabels = map[string]string{"route": "route rules", "key-file": "keys"}
+
+var clientReloadable = map[string]bool{
+	"key": true, "key-file": true, "maxconn": true, "timeout": true, "s5user": true, "s5pass": true, "s5confirm": true,
+	"httpuser": true, "httppass": true, "s5filter": true, "route": true,
+}
+
+// configReloader reloads the config file on SIGHUP or an admin call. Flags
+// given on the command line keep their value.
+type configReloader struct {
+	lock       sync.Mutex
+	config     string
+	cmdline    map[string]bool
+	reloadable map[string]bool
+	listeners  string
+	files      map[string]string
+	// apply builds the runtime settings from the flags and hands them to the
+	// server or client, returning what reloadFiles loaded.
+	apply func() (map[string]string, error)
+}
+
+func (r *configReloader) reload() (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	options := map[string]string{}
+	listeners := ""
+	if r.config != "" {
+		fileConfig, err := pingtunnel.LoadConfigFile(r.config)
+		if err != nil {
+			return "", err
+		}
+		if err := checkConfigOptions(fileConfig.Options); err != nil {
+			return "", err
+		}
+		options = fileConfig.Options
+		listeners = listenersString(fileConfig.Listeners)
+	}
+
+	var changed, restart []string
+	old := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if r.cmdline[f.Name] || f.Name == "config" || f.Name == "check-config" {
+			return
+		}
+		value, ok := options[f.Name]
+		if !ok {
+			value = f.DefValue
+		}
+		if value == f.Value.String() {
+			return
+		}
+		if !r.reloadable[f.Name] {
+			restart = append(restart, f.Name)
+			return
+		}
+		old[f.Name] = f.Value.String()
+		changed = append(changed, f.Name)
+	})
+	if listeners != r.listeners {
+		restart = append(restart, "listeners")
+	}
+
+	rollback := func() {
+		for name, value := range old {
+			flag.Set(name, value)
+		}
+	}
+	for _, name := range changed {
+		value, ok := options[name]
+		if !ok {
+			value = flag.Lookup(name).DefValue
+		}
+		if err := flag.Set(name, value); err != nil {
+			rollback()
+			return "", fmt.Errorf("option %q: %w", name, err)
+		}
+	}
+	files, err := r.apply()
+	if err != nil {
+		rollback()
+		return "", err
+	}
+	for name, text := range files {
+		if _, ok := old[name]; !ok && text != r.files[name] {
+			changed = append(changed, fileLabels[name])
+		}
+	}
+	r.files = files
+
+	sort.Strings(changed)
+	sort.Strings(restart)
+	report := "nothing changed"
+	if len(changed) > 0 {
+		report = "changed " + strings.Join(changed, ", ")
+	}
+	if len(restart) > 0 {
+		report += "; restart needed for " + strings.Join(restart, ", ")
+	}
+	return report, nil
+}
+
+func (r *configReloader) reloadAndLog(from string) (string, error) {
+	report, err := r.reload()
+	if err != nil {
+		loggo.Error("reload from %s ERROR: %s, keep the running config", from, err.Error())
+		return "", err
+	}
+	loggo.Info("reload from %s: %s", from, report)
+	return report, nil
+}
+
+// serveAdmin serves POST /reload. It has no authentication, bind it to a
+// local address.
+func serveAdmin(addr string, r *configReloader) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := r.reloadAndLog("admin " + req.RemoteAddr)
+		if err != nil {
+			http.Error(w, "reload failed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, report)
+	})
+	loggo.Info("admin listen %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		loggo.Error("admin listen %s ERROR: %s", addr, err.Error())
+	}
+}
+
+func listenersString(listeners []*pingtunnel.ListenerConfig) string {
+	s := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		s = append(s, l.String())
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,177 @@
+package pingtunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	LISTENER_TCP    = "tcp"
+	LISTENER_UDP    = "udp"
+	LISTENER_SOCKS5 = "socks5"
+	LISTENER_HTTP   = "http"
+)
+
+// ListenerConfig is one extra local listener of a client. All listeners share
+// the client's tunnel, so several forwards need only one ICMP socket and ping.
+type ListenerConfig struct {
+	Type   string `json:"type"`   // tcp, udp, socks5 or http
+	Listen string `json:"listen"` // local address
+	Target string `json:"target"` // destination of tcp and udp forwards
+}
+
+func (l *ListenerConfig) network() string {
+	if l.Type == LISTENER_UDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func (l *ListenerConfig) String() string {
+	if l.Target != "" {
+		return l.Type + "/" + l.Listen + "/" + l.Target
+	}
+	return l.Type + "/" + l.Listen
+}
+
+// FileConfig is a parsed config file. Options are named like the command line
+// flags and hold their values as flag strings.
+type FileConfig struct {
+	Options   map[string]string
+	Listeners []*ListenerConfig
+}
+
+// LoadConfigFile reads a JSON config file:
+//
+//	{
+//	  "type": "client",
+//	  "s": "www.yourserver.com",
+//	  "key": 123456,
+//	  "listeners": [
+//	    {"type": "tcp", "listen": ":2222", "target": "10.0.0.2:22"},
+//	    {"type": "socks5", "listen": "127.0.0.1:1080"}
+//	  ]
+//	}
+func LoadConfigFile(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+func ParseConfig(data []byte) (*FileConfig, error) {
+	var raw map[string]json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid json: %w", err)
+	}
+
+	config := &FileConfig{Options: make(map[string]string)}
+	for name, value := range raw {
+		if name == "listeners" {
+			listenerDecoder := json.NewDecoder(bytes.NewReader(value))
+			listenerDecoder.DisallowUnknownFields()
+			if err := listenerDecoder.Decode(&config.Listeners); err != nil {
+				return nil, fmt.Errorf("invalid listeners: %w", err)
+			}
+			continue
+		}
+		s, err := configOptionString(value)
+		if err != nil {
+			return nil, fmt.Errorf("option %q: %w", name, err)
+		}
+		config.Options[name] = s
+	}
+
+	if err := ValidateListeners(config.Listeners); err != nil {
+		return nil, err
+	}
+	if len(config.Listeners) > 0 && config.Options["type"] == "server" {
+		return nil, fmt.Errorf("listeners are only used by the client")
+	}
+	return config, nil
+}
+
+// configOptionString turns a JSON value into a flag value. Booleans become
+// 1 and 0 like the int switches, and lists are joined with commas.
+func configOptionString(value json.RawMessage) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return "", err
+	}
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case json.Number:
+		return x.String(), nil
+	case bool:
+		if x {
+			return "1", nil
+		}
+		return "0", nil
+	case []interface{}:
+		items := make([]string, 0, len(x))
+		for _, item := range x {
+			s, ok := item.(string)
+			if !ok {
+				return "", fmt.Errorf("list items must be strings")
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %s", string(value))
+}
+
+// ValidateListeners checks types and addresses and that no two listeners share
+// a local address.
+func ValidateListeners(listeners []*ListenerConfig) error {
+	seen := make(map[string]bool)
+	for i, l := range listeners {
+		if l == nil {
+			return fmt.Errorf("listener %d: empty", i)
+		}
+		switch l.Type {
+		case LISTENER_TCP, LISTENER_UDP:
+			if err := checkHostPort(l.Target); err != nil {
+				return fmt.Errorf("listener %d %s: invalid target: %w", i, l.Type, err)
+			}
+		case LISTENER_SOCKS5, LISTENER_HTTP:
+			if l.Target != "" {
+				return fmt.Errorf("listener %d %s: target is not used by %s listeners", i, l.Type, l.Type)
+			}
+		default:
+			return fmt.Errorf("listener %d: unsupported type %q (supported: tcp, udp, socks5, http)", i, l.Type)
+		}
+		if err := checkHostPort(l.Listen); err != nil {
+			return fmt.Errorf("listener %d %s: invalid listen address: %w", i, l.Type, err)
+		}
+		key := l.network() + "|" + l.Listen
+		if seen[key] {
+			return fmt.Errorf("listener %d %s: %s %s is used twice", i, l.Type, l.network(), l.Listen)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+func checkHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
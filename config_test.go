@@ -0,0 +1,82 @@
+package pingtunnel
+
+import (
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`{
+  "type": "client",
+  "s": "www.yourserver.com",
+  "key": 123456,
+  "s5confirm": true,
+  "nolog": false,
+  "no_proxy": ["localhost", "10.0.0.0/8"],
+  "listeners": [
+    {"type": "tcp", "listen": ":2222", "target": "10.0.0.2:22"},
+    {"type": "udp", "listen": "127.0.0.1:5353", "target": "8.8.8.8:53"},
+    {"type": "socks5", "listen": "127.0.0.1:1080"},
+    {"type": "http", "listen": "127.0.0.1:8080"}
+  ]
+}`))
+	if err != nil {
+		t.Fatalf("ParseConfig unexpected error: %v", err)
+	}
+
+	wantOptions := map[string]string{
+		"type":      "client",
+		"s":         "www.yourserver.com",
+		"key":       "123456",
+		"s5confirm": "1",
+		"nolog":     "0",
+		"no_proxy":  "localhost,10.0.0.0/8",
+	}
+	if len(config.Options) != len(wantOptions) {
+		t.Errorf("ParseConfig returned %d options, want %d", len(config.Options), len(wantOptions))
+	}
+	for name, want := range wantOptions {
+		if got := config.Options[name]; got != want {
+			t.Errorf("option %s = %q, want %q", name, got, want)
+		}
+	}
+
+	wantListeners := []string{"tcp/:2222/10.0.0.2:22", "udp/127.0.0.1:5353/8.8.8.8:53", "socks5/127.0.0.1:1080", "http/127.0.0.1:8080"}
+	if len(config.Listeners) != len(wantListeners) {
+		t.Fatalf("ParseConfig returned %d listeners, want %d", len(config.Listeners), len(wantListeners))
+	}
+	for i, want := range wantListeners {
+		if got := config.Listeners[i].String(); got != want {
+			t.Errorf("listener %d = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	invalid := []string{
+		`{"type": "client",`,
+		`["client"]`,
+		`{"key": {"value": 1}}`,
+		`{"no_proxy": ["localhost", 1]}`,
+		`{"listeners": [{"type": "tcp", "listen": ":2222", "target": "10.0.0.2:22", "mode": 1}]}`,
+		`{"listeners": [{"type": "sctp", "listen": ":2222", "target": "10.0.0.2:22"}]}`,
+		`{"listeners": [{"type": "tcp", "listen": ":2222"}]}`,
+		`{"listeners": [{"type": "udp", "listen": "127.0.0.1", "target": "8.8.8.8:53"}]}`,
+		`{"listeners": [{"type": "socks5", "listen": ":1080", "target": "10.0.0.2:22"}]}`,
+		`{"listeners": [{"type": "socks5", "listen": ":1080"}, {"type": "http", "listen": ":1080"}]}`,
+		`{"type": "server", "listeners": [{"type": "socks5", "listen": ":1080"}]}`,
+	}
+	for _, data := range invalid {
+		if _, err := ParseConfig([]byte(data)); err == nil {
+			t.Errorf("ParseConfig(%q) expected error, got none", data)
+		}
+	}
+
+	// the same port may carry a tcp and a udp forward
+	_, err := ParseConfig([]byte(`{"listeners": [
+  {"type": "tcp", "listen": ":53", "target": "8.8.8.8:53"},
+  {"type": "udp", "listen": ":53", "target": "8.8.8.8:53"}
+]}`))
+	if err != nil {
+		t.Errorf("ParseConfig(tcp and udp on one port) unexpected error: %v", err)
+	}
+}
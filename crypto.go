@@ -3,13 +3,15 @@ package pingtunnel
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/crypto/pbkdf2"
+	"slices"
+	"strings"
 )
 
 // EncryptionMode represents the encryption mode
@@ -20,13 +22,32 @@ const (
 	AES128
 	AES256
 	CHACHA20
+	XCHACHA20
+	AES128_GCM_SIV
+	AES256_GCM_SIV
 )
 
+// ENCRYPTION_STRENGTH orders the modes from the strongest. Nonce-misuse
+// resistant and extended-nonce modes come first, random 96-bit nonces under
+// one key approach the birthday bound on busy long-running tunnels.
+var ENCRYPTION_STRENGTH = []EncryptionMode{AES256_GCM_SIV, XCHACHA20, AES128_GCM_SIV, CHACHA20, AES256, AES128}
+
+// LEGACY_ENCRYPTION_MODES use the configured key as is, as earlier releases
+// do. They share it, so a suite list takes at most one of them; the other
+// modes get a subkey of their own.
+var LEGACY_ENCRYPTION_MODES = []EncryptionMode{AES128, AES256, CHACHA20}
+
 // CryptoConfig holds encryption configuration
 type CryptoConfig struct {
 	Mode   EncryptionMode
 	Key    []byte
 	Cipher cipher.AEAD
+	// Fallbacks decrypt data sealed with older keys while keys are rotated,
+	// Cipher is tried first and is the only one used to encrypt
+	Fallbacks []cipher.AEAD
+	// Alternates are the weaker suites also accepted, strongest first. A
+	// packet is answered in the suite it came in
+	Alternates []*CryptoConfig
 }
 
 // NewCryptoConfig creates a new crypto configuration
@@ -35,21 +56,108 @@ func NewCryptoConfig(mode EncryptionMode, keyInput string) (*CryptoConfig, error
 		return &CryptoConfig{Mode: NoEncryption}, nil
 	}
 
-	var keySize int
+	key, aead, err := newCipher(mode, keyInput, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CryptoConfig{
+		Mode:   mode,
+		Key:    key,
+		Cipher: aead,
+	}, nil
+}
+
+// NewCryptoConfigKeys creates a crypto configuration with several keys. The
+// first one encrypts, all of them decrypt. Passphrases are stretched with kdf,
+// nil is the old pbkdf2 derivation.
+func NewCryptoConfigKeys(mode EncryptionMode, keyInputs []string, kdf *KdfConfig) (*CryptoConfig, error) {
+	if mode == NoEncryption {
+		return &CryptoConfig{Mode: NoEncryption}, nil
+	}
+	if len(keyInputs) == 0 {
+		return nil, errors.New("encryption key cannot be empty")
+	}
+
+	c := &CryptoConfig{Mode: mode}
+	for i, keyInput := range keyInputs {
+		key, aead, err := newCipher(mode, keyInput, kdf)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			c.Key = key
+			c.Cipher = aead
+		} else {
+			c.Fallbacks = append(c.Fallbacks, aead)
+		}
+	}
+	return c, nil
+}
+
+// NewCryptoConfigSuites creates a crypto configuration accepting several
+// suites, encrypting with the strongest until the peer picks another.
+func NewCryptoConfigSuites(modes []EncryptionMode, keyInputs []string, kdf *KdfConfig) (*CryptoConfig, error) {
+	if len(modes) == 0 {
+		return nil, errors.New("no encryption mode")
+	}
+	legacy := 0
+	for _, mode := range modes {
+		if slices.Contains(LEGACY_ENCRYPTION_MODES, mode) {
+			legacy++
+		}
+	}
+	if legacy > 1 {
+		return nil, errors.New("aes128, aes256 and chacha20 share the key, combine at most one of them")
+	}
+	c, err := NewCryptoConfigKeys(modes[0], keyInputs, kdf)
+	if err != nil {
+		return nil, err
+	}
+	for _, mode := range modes[1:] {
+		if mode == NoEncryption {
+			return nil, errors.New("none can not be combined with other encryption modes")
+		}
+		alternate, err := NewCryptoConfigKeys(mode, keyInputs, kdf)
+		if err != nil {
+			return nil, err
+		}
+		c.Alternates = append(c.Alternates, alternate)
+	}
+	return c, nil
+}
+
+// Suites returns c and its alternates, strongest first.
+func (c *CryptoConfig) Suites() []*CryptoConfig {
+	return append([]*CryptoConfig{c}, c.Alternates...)
+}
+
+func keySizeOf(mode EncryptionMode) (int, error) {
 	switch mode {
-	case AES128:
-		keySize = 16 // 128 bits
-	case AES256:
-		keySize = 32 // 256 bits
-	case CHACHA20:
-		keySize = chacha20poly1305.KeySize // 32 bytes
+	case AES128, AES128_GCM_SIV:
+		return 16, nil // 128 bits
+	case AES256, AES256_GCM_SIV:
+		return 32, nil // 256 bits
+	case CHACHA20, XCHACHA20:
+		return chacha20poly1305.KeySize, nil // 32 bytes
 	default:
-		return nil, fmt.Errorf("unsupported encryption mode: %d", mode)
+		return 0, fmt.Errorf("unsupported encryption mode: %d", mode)
+	}
+}
+
+func newCipher(mode EncryptionMode, keyInput string, kdf *KdfConfig) ([]byte, cipher.AEAD, error) {
+	keySize, err := keySizeOf(mode)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	key, err := deriveKey(keyInput, keySize)
+	key, err := deriveKeyKdf(keyInput, keySize, kdf)
 	if err != nil {
-		return nil, fmt.Errorf("failed to derive key: %v", err)
+		return nil, nil, fmt.Errorf("failed to derive key: %v", err)
+	}
+	key, err = suiteKey(mode, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to derive suite key: %v", err)
 	}
 
 	// Create AEAD based on mode
@@ -59,33 +167,57 @@ func NewCryptoConfig(mode EncryptionMode, keyInput string) (*CryptoConfig, error
 		// AES-GCM
 		block, err := aes.NewCipher(key)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+			return nil, nil, fmt.Errorf("failed to create AES cipher: %v", err)
 		}
 		gcm, err := cipher.NewGCM(block)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create GCM: %v", err)
+			return nil, nil, fmt.Errorf("failed to create GCM: %v", err)
 		}
 		aead = gcm
 	case CHACHA20:
 		// ChaCha20-Poly1305
 		cc20, err := chacha20poly1305.New(key)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create ChaCha20-Poly1305: %v", err)
+			return nil, nil, fmt.Errorf("failed to create ChaCha20-Poly1305: %v", err)
 		}
 		aead = cc20
+	case XCHACHA20:
+		// XChaCha20-Poly1305, 192-bit nonces are safe to draw at random
+		xcc20, err := chacha20poly1305.NewX(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create XChaCha20-Poly1305: %v", err)
+		}
+		aead = xcc20
+	case AES128_GCM_SIV, AES256_GCM_SIV:
+		siv, err := newAESGCMSIV(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create AES-GCM-SIV: %v", err)
+		}
+		aead = siv
 	default:
-		return nil, fmt.Errorf("unsupported encryption mode: %d", mode)
+		return nil, nil, fmt.Errorf("unsupported encryption mode: %d", mode)
 	}
 
-	return &CryptoConfig{
-		Mode:   mode,
-		Key:    key,
-		Cipher: aead,
-	}, nil
+	return key, aead, nil
+}
+
+// suiteKey derives the key of mode from the configured one with HKDF and the
+// mode name, so suites negotiated under one key do not share it.
+func suiteKey(mode EncryptionMode, key []byte) ([]byte, error) {
+	if slices.Contains(LEGACY_ENCRYPTION_MODES, mode) {
+		return key, nil
+	}
+	return hkdf.Key(sha256.New, key, nil, "pingtunnel "+mode.String(), len(key))
 }
 
 // deriveKey derives an encryption key from the input string
 func deriveKey(keyInput string, keySize int) ([]byte, error) {
+	return deriveKeyKdf(keyInput, keySize, nil)
+}
+
+// deriveKeyKdf derives an encryption key from the input string with kdf, nil
+// is pbkdf2 with the old constant salt
+func deriveKeyKdf(keyInput string, keySize int, kdf *KdfConfig) ([]byte, error) {
 	if keyInput == "" {
 		return nil, errors.New("encryption key cannot be empty")
 	}
@@ -97,10 +229,23 @@ func deriveKey(keyInput string, keySize int) ([]byte, error) {
 		}
 	}
 
-	// If not valid base64 or wrong size, use PBKDF2 to derive key
-	salt := []byte("pingtunnel-salt") // Fixed salt for deterministic key derivation
-	iterations := 10000               // Standard iteration count
-	return pbkdf2.Key([]byte(keyInput), salt, iterations, keySize, sha256.New), nil
+	// If not valid base64 or wrong size, stretch it as a passphrase
+	if kdf == nil {
+		var err error
+		kdf, err = ParseKdfSpec(KDF_PBKDF2)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return kdf.Derive(keyInput, keySize)
+}
+
+// NonceSize is the room EncryptInPlace needs in front of the plaintext
+func (c *CryptoConfig) NonceSize() int {
+	if c.Mode == NoEncryption || c.Cipher == nil {
+		return 0
+	}
+	return c.Cipher.NonceSize()
 }
 
 // Encrypt encrypts the given data
@@ -113,25 +258,70 @@ func (c *CryptoConfig) Encrypt(data []byte) ([]byte, error) {
 		return nil, errors.New("cipher not initialized")
 	}
 
+	nonceSize := c.Cipher.NonceSize()
+	b := make([]byte, nonceSize, nonceSize+len(data)+c.Cipher.Overhead())
+	b = append(b, data...)
+	return c.EncryptInPlace(b, 0)
+}
+
+// EncryptInPlace seals b[off+NonceSize():] where it is, draws the nonce into
+// the NonceSize bytes at off, and returns b grown by the tag. The output is
+// the same as Encrypt's without allocating when b has room for the tag.
+func (c *CryptoConfig) EncryptInPlace(b []byte, off int) ([]byte, error) {
+	if c.Mode == NoEncryption {
+		return b, nil
+	}
+
+	if c.Cipher == nil {
+		return nil, errors.New("cipher not initialized")
+	}
+
 	// Generate a random nonce
-	nonce := make([]byte, c.Cipher.NonceSize())
+	nonceSize := c.Cipher.NonceSize()
+	nonce := b[off : off+nonceSize]
 	if _, err := rand.Read(nonce); err != nil {
 		return nil, fmt.Errorf("failed to generate nonce: %v", err)
 	}
 
-	// Encrypt the data
-	ciphertext := c.Cipher.Seal(nil, nonce, data, nil)
-
-	// Prepend nonce to ciphertext
-	result := make([]byte, len(nonce)+len(ciphertext))
-	copy(result, nonce)
-	copy(result[len(nonce):], ciphertext)
+	// Encrypt the data over itself
+	b = slices.Grow(b, c.Cipher.Overhead())
+	plaintext := b[off+nonceSize:]
+	ciphertext := c.Cipher.Seal(plaintext[:0], nonce, plaintext, nil)
 
-	return result, nil
+	return b[:off+nonceSize+len(ciphertext)], nil
 }
 
 // Decrypt decrypts the given data
 func (c *CryptoConfig) Decrypt(data []byte) ([]byte, error) {
+	plaintext, _, err := c.DecryptSuiteTo(nil, data)
+	return plaintext, err
+}
+
+// DecryptSuite decrypts data with any accepted suite and returns the suite
+// that opened it, for the reply.
+func (c *CryptoConfig) DecryptSuite(data []byte) ([]byte, *CryptoConfig, error) {
+	return c.DecryptSuiteTo(nil, data)
+}
+
+// DecryptSuiteTo is DecryptSuite appending the plaintext to dst, which may be
+// a reused buffer but must not overlap data. Without encryption data itself
+// is returned.
+func (c *CryptoConfig) DecryptSuiteTo(dst []byte, data []byte) ([]byte, *CryptoConfig, error) {
+	plaintext, err := c.decrypt(dst, data)
+	for i := 0; err != nil && i < len(c.Alternates); i++ {
+		var alternateErr error
+		plaintext, alternateErr = c.Alternates[i].decrypt(dst, data)
+		if alternateErr == nil {
+			return plaintext, c.Alternates[i], nil
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, c, nil
+}
+
+func (c *CryptoConfig) decrypt(dst []byte, data []byte) ([]byte, error) {
 	if c.Mode == NoEncryption {
 		return data, nil
 	}
@@ -149,8 +339,11 @@ func (c *CryptoConfig) Decrypt(data []byte) ([]byte, error) {
 	nonce := data[:nonceSize]
 	ciphertext := data[nonceSize:]
 
-	// Decrypt the data
-	plaintext, err := c.Cipher.Open(nil, nonce, ciphertext, nil)
+	// Decrypt the data, falling back to the older keys
+	plaintext, err := c.Cipher.Open(dst, nonce, ciphertext, nil)
+	for i := 0; err != nil && i < len(c.Fallbacks); i++ {
+		plaintext, err = c.Fallbacks[i].Open(dst, nonce, ciphertext, nil)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("decryption failed: %v", err)
 	}
@@ -169,6 +362,12 @@ func (m EncryptionMode) String() string {
 		return "aes256"
 	case CHACHA20:
 		return "chacha20"
+	case XCHACHA20:
+		return "xchacha20"
+	case AES128_GCM_SIV:
+		return "aes128-gcm-siv"
+	case AES256_GCM_SIV:
+		return "aes256-gcm-siv"
 	default:
 		return "unknown"
 	}
@@ -185,7 +384,44 @@ func ParseEncryptionMode(s string) (EncryptionMode, error) {
 		return AES256, nil
 	case "chacha20", "chacha20-poly1305":
 		return CHACHA20, nil
+	case "xchacha20", "xchacha20-poly1305":
+		return XCHACHA20, nil
+	case "aes128-gcm-siv":
+		return AES128_GCM_SIV, nil
+	case "aes256-gcm-siv":
+		return AES256_GCM_SIV, nil
 	default:
 		return NoEncryption, fmt.Errorf("invalid encryption mode: %s", s)
 	}
 }
+
+// ParseEncryptionModes parses a comma-separated list of modes a side
+// supports and sorts it strongest first, none can not be combined.
+func ParseEncryptionModes(s string) ([]EncryptionMode, error) {
+	if !strings.Contains(s, ",") {
+		mode, err := ParseEncryptionMode(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		return []EncryptionMode{mode}, nil
+	}
+
+	wanted := make(map[EncryptionMode]bool)
+	for _, field := range strings.Split(s, ",") {
+		mode, err := ParseEncryptionMode(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		if mode == NoEncryption {
+			return nil, errors.New("none can not be combined with other encryption modes")
+		}
+		wanted[mode] = true
+	}
+	var modes []EncryptionMode
+	for _, mode := range ENCRYPTION_STRENGTH {
+		if wanted[mode] {
+			modes = append(modes, mode)
+		}
+	}
+	return modes, nil
+}
@@ -2,6 +2,8 @@ package pingtunnel
 
 import (
 	"bytes"
+	"encoding/base64"
+	"fmt"
 	"testing"
 )
 
@@ -134,6 +136,10 @@ func TestParseEncryptionMode(t *testing.T) {
 		{"aes256", AES256, false},
 		{"chacha20", CHACHA20, false},
 		{"chacha20-poly1305", CHACHA20, false},
+		{"xchacha20", XCHACHA20, false},
+		{"xchacha20-poly1305", XCHACHA20, false},
+		{"aes128-gcm-siv", AES128_GCM_SIV, false},
+		{"aes256-gcm-siv", AES256_GCM_SIV, false},
 		{"invalid", NoEncryption, true},
 	}
 
@@ -181,3 +187,164 @@ func TestKeyDerivation(t *testing.T) {
 		t.Fatal("Same passphrase should produce same derived key")
 	}
 }
+
+func TestCryptoConfig_Keys(t *testing.T) {
+	oldConfig, err := NewCryptoConfig(CHACHA20, "old-passphrase")
+	if err != nil {
+		t.Fatalf("Failed to create crypto config: %v", err)
+	}
+	newConfig, err := NewCryptoConfig(CHACHA20, "new-passphrase")
+	if err != nil {
+		t.Fatalf("Failed to create crypto config: %v", err)
+	}
+	config, err := NewCryptoConfigKeys(CHACHA20, []string{"new-passphrase", "old-passphrase"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create crypto config with keys: %v", err)
+	}
+
+	testData := []byte("Hello, World! This is a test message.")
+
+	// data from either key decrypts
+	for _, c := range []*CryptoConfig{oldConfig, newConfig} {
+		encrypted, err := c.Encrypt(testData)
+		if err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+		decrypted, err := config.Decrypt(encrypted)
+		if err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		if !bytes.Equal(testData, decrypted) {
+			t.Fatal("Decrypted data doesn't match original")
+		}
+	}
+
+	// only the primary key encrypts
+	encrypted, err := config.Encrypt(testData)
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if _, err := newConfig.Decrypt(encrypted); err != nil {
+		t.Fatalf("Decryption with the primary key failed: %v", err)
+	}
+	if _, err := oldConfig.Decrypt(encrypted); err == nil {
+		t.Fatal("Decryption with the old key should fail")
+	}
+
+	if _, err := NewCryptoConfigKeys(CHACHA20, nil, nil); err == nil {
+		t.Fatal("Expected error for no keys")
+	}
+}
+
+func TestCryptoConfig_Suites(t *testing.T) {
+	testData := []byte("Testing every suite for encryption and decryption correctness.")
+	for _, mode := range ENCRYPTION_STRENGTH {
+		config, err := NewCryptoConfig(mode, "suite-passphrase")
+		if err != nil {
+			t.Fatalf("Failed to create %s crypto config: %v", mode, err)
+		}
+		encrypted, err := config.Encrypt(testData)
+		if err != nil {
+			t.Fatalf("Failed to encrypt %s data: %v", mode, err)
+		}
+		decrypted, err := config.Decrypt(encrypted)
+		if err != nil {
+			t.Fatalf("Failed to decrypt %s data: %v", mode, err)
+		}
+		if !bytes.Equal(testData, decrypted) {
+			t.Fatalf("Decrypted %s data doesn't match original", mode)
+		}
+		encrypted[len(encrypted)-1] ^= 1
+		if _, err := config.Decrypt(encrypted); err == nil {
+			t.Fatalf("Decrypting tampered %s data should fail", mode)
+		}
+	}
+
+	server, err := NewCryptoConfigSuites([]EncryptionMode{AES256_GCM_SIV, XCHACHA20, CHACHA20}, []string{"suite-passphrase"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create crypto config with suites: %v", err)
+	}
+	for _, suite := range server.Suites() {
+		peer, err := NewCryptoConfig(suite.Mode, "suite-passphrase")
+		if err != nil {
+			t.Fatalf("Failed to create %s crypto config: %v", suite.Mode, err)
+		}
+		encrypted, err := peer.Encrypt(testData)
+		if err != nil {
+			t.Fatalf("Failed to encrypt %s data: %v", suite.Mode, err)
+		}
+		decrypted, used, err := server.DecryptSuite(encrypted)
+		if err != nil {
+			t.Fatalf("Failed to decrypt %s data with suites: %v", suite.Mode, err)
+		}
+		if used != suite || !bytes.Equal(testData, decrypted) {
+			t.Fatalf("DecryptSuite(%s data) used %s", suite.Mode, used.Mode)
+		}
+	}
+
+	other, _ := NewCryptoConfig(AES128, "suite-passphrase")
+	encrypted, _ := other.Encrypt(testData)
+	if _, _, err := server.DecryptSuite(encrypted); err == nil {
+		t.Fatal("Decrypting a suite that is not accepted should fail")
+	}
+}
+
+func TestParseEncryptionModes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []EncryptionMode
+	}{
+		{"", []EncryptionMode{NoEncryption}},
+		{"chacha20", []EncryptionMode{CHACHA20}},
+		{"chacha20,xchacha20", []EncryptionMode{XCHACHA20, CHACHA20}},
+		{"aes128, aes256-gcm-siv, aes128", []EncryptionMode{AES256_GCM_SIV, AES128}},
+	}
+	for _, test := range tests {
+		result, err := ParseEncryptionModes(test.input)
+		if err != nil {
+			t.Fatalf("Unexpected error for input %s: %v", test.input, err)
+		}
+		if fmt.Sprint(result) != fmt.Sprint(test.expected) {
+			t.Fatalf("For input %s, expected %v, got %v", test.input, test.expected, result)
+		}
+	}
+
+	for _, input := range []string{"chacha20,none", "chacha20,", "aes128,invalid"} {
+		if _, err := ParseEncryptionModes(input); err == nil {
+			t.Fatalf("Expected error for input %s, but got none", input)
+		}
+	}
+}
+
+func TestCryptoConfig_SuiteKeys(t *testing.T) {
+	raw := bytes.Repeat([]byte{7}, 32)
+	keyInput := base64.StdEncoding.EncodeToString(raw)
+
+	keys := make(map[string]EncryptionMode)
+	for _, mode := range []EncryptionMode{AES256_GCM_SIV, XCHACHA20, AES256} {
+		config, err := NewCryptoConfig(mode, keyInput)
+		if err != nil {
+			t.Fatalf("Failed to create %s crypto config: %v", mode, err)
+		}
+		if other, ok := keys[string(config.Key)]; ok {
+			t.Errorf("%s and %s share a key", mode, other)
+		}
+		keys[string(config.Key)] = mode
+	}
+
+	// the modes of earlier releases keep the key
+	for _, mode := range LEGACY_ENCRYPTION_MODES {
+		keySize, _ := keySizeOf(mode)
+		config, err := NewCryptoConfig(mode, base64.StdEncoding.EncodeToString(raw[:keySize]))
+		if err != nil {
+			t.Fatalf("Failed to create %s crypto config: %v", mode, err)
+		}
+		if !bytes.Equal(config.Key, raw[:keySize]) {
+			t.Errorf("%s key changed", mode)
+		}
+	}
+
+	if _, err := NewCryptoConfigSuites([]EncryptionMode{AES256, CHACHA20}, []string{keyInput}, nil); err == nil {
+		t.Error("Expected error for suites sharing the key")
+	}
+}
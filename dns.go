@@ -0,0 +1,684 @@
+package pingtunnel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DNS_ACTION_TUNNEL = "tunnel" // resolve through the tunnel, the default
+	DNS_ACTION_LOCAL  = "local"  // resolve with the local resolver
+	DNS_ACTION_BLOCK  = "block"  // answer NXDOMAIN
+	DNS_ACTION_ADDR   = "addr"   // answer with a fixed address
+
+	DNS_MAX_TUNNEL_SIZE int = 8192
+	DNS_MAX_TTL             = 24 * time.Hour
+
+	// queries of the local listener are resent through the tunnel a few
+	// times since ICMP may be dropped
+	DNS_QUERY_TRIES  int = 4
+	DNS_QUERY_RESEND     = time.Second
+	// lookups for routing decisions hold up a new connection, give up sooner
+	DNS_ROUTE_TRIES  int = 2
+	DNS_ROUTE_RESEND     = 500 * time.Millisecond
+	// queries resolved at once, more are dropped and resent by the stub
+	DNS_MAX_WORKERS int = 256
+)
+
+// DnsRule is a split rule matching a domain and all of its subdomains.
+type DnsRule struct {
+	Suffix string
+	Action string
+	IP     net.IP // used by DNS_ACTION_ADDR
+}
+
+// DnsConfig configures the client side DNS forwarder.
+type DnsConfig struct {
+	ListenAddr  string // local UDP and TCP listen address, empty keeps routing lookups on the local resolver
+	LocalServer string // resolver used by "local" rules, empty reads /etc/resolv.conf
+	Rules       []*DnsRule
+	CacheSize   int
+}
+
+// ParseDnsRules parses a comma separated list of split rules like
+// "lan=local,ads.example.com=block,router.home=192.168.1.1,corp.com=tunnel".
+func ParseDnsRules(spec string) ([]*DnsRule, error) {
+	var ret []*DnsRule
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		domain, action, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid dns rule %q (expected domain=action)", item)
+		}
+		domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+		action = strings.TrimSpace(action)
+		if domain == "" {
+			return nil, fmt.Errorf("invalid dns rule %q: empty domain", item)
+		}
+
+		r := &DnsRule{Suffix: domain}
+		switch action {
+		case DNS_ACTION_TUNNEL, DNS_ACTION_LOCAL, DNS_ACTION_BLOCK:
+			r.Action = action
+		default:
+			ip := net.ParseIP(action)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid dns rule action %q (supported: tunnel, local, block, ip)", action)
+			}
+			r.Action = DNS_ACTION_ADDR
+			r.IP = ip
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// matchDnsRule returns the rule with the longest suffix matching name, or nil.
+func matchDnsRule(rules []*DnsRule, name string) *DnsRule {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var best *DnsRule
+	for _, r := range rules {
+		if name != r.Suffix && !strings.HasSuffix(name, "."+r.Suffix) {
+			continue
+		}
+		if best == nil || len(r.Suffix) > len(best.Suffix) {
+			best = r
+		}
+	}
+	return best
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf.
+func systemNameserver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "8.8.8.8:53"
+}
+
+// parseDnsQuery unpacks a query with exactly one question.
+func parseDnsQuery(query []byte) (*dnsmessage.Message, error) {
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+	if msg.Header.Response || len(msg.Questions) != 1 {
+		return nil, errors.New("dns query must have exactly one question")
+	}
+	return msg, nil
+}
+
+func dnsHasEdns(msg *dnsmessage.Message) bool {
+	for _, r := range msg.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			return true
+		}
+	}
+	return false
+}
+
+func dnsCacheKey(msg *dnsmessage.Message) string {
+	q := msg.Questions[0]
+	edns := "0"
+	if dnsHasEdns(msg) {
+		edns = "1"
+	}
+	return strings.ToLower(q.Name.String()) + "|" + q.Type.String() + "|" + q.Class.String() + "|" + edns
+}
+
+// buildDnsReply answers query locally with rcode and, for matching types, ip.
+func buildDnsReply(query *dnsmessage.Message, rcode dnsmessage.RCode, ip net.IP) ([]byte, error) {
+	q := query.Questions[0]
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.Header.ID,
+			Response:           true,
+			OpCode:             query.Header.OpCode,
+			RecursionDesired:   query.Header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+
+	if ip != nil {
+		hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: 60}
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			r := &dnsmessage.AResource{}
+			copy(r.A[:], ip4)
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: r})
+		} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+			r := &dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip.To16())
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: hdr, Body: r})
+		}
+	}
+	return resp.Pack()
+}
+
+// truncateDnsReply keeps only the question and sets TC, so the stub retries over TCP.
+func truncateDnsReply(resp []byte) []byte {
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(resp); err != nil {
+		return nil
+	}
+	msg.Header.Truncated = true
+	msg.Answers = nil
+	msg.Authorities = nil
+	msg.Additionals = nil
+	ret, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return ret
+}
+
+// dnsResponseTTL returns how long resp may be cached, or 0 if it must not be.
+func dnsResponseTTL(resp *dnsmessage.Message) time.Duration {
+	if resp.Header.Truncated {
+		return 0
+	}
+
+	var ttl uint32
+	found := false
+	switch resp.Header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+		for _, r := range resp.Answers {
+			if !found || r.Header.TTL < ttl {
+				ttl = r.Header.TTL
+				found = true
+			}
+		}
+		if !found {
+			// negative answer, cached for the SOA minimum (RFC 2308)
+			for _, r := range resp.Authorities {
+				if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+					ttl = r.Header.TTL
+					if soa.MinTTL < ttl {
+						ttl = soa.MinTTL
+					}
+					found = true
+					break
+				}
+			}
+		}
+	}
+	if !found {
+		return 0
+	}
+
+	d := time.Duration(ttl) * time.Second
+	if d > DNS_MAX_TTL {
+		d = DNS_MAX_TTL
+	}
+	return d
+}
+
+type dnsCacheEntry struct {
+	resp   *dnsmessage.Message
+	stored time.Time
+	expire time.Time
+}
+
+// dnsCache keeps answers until their TTL runs out.
+type dnsCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*dnsCacheEntry
+}
+
+func newDnsCache(size int) *dnsCache {
+	if size <= 0 {
+		size = 4096
+	}
+	return &dnsCache{size: size, entries: make(map[string]*dnsCacheEntry)}
+}
+
+func (c *dnsCache) put(key string, resp []byte, now time.Time) {
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(resp); err != nil {
+		return
+	}
+	ttl := dnsResponseTTL(msg)
+	if ttl <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if now.After(e.expire) {
+				delete(c.entries, k)
+			}
+		}
+		// still full, drop an arbitrary entry
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &dnsCacheEntry{resp: msg, stored: now, expire: now.Add(ttl)}
+}
+
+// get returns the cached answer with the query id and TTLs reduced by its age.
+func (c *dnsCache) get(key string, id uint16, now time.Time) []byte {
+	c.lock.Lock()
+	e, ok := c.entries[key]
+	if ok && !now.Before(e.expire) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	age := uint32(now.Sub(e.stored) / time.Second)
+	msg := *e.resp
+	msg.Header.ID = id
+	msg.Answers = agedDnsResources(e.resp.Answers, age)
+	msg.Authorities = agedDnsResources(e.resp.Authorities, age)
+	msg.Additionals = agedDnsResources(e.resp.Additionals, age)
+	ret, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return ret
+}
+
+func agedDnsResources(rs []dnsmessage.Resource, age uint32) []dnsmessage.Resource {
+	if len(rs) == 0 {
+		return nil
+	}
+	ret := make([]dnsmessage.Resource, len(rs))
+	copy(ret, rs)
+	for i := range ret {
+		// the OPT ttl field carries EDNS flags, not a ttl
+		if ret[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		if ret[i].Header.TTL > age {
+			ret[i].Header.TTL -= age
+		} else {
+			ret[i].Header.TTL = 0
+		}
+	}
+	return ret
+}
+
+// dnsExchange sends query to server over UDP, retrying over TCP when the answer is truncated.
+func dnsExchange(server string, query []byte, timeout time.Duration) ([]byte, error) {
+	if len(query) < 2 {
+		return nil, errors.New("dns query too short")
+	}
+
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray answers to other queries
+		if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+			continue
+		}
+		if buf[2]&0x02 != 0 {
+			return dnsExchangeTCP(server, query, timeout)
+		}
+		return append([]byte(nil), buf[:n]...), nil
+	}
+}
+
+func dnsExchangeTCP(server string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeDnsTCP(conn, query); err != nil {
+		return nil, err
+	}
+	return readDnsTCP(conn)
+}
+
+func readDnsTCP(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func writeDnsTCP(w io.Writer, msg []byte) error {
+	if len(msg) > 65535 {
+		return errors.New("dns message too long")
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// resolveDns answers query from the split rules, the cache, the local
+// resolver or the tunnel, in that order. A tunnel query is sent up to tries
+// times, resend apart.
+func (p *Client) resolveDns(query []byte, tries int, resend time.Duration) ([]byte, error) {
+	msg, err := parseDnsQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*DnsRule
+	if p.dns != nil {
+		rules = p.dns.Rules
+	}
+	rule := matchDnsRule(rules, msg.Questions[0].Name.String())
+	if rule != nil {
+		switch rule.Action {
+		case DNS_ACTION_BLOCK:
+			return buildDnsReply(msg, dnsmessage.RCodeNameError, nil)
+		case DNS_ACTION_ADDR:
+			return buildDnsReply(msg, dnsmessage.RCodeSuccess, rule.IP)
+		}
+	}
+
+	now := time.Now()
+	key := dnsCacheKey(msg)
+	if resp := p.dnsCache.get(key, msg.Header.ID, now); resp != nil {
+		loggo.Debug("dns cache hit %s", key)
+		return resp, nil
+	}
+
+	var resp []byte
+	if rule != nil && rule.Action == DNS_ACTION_LOCAL {
+		resp, err = dnsExchange(p.dnsLocalServer(), query, 3*time.Second)
+	} else {
+		resp, err = p.exchangeDnsTunnel(query, tries, resend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.dnsCache.put(key, resp, now)
+	return resp, nil
+}
+
+func (p *Client) dnsLocalServer() string {
+	if p.dns != nil && p.dns.LocalServer != "" {
+		return p.dns.LocalServer
+	}
+	return systemNameserver()
+}
+
+// exchangeDnsTunnel sends query to the server's resolver, resending it while
+// no answer arrives since ICMP may be dropped.
+func (p *Client) exchangeDnsTunnel(query []byte, tries int, resend time.Duration) ([]byte, error) {
+	settings := p.settings.Load()
+	uuid := common.UniqueId()
+	ch := make(chan []byte, 1)
+	p.dnsPending.Store(uuid, ch)
+	defer p.dnsPending.Delete(uuid)
+
+	for i := 0; i < tries && p.ctx.Err() == nil; i++ {
+		sendICMP(p.id, p.nextSequence(), *p.conn, p.ipaddrServer.Load(), "", uuid, (uint32)(MyMsg_DNS), query,
+			SEND_PROTO, RECV_PROTO, settings.Key,
+			0, 0, 0, 0, 0, 0,
+			settings.Timeout, p.cryptoConfig.Load())
+		p.sendPacket.Add(1)
+		p.sendPacketSize.Add((uint64)(len(query)))
+		p.touchActivity()
+
+		select {
+		case resp := <-ch:
+			return resp, nil
+		case <-time.After(resend):
+		}
+	}
+	return nil, errors.New("dns query through tunnel timeout")
+}
+
+func (p *Client) processDnsReply(packet *Packet) {
+	v, ok := p.dnsPending.Load(packet.my.Id)
+	if !ok {
+		return
+	}
+	select {
+	case v.(chan []byte) <- packet.my.Data:
+	default:
+	}
+	p.recvPacket.Add(1)
+	p.recvPacketSize.Add((uint64)(len(packet.my.Data)))
+}
+
+// ResolveHost resolves host for routing decisions. With the DNS forwarder
+// listening it resolves through it, so the lookups do not leak outside the
+// tunnel, otherwise with the local resolver.
+func (p *Client) ResolveHost(host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+
+	if p.dns == nil || p.dns.ListenAddr == "" {
+		ipaddr, err := net.ResolveIPAddr("ip", host)
+		if err != nil {
+			return nil, err
+		}
+		return ipaddr.IP, nil
+	}
+
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		query := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: uint16(common.RandInt()), RecursionDesired: true},
+			Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+		}
+		qb, err := query.Pack()
+		if err != nil {
+			return nil, err
+		}
+		rb, err := p.resolveDns(qb, DNS_ROUTE_TRIES, DNS_ROUTE_RESEND)
+		if err != nil {
+			return nil, err
+		}
+		resp := &dnsmessage.Message{}
+		if err := resp.Unpack(rb); err != nil {
+			return nil, err
+		}
+		for _, r := range resp.Answers {
+			switch b := r.Body.(type) {
+			case *dnsmessage.AResource:
+				return net.IP(b.A[:]), nil
+			case *dnsmessage.AAAAResource:
+				return net.IP(b.AAAA[:]), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no address for %s", host)
+}
+
+func (p *Client) AcceptDnsUdp() {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	loggo.Info("client waiting local dns udp %s", p.dns.ListenAddr)
+
+	bytes := make([]byte, 65535)
+
+	for p.ctx.Err() == nil {
+		p.dnsUdpConn.SetReadDeadline(time.Now().Add(time.Millisecond * 1000))
+		n, srcaddr, err := p.dnsUdpConn.ReadFromUDP(bytes)
+		if err != nil {
+			nerr, ok := err.(net.Error)
+			if !ok || !nerr.Timeout() {
+				loggo.Info("Error read dns udp %s", err)
+			}
+			continue
+		}
+
+		select {
+		case p.dnsWorker <- struct{}{}:
+		default:
+			loggo.Info("too many dns queries, drop query from %s", srcaddr.String())
+			continue
+		}
+
+		query := append([]byte(nil), bytes[:n]...)
+		go func() {
+			defer common.CrashLog()
+			defer func() { <-p.dnsWorker }()
+
+			resp, err := p.resolveDns(query, DNS_QUERY_TRIES, DNS_QUERY_RESEND)
+			if err != nil {
+				loggo.Info("dns query from %s fail: %s", srcaddr.String(), err)
+				return
+			}
+			p.dnsUdpConn.WriteToUDP(resp, srcaddr)
+		}()
+	}
+}
+
+func (p *Client) AcceptDnsTcp() {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	loggo.Info("client waiting local dns tcp %s", p.dns.ListenAddr)
+
+	for p.ctx.Err() == nil {
+		p.dnsTcpListener.SetDeadline(time.Now().Add(time.Millisecond * 1000))
+
+		conn, err := p.dnsTcpListener.AcceptTCP()
+		if err != nil {
+			nerr, ok := err.(net.Error)
+			if !ok || !nerr.Timeout() {
+				loggo.Info("Error accept dns tcp %s", err)
+			}
+			continue
+		}
+
+		go p.AcceptDnsTcpConn(conn)
+	}
+}
+
+func (p *Client) AcceptDnsTcpConn(conn *net.TCPConn) {
+
+	defer common.CrashLog()
+	defer conn.Close()
+
+	for p.ctx.Err() == nil {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		query, err := readDnsTCP(conn)
+		if err != nil {
+			return
+		}
+
+		resp, err := p.resolveDns(query, DNS_QUERY_TRIES, DNS_QUERY_RESEND)
+		if err != nil {
+			loggo.Info("dns query from %s fail: %s", conn.RemoteAddr().String(), err)
+			return
+		}
+		if err := writeDnsTCP(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+func (p *Server) processDnsPacket(packet *Packet) {
+	if len(packet.my.Data) == 0 {
+		return
+	}
+
+	select {
+	case p.dnsWorker <- struct{}{}:
+	default:
+		loggo.Info("too many dns queries, drop query from %s", packet.src.String())
+		return
+	}
+
+	go func() {
+		defer common.CrashLog()
+		defer func() { <-p.dnsWorker }()
+
+		resp, err := dnsExchange(p.dnsUpstream, packet.my.Data, 3*time.Second)
+		if err != nil {
+			loggo.Info("dns exchange with %s fail: %s", p.dnsUpstream, err)
+			query, perr := parseDnsQuery(packet.my.Data)
+			if perr != nil {
+				return
+			}
+			resp, err = buildDnsReply(query, dnsmessage.RCodeServerFailure, nil)
+			if err != nil {
+				return
+			}
+		}
+		if len(resp) > DNS_MAX_TUNNEL_SIZE {
+			resp = truncateDnsReply(resp)
+			if resp == nil {
+				return
+			}
+		}
+
+		sendICMP(packet.echoId, packet.echoSeq, *p.conn, packet.src, "", packet.my.Id, (uint32)(MyMsg_DNS), resp,
+			(int)(packet.my.Rproto), -1, (int)(packet.my.Key),
+			0, 0, 0, 0, 0, 0,
+			0, packet.crypto)
+
+		p.sendPacket.Add(1)
+		p.sendPacketSize.Add((uint64)(len(resp)))
+	}()
+}
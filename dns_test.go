@@ -0,0 +1,210 @@
+package pingtunnel
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseDnsRules(t *testing.T) {
+	rules, err := ParseDnsRules("lan=local, Ads.Example.com.=block,router.home=192.168.1.1,corp.com=tunnel,v6.home=fd00::1")
+	if err != nil {
+		t.Fatalf("ParseDnsRules unexpected error: %v", err)
+	}
+	expected := []struct {
+		suffix string
+		action string
+		ip     string
+	}{
+		{"lan", DNS_ACTION_LOCAL, "<nil>"},
+		{"ads.example.com", DNS_ACTION_BLOCK, "<nil>"},
+		{"router.home", DNS_ACTION_ADDR, "192.168.1.1"},
+		{"corp.com", DNS_ACTION_TUNNEL, "<nil>"},
+		{"v6.home", DNS_ACTION_ADDR, "fd00::1"},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("ParseDnsRules returned %d rules, want %d", len(rules), len(expected))
+	}
+	for i, e := range expected {
+		if rules[i].Suffix != e.suffix || rules[i].Action != e.action || rules[i].IP.String() != e.ip {
+			t.Errorf("rule %d = %+v, want %v", i, rules[i], e)
+		}
+	}
+
+	for _, spec := range []string{"example.com", "=block", "example.com=drop"} {
+		if _, err := ParseDnsRules(spec); err == nil {
+			t.Errorf("ParseDnsRules(%q) expected error, got none", spec)
+		}
+	}
+}
+
+func TestMatchDnsRule(t *testing.T) {
+	rules, _ := ParseDnsRules("example.com=local,ads.example.com=block")
+	tests := []struct {
+		name   string
+		action string
+	}{
+		{"example.com.", DNS_ACTION_LOCAL},
+		{"www.EXAMPLE.com.", DNS_ACTION_LOCAL},
+		{"x.ads.example.com.", DNS_ACTION_BLOCK},
+		{"badexample.com.", ""},
+		{"example.org.", ""},
+	}
+	for _, test := range tests {
+		r := matchDnsRule(rules, test.name)
+		action := ""
+		if r != nil {
+			action = r.Action
+		}
+		if action != test.action {
+			t.Errorf("matchDnsRule(%q) = %q, want %q", test.name, action, test.action)
+		}
+	}
+}
+
+func buildTestDnsQuery(t *testing.T, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	query := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatalf("pack query: %v", err)
+	}
+	msg, err := parseDnsQuery(b)
+	if err != nil {
+		t.Fatalf("parseDnsQuery: %v", err)
+	}
+	return msg
+}
+
+func TestBuildDnsReply(t *testing.T) {
+	query := buildTestDnsQuery(t, "router.home.", dnsmessage.TypeA)
+
+	b, err := buildDnsReply(query, dnsmessage.RCodeSuccess, net.ParseIP("192.168.1.1"))
+	if err != nil {
+		t.Fatalf("buildDnsReply: %v", err)
+	}
+	resp := &dnsmessage.Message{}
+	if err := resp.Unpack(b); err != nil {
+		t.Fatalf("unpack reply: %v", err)
+	}
+	if resp.Header.ID != 0x1234 || !resp.Header.Response || len(resp.Answers) != 1 {
+		t.Fatalf("unexpected reply %+v", resp)
+	}
+	if a, ok := resp.Answers[0].Body.(*dnsmessage.AResource); !ok || net.IP(a.A[:]).String() != "192.168.1.1" {
+		t.Errorf("unexpected answer %v", resp.Answers[0].Body)
+	}
+
+	// an ipv4 rule gives an empty answer to AAAA queries
+	query = buildTestDnsQuery(t, "router.home.", dnsmessage.TypeAAAA)
+	b, _ = buildDnsReply(query, dnsmessage.RCodeSuccess, net.ParseIP("192.168.1.1"))
+	resp.Unpack(b)
+	if len(resp.Answers) != 0 || resp.Header.RCode != dnsmessage.RCodeSuccess {
+		t.Errorf("unexpected AAAA reply %+v", resp)
+	}
+}
+
+func TestDnsCache(t *testing.T) {
+	query := buildTestDnsQuery(t, "example.com.", dnsmessage.TypeA)
+	answer := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 0x1234, Response: true},
+		Questions: query.Questions,
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Class: dnsmessage.ClassINET, TTL: 30},
+			Body:   &dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}},
+		}},
+	}
+	b, _ := answer.Pack()
+
+	c := newDnsCache(2)
+	now := time.Now()
+	key := dnsCacheKey(query)
+	c.put(key, b, now)
+
+	got := c.get(key, 0x5678, now.Add(10*time.Second))
+	if got == nil {
+		t.Fatal("expected cache hit")
+	}
+	resp := &dnsmessage.Message{}
+	resp.Unpack(got)
+	if resp.Header.ID != 0x5678 || resp.Answers[0].Header.TTL != 20 {
+		t.Errorf("cached reply id %x ttl %d, want 5678 20", resp.Header.ID, resp.Answers[0].Header.TTL)
+	}
+
+	if c.get(key, 0x5678, now.Add(30*time.Second)) != nil {
+		t.Error("expected expired entry to miss")
+	}
+
+	// SERVFAIL is never cached
+	answer.Header.RCode = dnsmessage.RCodeServerFailure
+	answer.Answers = nil
+	b, _ = answer.Pack()
+	c.put(key, b, now)
+	if c.get(key, 1, now) != nil {
+		t.Error("expected SERVFAIL not to be cached")
+	}
+}
+
+func TestResolveHostWithoutListener(t *testing.T) {
+	// without -dns the lookup stays local, there is no tunnel to ask here
+	c := &Client{dns: &DnsConfig{}}
+	ip, err := c.ResolveHost("localhost")
+	if err != nil {
+		t.Fatalf("ResolveHost unexpected error: %v", err)
+	}
+	if !ip.IsLoopback() {
+		t.Errorf("ResolveHost(localhost) = %v, want a loopback address", ip)
+	}
+}
+
+func TestAcceptDnsUdpDropsWhenBusy(t *testing.T) {
+	t.Chdir(t.TempDir())
+	rules, err := ParseDnsRules("blocked.test=block")
+	if err != nil {
+		t.Fatalf("ParseDnsRules: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	c := &Client{dns: &DnsConfig{Rules: rules}, dnsUdpConn: conn, dnsWorker: make(chan struct{}, 1)}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go c.AcceptDnsUdp()
+	defer func() {
+		c.cancel()
+		c.workResultLock.Wait()
+		conn.Close()
+	}()
+
+	stub, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	defer stub.Close()
+	query, err := buildTestDnsQuery(t, "blocked.test.", dnsmessage.TypeA).Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	ask := func(wait time.Duration) bool {
+		stub.Write(query)
+		stub.SetReadDeadline(time.Now().Add(wait))
+		_, err := stub.Read(make([]byte, 512))
+		return err == nil
+	}
+
+	if !ask(2 * time.Second) {
+		t.Fatal("no answer with a free worker")
+	}
+	c.dnsWorker <- struct{}{}
+	if ask(300 * time.Millisecond) {
+		t.Error("answered with every worker busy")
+	}
+	<-c.dnsWorker
+	if !ask(2 * time.Second) {
+		t.Error("no answer once a worker is free again")
+	}
+}
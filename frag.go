@@ -0,0 +1,147 @@
+package pingtunnel
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// Udp datagrams larger than UDP_FRAG_SIZE are split into several echo packets
+// instead of one IP-fragmented ICMP packet, which many networks drop. The
+// receiver puts them back together with FragId, FragIndex and FragCount.
+const (
+	UDP_FRAG_SIZE         = 1200
+	UDP_FRAG_MAX_DATAGRAM = 65535
+	UDP_FRAG_MAX_COUNT    = (UDP_FRAG_MAX_DATAGRAM + UDP_FRAG_SIZE - 1) / UDP_FRAG_SIZE
+	UDP_FRAG_TIMEOUT      = 5 * time.Second
+	UDP_FRAG_MAX_BUFFER   = 16 * 1024 * 1024
+)
+
+var udpFragId uint32
+
+// sendICMPUDP sends a udp datagram, in pieces when it is too large for one
+// packet. It returns the number of packets sent.
+func sendICMPUDP(id int, sequence int, conn icmp.PacketConn, server *net.IPAddr, target string,
+	connId string, data []byte, sproto int, rproto int, key int, timeout int, udpmode int, cryptoConfig *CryptoConfig) int {
+
+	m := sendMsgPool.Get().(*MyMsg)
+	defer func() {
+		m.Reset()
+		sendMsgPool.Put(m)
+	}()
+	m.Id = connId
+	m.Type = (int32)(MyMsg_DATA)
+	m.Target = target
+	m.Rproto = (int32)(rproto)
+	m.Key = (int32)(key)
+	m.Timeout = (int32)(timeout)
+	m.Udpmode = (int32)(udpmode)
+	m.Magic = (int32)(MyMsg_MAGIC)
+
+	if len(data) <= UDP_FRAG_SIZE {
+		m.Data = data
+		sendICMPMsg(id, sequence, conn, server, m, sproto, cryptoConfig)
+		return 1
+	}
+
+	pieces := splitUDPFragments(data, UDP_FRAG_SIZE)
+	m.FragId = atomic.AddUint32(&udpFragId, 1)
+	m.FragCount = (int32)(len(pieces))
+	for i, piece := range pieces {
+		m.FragIndex = (int32)(i)
+		m.Data = piece
+		sendICMPMsg(id, sequence, conn, server, m, sproto, cryptoConfig)
+	}
+	return len(pieces)
+}
+
+func splitUDPFragments(data []byte, size int) [][]byte {
+	var pieces [][]byte
+	for len(data) > size {
+		pieces = append(pieces, data[:size])
+		data = data[size:]
+	}
+	return append(pieces, data)
+}
+
+type fragBuffer struct {
+	parts   [][]byte
+	got     int
+	size    int
+	created time.Time
+}
+
+// fragAssembler collects the pieces of fragmented datagrams. Incomplete ones
+// are dropped after UDP_FRAG_TIMEOUT, and at most maxBuffer bytes are held.
+type fragAssembler struct {
+	lock       sync.Mutex
+	pending    map[string]*fragBuffer
+	size       int
+	maxBuffer  int
+	lastExpire time.Time
+}
+
+func newFragAssembler(maxBuffer int) *fragAssembler {
+	return &fragAssembler{pending: make(map[string]*fragBuffer), maxBuffer: maxBuffer}
+}
+
+// add stores one piece and returns the whole datagram once all pieces are in.
+func (a *fragAssembler) add(connId string, fragId uint32, index int, count int, data []byte, now time.Time) []byte {
+	if count <= 1 || count > UDP_FRAG_MAX_COUNT || index < 0 || index >= count || len(data) > UDP_FRAG_SIZE {
+		return nil
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if now.Sub(a.lastExpire) >= time.Second {
+		a.expire(now)
+		a.lastExpire = now
+	}
+
+	key := connId + "|" + strconv.FormatUint(uint64(fragId), 10)
+	b := a.pending[key]
+	if b == nil {
+		b = &fragBuffer{parts: make([][]byte, count), created: now}
+		a.pending[key] = b
+	}
+	if len(b.parts) != count || b.parts[index] != nil {
+		return nil
+	}
+	if a.size+len(data) > a.maxBuffer || b.size+len(data) > UDP_FRAG_MAX_DATAGRAM {
+		a.drop(key, b)
+		return nil
+	}
+
+	b.parts[index] = append([]byte(nil), data...)
+	b.got++
+	b.size += len(data)
+	a.size += len(data)
+	if b.got < count {
+		return nil
+	}
+
+	ret := make([]byte, 0, b.size)
+	for _, part := range b.parts {
+		ret = append(ret, part...)
+	}
+	a.drop(key, b)
+	return ret
+}
+
+func (a *fragAssembler) drop(key string, b *fragBuffer) {
+	a.size -= b.size
+	delete(a.pending, key)
+}
+
+func (a *fragAssembler) expire(now time.Time) {
+	for key, b := range a.pending {
+		if now.Sub(b.created) > UDP_FRAG_TIMEOUT {
+			a.drop(key, b)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package pingtunnel
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSplitUDPFragments(t *testing.T) {
+	tests := []struct {
+		size  int
+		count int
+	}{
+		{1, 1},
+		{UDP_FRAG_SIZE, 1},
+		{UDP_FRAG_SIZE + 1, 2},
+		{UDP_FRAG_MAX_DATAGRAM, UDP_FRAG_MAX_COUNT},
+	}
+
+	for _, tt := range tests {
+		pieces := splitUDPFragments(make([]byte, tt.size), UDP_FRAG_SIZE)
+		if len(pieces) != tt.count {
+			t.Errorf("splitUDPFragments(%d) = %d pieces, want %d", tt.size, len(pieces), tt.count)
+		}
+	}
+}
+
+func TestFragAssembler(t *testing.T) {
+	data := make([]byte, 3*UDP_FRAG_SIZE+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	pieces := splitUDPFragments(data, UDP_FRAG_SIZE)
+	now := time.Now()
+
+	a := newFragAssembler(UDP_FRAG_MAX_BUFFER)
+	order := []int{2, 0, 3}
+	for _, i := range order {
+		if got := a.add("c1", 7, i, len(pieces), pieces[i], now); got != nil {
+			t.Fatalf("add piece %d returned a datagram before all pieces arrived", i)
+		}
+	}
+	if got := a.add("c1", 7, 0, len(pieces), pieces[0], now); got != nil {
+		t.Fatalf("add duplicate piece returned a datagram")
+	}
+	got := a.add("c1", 7, 1, len(pieces), pieces[1], now)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("reassembled datagram mismatch, got %d bytes, want %d", len(got), len(data))
+	}
+	if len(a.pending) != 0 || a.size != 0 {
+		t.Errorf("assembler not empty after reassembly: %d pending, %d bytes", len(a.pending), a.size)
+	}
+
+	// same fragment id on another session is another datagram
+	a.add("c1", 8, 0, 2, pieces[0], now)
+	if got := a.add("c2", 8, 1, 2, pieces[1], now); got != nil {
+		t.Errorf("pieces of different sessions were joined")
+	}
+}
+
+func TestFragAssemblerInvalid(t *testing.T) {
+	a := newFragAssembler(UDP_FRAG_MAX_BUFFER)
+	now := time.Now()
+	piece := make([]byte, 10)
+
+	tests := []struct {
+		name  string
+		index int
+		count int
+		data  []byte
+	}{
+		{"single", 0, 1, piece},
+		{"negative index", -1, 2, piece},
+		{"index out of range", 2, 2, piece},
+		{"too many pieces", 0, UDP_FRAG_MAX_COUNT + 1, piece},
+		{"piece too large", 0, 2, make([]byte, UDP_FRAG_SIZE+1)},
+	}
+
+	for _, tt := range tests {
+		a.add("c", 1, tt.index, tt.count, tt.data, now)
+		if len(a.pending) != 0 {
+			t.Errorf("add(%s) kept a buffer", tt.name)
+		}
+	}
+
+	a.add("c", 1, 0, 3, piece, now)
+	if got := a.add("c", 1, 1, 4, piece, now); got != nil || a.pending["c|1"].got != 1 {
+		t.Errorf("add with a changed piece count was accepted")
+	}
+}
+
+func TestFragAssemblerLimits(t *testing.T) {
+	now := time.Now()
+	piece := make([]byte, UDP_FRAG_SIZE)
+
+	a := newFragAssembler(UDP_FRAG_MAX_BUFFER)
+	a.add("c", 1, 0, 2, piece, now)
+	a.add("c", 2, 0, 2, piece, now.Add(UDP_FRAG_TIMEOUT))
+	a.add("c", 3, 0, 2, piece, now.Add(UDP_FRAG_TIMEOUT+time.Second))
+	if _, ok := a.pending["c|1"]; ok {
+		t.Errorf("timed out datagram was not dropped")
+	}
+	if len(a.pending) != 2 || a.size != 2*UDP_FRAG_SIZE {
+		t.Errorf("assembler holds %d datagrams %d bytes, want 2 and %d", len(a.pending), a.size, 2*UDP_FRAG_SIZE)
+	}
+
+	a = newFragAssembler(2 * UDP_FRAG_SIZE)
+	a.add("c", 1, 0, 3, piece, now)
+	a.add("c", 1, 1, 3, piece, now)
+	if got := a.add("c", 1, 2, 3, piece, now); got != nil {
+		t.Errorf("datagram over the buffer limit was reassembled")
+	}
+	if len(a.pending) != 0 || a.size != 0 {
+		t.Errorf("assembler holds %d datagrams %d bytes after hitting the limit", len(a.pending), a.size)
+	}
+}
@@ -0,0 +1,116 @@
+package pingtunnel
+
+import (
+	"container/list"
+	"sync/atomic"
+	"time"
+
+	"github.com/esrrhs/gohome/network"
+)
+
+const (
+	// FrameMgr pings and sends a heartbeat once a second
+	FRAME_CLOCK_BEAT = time.Second
+	// waited past a deadline as the FrameMgr only acts once it has passed
+	FRAME_CLOCK_SLACK = time.Millisecond
+	// retry of a deadline the FrameMgr did not act on, e.g. a resend held back
+	FRAME_CLOCK_RETRY = 10 * time.Millisecond
+)
+
+// frameClock follows the timers of a FrameMgr from the frames it sends and
+// receives, as it does not expose them, so a session loop can sleep until the
+// next one is due and otherwise only wake on data or acks. It is created with
+// the FrameMgr, everything but the rtt belongs to the session loop.
+type frameClock struct {
+	resend   time.Duration
+	rtt      atomic.Int64 // ns, averaged from pongs as the FrameMgr does
+	inflight map[int32]*network.Frame
+	nextBeat time.Time
+	reqUntil time.Time
+	timer    *time.Timer
+}
+
+func newFrameClock(resendms int) *frameClock {
+	return &frameClock{
+		resend:   time.Duration(resendms) * time.Millisecond,
+		inflight: make(map[int32]*network.Frame),
+		nextBeat: time.Now().Add(FRAME_CLOCK_BEAT),
+	}
+}
+
+func (c *frameClock) stop() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// received notes a frame passed to OnRecvFrame, from the packet path.
+func (c *frameClock) received(f *network.Frame) {
+	if f.Type != (int32)(network.Frame_PONG) {
+		return
+	}
+	rtt := time.Now().UnixNano() - f.Sendtime
+	if rtt > 0 {
+		c.rtt.Store((c.rtt.Load() + rtt) / 2)
+	}
+}
+
+// sent notes the frames of GetSendList. Data frames stay in flight until
+// acked, a REQ is repeated each rtt while frames are missing.
+func (c *frameClock) sent(sendlist *list.List, now time.Time) {
+	req := false
+	for e := sendlist.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*network.Frame)
+		switch f.Type {
+		case (int32)(network.Frame_DATA):
+			c.inflight[f.Id] = f
+		case (int32)(network.Frame_PING):
+			c.nextBeat = now.Add(FRAME_CLOCK_BEAT + FRAME_CLOCK_SLACK)
+		case (int32)(network.Frame_REQ):
+			req = true
+		}
+	}
+	if req {
+		c.reqUntil = now.Add(c.resendAfter(0))
+	} else if !now.Before(c.reqUntil) {
+		c.reqUntil = time.Time{}
+	}
+}
+
+// resendAfter is how long the FrameMgr waits before sending a frame again.
+func (c *frameClock) resendAfter(min time.Duration) time.Duration {
+	return max(min, time.Duration(c.rtt.Load())) + FRAME_CLOCK_SLACK
+}
+
+// next returns when the FrameMgr has something to do without new data.
+func (c *frameClock) next(now time.Time) time.Time {
+	next := c.nextBeat
+	if !c.reqUntil.IsZero() && c.reqUntil.Before(next) {
+		next = c.reqUntil
+	}
+	resend := c.resendAfter(c.resend)
+	for id, f := range c.inflight {
+		if f.Acked {
+			delete(c.inflight, id)
+			continue
+		}
+		if due := time.Unix(0, f.Sendtime).Add(resend); due.Before(next) {
+			next = due
+		}
+	}
+	if !next.After(now) {
+		next = now.Add(FRAME_CLOCK_RETRY)
+	}
+	return next
+}
+
+// after resets the timer to the next deadline and returns its channel.
+func (c *frameClock) after(now time.Time) <-chan time.Time {
+	d := c.next(now).Sub(now)
+	if c.timer == nil {
+		c.timer = time.NewTimer(d)
+	} else {
+		c.timer.Reset(d)
+	}
+	return c.timer.C
+}
@@ -0,0 +1,179 @@
+package pingtunnel
+
+import (
+	"bytes"
+	"container/list"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/esrrhs/gohome/network"
+	"google.golang.org/protobuf/proto"
+)
+
+func sendList(frames ...*network.Frame) *list.List {
+	l := list.New()
+	for _, f := range frames {
+		l.PushBack(f)
+	}
+	return l
+}
+
+func TestFrameClock(t *testing.T) {
+	c := newFrameClock(400)
+	now := time.Now()
+
+	// idle, only the ping is due
+	c.sent(sendList(&network.Frame{Type: (int32)(network.Frame_PING), Sendtime: now.UnixNano()}), now)
+	if got, want := c.next(now), now.Add(FRAME_CLOCK_BEAT+FRAME_CLOCK_SLACK); !got.Equal(want) {
+		t.Errorf("next idle = %v, want %v", got.Sub(now), want.Sub(now))
+	}
+
+	// a data frame in flight is resent after the resend time
+	data := &network.Frame{Type: (int32)(network.Frame_DATA), Id: 1, Sendtime: now.UnixNano()}
+	c.sent(sendList(data), now)
+	if got, want := c.next(now), now.Add(400*time.Millisecond+FRAME_CLOCK_SLACK); !got.Equal(want) {
+		t.Errorf("next in flight = %v, want %v", got.Sub(now), want.Sub(now))
+	}
+
+	// or after the rtt when it is longer
+	c.received(&network.Frame{Type: (int32)(network.Frame_PONG), Sendtime: time.Now().Add(-2 * time.Second).UnixNano()})
+	if got := c.next(now).Sub(now); got < time.Second || got > FRAME_CLOCK_BEAT+FRAME_CLOCK_SLACK {
+		t.Errorf("next with 1s rtt = %v, want the beat", got)
+	}
+	c.rtt.Store(0)
+
+	// acked frames are dropped
+	data.Acked = true
+	c.next(now)
+	if len(c.inflight) != 0 {
+		t.Errorf("inflight = %d frames after the ack, want 0", len(c.inflight))
+	}
+
+	// a REQ is repeated each rtt until no more is sent after it
+	c.rtt.Store(int64(50 * time.Millisecond))
+	c.sent(sendList(&network.Frame{Type: (int32)(network.Frame_REQ)}), now)
+	if got, want := c.next(now), now.Add(50*time.Millisecond+FRAME_CLOCK_SLACK); !got.Equal(want) {
+		t.Errorf("next after req = %v, want %v", got.Sub(now), want.Sub(now))
+	}
+	c.sent(list.New(), now.Add(10*time.Millisecond))
+	if c.reqUntil.IsZero() {
+		t.Errorf("req deadline dropped before it was due")
+	}
+	c.sent(list.New(), now.Add(60*time.Millisecond))
+	if !c.reqUntil.IsZero() {
+		t.Errorf("req deadline kept after no req was sent")
+	}
+
+	// a deadline the FrameMgr let pass is retried, not spun on
+	late := now.Add(5 * time.Second)
+	if got, want := c.next(late), late.Add(FRAME_CLOCK_RETRY); !got.Equal(want) {
+		t.Errorf("next overdue = %v, want %v", got.Sub(late), want.Sub(late))
+	}
+
+	// the timer fires at the deadline
+	c.nextBeat = time.Now().Add(20 * time.Millisecond)
+	start := time.Now()
+	select {
+	case <-c.after(start):
+	case <-time.After(time.Second):
+		t.Fatalf("timer did not fire")
+	}
+	if d := time.Since(start); d < 15*time.Millisecond {
+		t.Errorf("timer fired after %v, want about 20ms", d)
+	}
+	c.stop()
+}
+
+// frameEnd is one side of a FrameMgr session driven like the session loops.
+type frameEnd struct {
+	fm       *network.FrameMgr
+	clock    *frameClock
+	activity chan struct{}
+	peer     *frameEnd
+}
+
+func newFrameEnd() *frameEnd {
+	return &frameEnd{
+		fm:       network.NewFrameMgr(FRAME_MAX_SIZE, FRAME_MAX_ID, 1024*1024, 1000, 100, 0, 0),
+		clock:    newFrameClock(100),
+		activity: make(chan struct{}, 1),
+	}
+}
+
+// run passes frames to the peer, dropping one in loss, and appends what it
+// receives to recv until done is closed.
+func (e *frameEnd) run(loss float64, recv *bytes.Buffer, mu *sync.Mutex, done chan struct{}) {
+	rnd := rand.New(rand.NewSource(1))
+	for {
+		e.fm.Update()
+		sendlist := e.fm.GetSendList()
+		e.clock.sent(sendlist, time.Now())
+		for el := sendlist.Front(); el != nil; el = el.Next() {
+			mb, _ := e.fm.MarshalFrame(el.Value.(*network.Frame))
+			if rnd.Float64() < loss {
+				continue
+			}
+			f := &network.Frame{}
+			proto.Unmarshal(mb, f)
+			e.peer.clock.received(f)
+			e.peer.fm.OnRecvFrame(f)
+			notifyActivity(e.peer.activity)
+		}
+		if n := e.fm.GetRecvBufferSize(); n > 0 {
+			mu.Lock()
+			recv.Write(e.fm.GetRecvReadLineBuffer())
+			mu.Unlock()
+			e.fm.SkipRecvBuffer(n)
+			continue
+		}
+		select {
+		case <-done:
+			e.clock.stop()
+			return
+		case <-e.activity:
+		case <-e.clock.after(time.Now()):
+		}
+	}
+}
+
+func TestFrameClockLoss(t *testing.T) {
+	a, b := newFrameEnd(), newFrameEnd()
+	a.peer, b.peer = b, a
+
+	data := make([]byte, 200*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	a.fm.Connect()
+	a.fm.WriteSendBuffer(data)
+
+	var mu sync.Mutex
+	recv := &bytes.Buffer{}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, e := range []*frameEnd{a, b} {
+		wg.Add(1)
+		go func(e *frameEnd) {
+			defer wg.Done()
+			e.run(0.1, recv, &mu, done)
+		}(e)
+	}
+
+	// lost frames are only recovered by the resend and req timers
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		mu.Lock()
+		n := recv.Len()
+		mu.Unlock()
+		if n >= len(data) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+
+	if !bytes.Equal(recv.Bytes(), data) {
+		t.Fatalf("received %d of %d bytes over a lossy link", recv.Len(), len(data))
+	}
+}
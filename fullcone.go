@@ -0,0 +1,96 @@
+package pingtunnel
+
+import (
+	"net"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// MyMsg.Udpmode of udp sessions. A full-cone session sends each datagram to
+// its own Target and accepts replies from any address.
+const (
+	UDP_MODE_CONNECTED = 0
+	UDP_MODE_FULLCONE  = 1
+
+	UDP_FULLCONE_ADDR_CACHE  = 256
+	UDP_FULLCONE_ROUTE_CACHE = 4096
+)
+
+func (p *Server) processFullConeNewConn(id string, packet *Packet) *ServerConn {
+
+	c, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		loggo.Error("Error listening for full cone udp: %s %s", id, err.Error())
+		p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), (int)(packet.my.Key), packet.crypto, packet.src, KICK_REASON_NONE)
+		return nil
+	}
+
+	// the first target passed the route in processDataPacketNewConn
+	localConn := &ServerConn{timeout: (int)(packet.my.Timeout), conn: c, id: id, tcpmode: (int)(packet.my.Tcpmode), udpTargetAddr: packet.my.Target,
+		udpFullCone: true, udpAddrCache: make(map[string]*net.UDPAddr), udpRouteCache: map[string]bool{packet.my.Target: true}}
+
+	p.addServerConn(id, localConn, packetPeer(packet))
+	loggo.Info("server new full cone udp %s %s", id, c.LocalAddr().String())
+
+	go p.Recv(localConn, id, packet.src)
+
+	return localConn
+}
+
+// fullConeAddr resolves the target of a full-cone datagram. Lookups are cached
+// per session, so only the first datagram to a name waits for DNS.
+func (conn *ServerConn) fullConeAddr(target string, resolver *Resolver) (*net.UDPAddr, error) {
+	if addr, ok := conn.udpAddrCache[target]; ok {
+		return addr, nil
+	}
+	var addr *net.UDPAddr
+	var err error
+	if resolver != nil {
+		addr, err = resolver.ResolveUDPAddr(target)
+	} else {
+		addr, err = net.ResolveUDPAddr("udp", target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(conn.udpAddrCache) >= UDP_FULLCONE_ADDR_CACHE {
+		conn.udpAddrCache = make(map[string]*net.UDPAddr)
+	}
+	conn.udpAddrCache[target] = addr
+	return addr, nil
+}
+
+// fullConeAllowed checks a target of a full-cone session against the server
+// route like the first one was. A target routed to an upstream is refused,
+// the session's socket can not reach it through a proxy. Decisions are cached
+// per session next to the addresses.
+func (p *Server) fullConeAllowed(conn *ServerConn, target string) bool {
+	if allowed, ok := conn.udpRouteCache[target]; ok {
+		return allowed
+	}
+	upstream, _, ok := p.routeUpstream(p.settings.Load(), "udp", target)
+	allowed := ok && upstream == nil
+	if !allowed {
+		loggo.Info("server route refuse full cone udp target %s %s", conn.id, target)
+	}
+	if len(conn.udpRouteCache) >= UDP_FULLCONE_ADDR_CACHE {
+		conn.udpRouteCache = make(map[string]bool)
+	}
+	conn.udpRouteCache[target] = allowed
+	return allowed
+}
+
+type sock5UDPRoute struct {
+	action string
+	server *net.IPAddr
+}
+
+// sock5FullConeKey is the session key of the full-cone flow of a socks client
+// socket, one per server it is routed to.
+func (p *Client) sock5FullConeKey(relayConn *net.UDPConn, srcaddr *net.UDPAddr, server *net.IPAddr) string {
+	s := "fullcone"
+	if server != nil {
+		s += "|" + server.String()
+	}
+	return p.sock5UDPConnKey(relayConn, srcaddr, s)
+}
@@ -0,0 +1,97 @@
+package pingtunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFullConeAddr(t *testing.T) {
+	conn := &ServerConn{udpAddrCache: make(map[string]*net.UDPAddr)}
+
+	addr, err := conn.fullConeAddr("127.0.0.1:3478", nil)
+	if err != nil {
+		t.Fatalf("fullConeAddr unexpected error: %v", err)
+	}
+	if addr.String() != "127.0.0.1:3478" {
+		t.Errorf("fullConeAddr(%q) = %s", "127.0.0.1:3478", addr)
+	}
+	if again, _ := conn.fullConeAddr("127.0.0.1:3478", nil); again != addr {
+		t.Errorf("fullConeAddr(%q) not cached", "127.0.0.1:3478")
+	}
+
+	if _, err := conn.fullConeAddr("127.0.0.1", nil); err == nil {
+		t.Errorf("fullConeAddr(%q) expected error", "127.0.0.1")
+	}
+
+	for i := 0; i < UDP_FULLCONE_ADDR_CACHE+10; i++ {
+		if _, err := conn.fullConeAddr(fmt.Sprintf("10.0.%d.%d:53", i/256, i%256), nil); err != nil {
+			t.Fatalf("fullConeAddr unexpected error: %v", err)
+		}
+	}
+	if len(conn.udpAddrCache) > UDP_FULLCONE_ADDR_CACHE {
+		t.Errorf("fullConeAddr cache size %d, want at most %d", len(conn.udpAddrCache), UDP_FULLCONE_ADDR_CACHE)
+	}
+}
+
+func TestFullConeRoutePerTarget(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	listen := func() *net.UDPConn {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("ListenUDP: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	allowed := listen()
+	rejected := listen()
+	rejectedPort := rejected.LocalAddr().(*net.UDPAddr).Port
+
+	table, err := ParseRouteRules(strings.NewReader(fmt.Sprintf("DST-PORT,%d,reject\nDOMAIN,proxied.test,proxy:us\nFINAL,direct\n", rejectedPort)))
+	if err != nil {
+		t.Fatalf("ParseRouteRules unexpected error: %v", err)
+	}
+	upstreams, _ := ParseUpstreams("us=socks5://127.0.0.1:1080")
+	route, err := NewServerRoute(table, upstreams, nil)
+	if err != nil {
+		t.Fatalf("NewServerRoute unexpected error: %v", err)
+	}
+	s, err := NewServer("", 0, 0, 0, 0, 1000, nil, nil, 0, 0, nil, "", route, nil, nil, 0)
+	if err != nil {
+		t.Fatalf("NewServer unexpected error: %v", err)
+	}
+
+	c, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	conn := &ServerConn{conn: c, id: "fullcone", udpTargetAddr: allowed.LocalAddr().String(), udpFullCone: true,
+		udpAddrCache: make(map[string]*net.UDPAddr), udpRouteCache: map[string]bool{allowed.LocalAddr().String(): true}}
+	s.addServerConn(conn.id, conn, serverPeer{src: &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}})
+	defer s.close(conn)
+
+	send := func(target string, data string) {
+		s.processDataPacket(&Packet{my: &MyMsg{Id: conn.id, Type: (int32)(MyMsg_DATA), Target: target, Data: []byte(data),
+			Udpmode: UDP_MODE_FULLCONE}, src: &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}})
+	}
+	send(allowed.LocalAddr().String(), "first")
+	send(rejected.LocalAddr().String(), "second")
+	send("proxied.test:53", "third")
+
+	buf := make([]byte, 64)
+	allowed.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := allowed.ReadFromUDP(buf); err != nil || string(buf[:n]) != "first" {
+		t.Errorf("allowed target got %q %v", buf[:n], err)
+	}
+	rejected.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := rejected.ReadFromUDP(buf); err == nil {
+		t.Errorf("rejected target got %q", buf[:n])
+	}
+	if conn.udpRouteCache[rejected.LocalAddr().String()] || conn.udpRouteCache["proxied.test:53"] {
+		t.Errorf("route cache %v, want the later targets refused", conn.udpRouteCache)
+	}
+}
@@ -0,0 +1,243 @@
+package pingtunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// AES-GCM-SIV (RFC 8452) is nonce-misuse resistant: a repeated nonce only
+// shows that two messages were equal, it does not leak the key stream.
+
+const (
+	gcmSivNonceSize = 12
+	gcmSivTagSize   = 16
+)
+
+// gcmSiv keeps the key-generating AES cipher of its key, only the message
+// key depends on the nonce and is expanded per message.
+type gcmSiv struct {
+	block   cipher.Block
+	keySize int
+}
+
+// gcmSivBlockPool holds the two blocks a message is encrypted through; arrays
+// handed to a cipher.Block escape, a pool saves allocating them per message.
+var gcmSivBlockPool = sync.Pool{
+	New: func() interface{} {
+		return new([2][16]byte)
+	},
+}
+
+// putGcmSivBlocks clears the key stream and derived key bytes left in blocks.
+func putGcmSivBlocks(blocks *[2][16]byte) {
+	*blocks = [2][16]byte{}
+	gcmSivBlockPool.Put(blocks)
+}
+
+func newAESGCMSIV(key []byte) (cipher.AEAD, error) {
+	if len(key) != 16 && len(key) != 32 {
+		return nil, errors.New("aes-gcm-siv key must be 16 or 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmSiv{block: block, keySize: len(key)}, nil
+}
+
+func (g *gcmSiv) NonceSize() int {
+	return gcmSivNonceSize
+}
+
+func (g *gcmSiv) Overhead() int {
+	return gcmSivTagSize
+}
+
+func (g *gcmSiv) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != gcmSivNonceSize {
+		panic("aes-gcm-siv: incorrect nonce length")
+	}
+	blocks := gcmSivBlockPool.Get().(*[2][16]byte)
+	defer putGcmSivBlocks(blocks)
+	authKey, encBlock := g.deriveKeys(nonce, blocks)
+	tag := gcmSivTag(authKey, encBlock, nonce, plaintext, additionalData, blocks)
+
+	ret, out := sliceForAppend(dst, len(plaintext)+gcmSivTagSize)
+	gcmSivCtr(encBlock, tag, out[:len(plaintext)], plaintext, blocks)
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (g *gcmSiv) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != gcmSivNonceSize {
+		panic("aes-gcm-siv: incorrect nonce length")
+	}
+	if len(ciphertext) < gcmSivTagSize {
+		return nil, errors.New("aes-gcm-siv: message authentication failed")
+	}
+	var tag [16]byte
+	copy(tag[:], ciphertext[len(ciphertext)-gcmSivTagSize:])
+	ciphertext = ciphertext[:len(ciphertext)-gcmSivTagSize]
+
+	blocks := gcmSivBlockPool.Get().(*[2][16]byte)
+	defer putGcmSivBlocks(blocks)
+	authKey, encBlock := g.deriveKeys(nonce, blocks)
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	gcmSivCtr(encBlock, tag, out, ciphertext, blocks)
+
+	expected := gcmSivTag(authKey, encBlock, nonce, out, additionalData, blocks)
+	if subtle.ConstantTimeCompare(expected[:], tag[:]) != 1 {
+		clear(out)
+		return nil, errors.New("aes-gcm-siv: message authentication failed")
+	}
+	return ret, nil
+}
+
+// deriveKeys derives the per-nonce POLYVAL key and AES key.
+func (g *gcmSiv) deriveKeys(nonce []byte, blocks *[2][16]byte) ([16]byte, cipher.Block) {
+	in, out := &blocks[0], &blocks[1]
+	copy(in[4:], nonce)
+	var buf [16 + 32]byte
+	derived := buf[:16+g.keySize]
+	for i := 0; i < len(derived)/8; i++ {
+		binary.LittleEndian.PutUint32(in[:4], uint32(i))
+		g.block.Encrypt(out[:], in[:])
+		copy(derived[i*8:], out[:8])
+	}
+	var authKey [16]byte
+	copy(authKey[:], derived[:16])
+	encBlock, _ := aes.NewCipher(derived[16:])
+	return authKey, encBlock
+}
+
+func gcmSivTag(authKey [16]byte, encBlock cipher.Block, nonce, plaintext, additionalData []byte, blocks *[2][16]byte) [16]byte {
+	var p polyval
+	p.init(authKey)
+	p.updatePadded(additionalData)
+	p.updatePadded(plaintext)
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(additionalData))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+	p.update(lengths[:])
+
+	s := &blocks[0]
+	*s = p.sum()
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	encBlock.Encrypt(s[:], s[:])
+	return *s
+}
+
+// gcmSivCtr is AES-CTR with the tag as initial counter block and a 32-bit
+// little-endian counter.
+func gcmSivCtr(encBlock cipher.Block, tag [16]byte, dst, src []byte, blocks *[2][16]byte) {
+	counter, stream := &blocks[0], &blocks[1]
+	*counter = tag
+	counter[15] |= 0x80
+	for len(src) > 0 {
+		encBlock.Encrypt(stream[:], counter[:])
+		n := subtle.XORBytes(dst, src, stream[:])
+		dst, src = dst[n:], src[n:]
+		binary.LittleEndian.PutUint32(counter[:4], binary.LittleEndian.Uint32(counter[:4])+1)
+	}
+}
+
+// polyval is the POLYVAL hash of RFC 8452, elements are 128-bit little-endian
+// polynomials over x^128 + x^127 + x^126 + x^121 + 1.
+type polyval struct {
+	hlo, hhi uint64
+	slo, shi uint64
+}
+
+func (p *polyval) init(key [16]byte) {
+	p.hlo = binary.LittleEndian.Uint64(key[:8])
+	p.hhi = binary.LittleEndian.Uint64(key[8:])
+	p.slo, p.shi = 0, 0
+}
+
+// update hashes whole blocks.
+func (p *polyval) update(data []byte) {
+	for ; len(data) >= 16; data = data[16:] {
+		p.slo ^= binary.LittleEndian.Uint64(data[:8])
+		p.shi ^= binary.LittleEndian.Uint64(data[8:16])
+		p.slo, p.shi = polyvalDot(p.slo, p.shi, p.hlo, p.hhi)
+	}
+}
+
+// updatePadded hashes data with the last block padded with zeros.
+func (p *polyval) updatePadded(data []byte) {
+	full := len(data) &^ 15
+	p.update(data[:full])
+	if full < len(data) {
+		var last [16]byte
+		copy(last[:], data[full:])
+		p.update(last[:])
+	}
+}
+
+func (p *polyval) sum() [16]byte {
+	var s [16]byte
+	binary.LittleEndian.PutUint64(s[:8], p.slo)
+	binary.LittleEndian.PutUint64(s[8:], p.shi)
+	return s
+}
+
+// polyvalDot returns a*b*x^-128: a Karatsuba carry-less multiply on 64-bit
+// limbs, then a Montgomery reduction that clears the low 128 bits 64 at a time.
+func polyvalDot(alo, ahi, blo, bhi uint64) (uint64, uint64) {
+	z0, z1 := clmul64(alo, blo)
+	z2, z3 := clmul64(ahi, bhi)
+	mlo, mhi := clmul64(alo^ahi, blo^bhi)
+	mlo ^= z0 ^ z2
+	mhi ^= z1 ^ z3
+	z1 ^= mlo
+	z2 ^= mhi
+
+	// adding z0*P clears z0, the x^121, x^126, x^127 and x^128 terms land
+	// in z1 and z2; then the same for z1
+	z1 ^= z0<<57 ^ z0<<62 ^ z0<<63
+	z2 ^= z0 ^ z0>>7 ^ z0>>2 ^ z0>>1
+	z2 ^= z1<<57 ^ z1<<62 ^ z1<<63
+	z3 ^= z1 ^ z1>>7 ^ z1>>2 ^ z1>>1
+	return z2, z3
+}
+
+// clmul64 returns the 128-bit carry-less product of x and y.
+func clmul64(x, y uint64) (uint64, uint64) {
+	x0, x1 := uint32(x), uint32(x>>32)
+	y0, y1 := uint32(y), uint32(y>>32)
+	lo := clmul32(x0, y0)
+	hi := clmul32(x1, y1)
+	mid := clmul32(x0^x1, y0^y1) ^ lo ^ hi
+	return lo ^ mid<<32, hi ^ mid>>32
+}
+
+// clmul32 returns the carry-less product of x and y in constant time. It
+// multiplies integers with every fourth bit kept, so carries only spill into
+// the three-bit holes between them, which are masked off (BearSSL's ctmul).
+func clmul32(x, y uint32) uint64 {
+	x0, x1, x2, x3 := uint64(x&0x11111111), uint64(x&0x22222222), uint64(x&0x44444444), uint64(x&0x88888888)
+	y0, y1, y2, y3 := uint64(y&0x11111111), uint64(y&0x22222222), uint64(y&0x44444444), uint64(y&0x88888888)
+	z0 := x0*y0 ^ x1*y3 ^ x2*y2 ^ x3*y1
+	z1 := x0*y1 ^ x1*y0 ^ x2*y3 ^ x3*y2
+	z2 := x0*y2 ^ x1*y1 ^ x2*y0 ^ x3*y3
+	z3 := x0*y3 ^ x1*y2 ^ x2*y1 ^ x3*y0
+	return z0&0x1111111111111111 | z1&0x2222222222222222 | z2&0x4444444444444444 | z3&0x8888888888888888
+}
+
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
@@ -0,0 +1,119 @@
+package pingtunnel
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+// vectors from RFC 8452 appendix A and C
+func TestPolyval(t *testing.T) {
+	h, _ := hex.DecodeString("25629347589242761d31f826ba4b757b")
+	x, _ := hex.DecodeString("4f4f95668c83dfb6401762bb2d01a262d1a24ddd2721d006bbe45f20d3c9f362")
+	var key [16]byte
+	copy(key[:], h)
+	var p polyval
+	p.init(key)
+	p.update(x)
+	sum := p.sum()
+	if got := hex.EncodeToString(sum[:]); got != "f7a3b47b846119fae5b7866cf5e5b77e" {
+		t.Errorf("POLYVAL = %s, want f7a3b47b846119fae5b7866cf5e5b77e", got)
+	}
+}
+
+func TestAESGCMSIV(t *testing.T) {
+	key128 := "01000000000000000000000000000000"
+	key256 := "0100000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		key       string
+		aad       string
+		plaintext string
+		want      string
+	}{
+		{key128, "", "", "dc20e2d83f25705bb49e439eca56de25"},
+		{key128, "", "0100000000000000", "b5d839330ac7b786578782fff6013b815b287c22493a364c"},
+		{key128, "", "010000000000000000000000", "7323ea61d05932260047d942a4978db357391a0bc4fdec8b0d106639"},
+		{key128, "", "01000000000000000000000000000000", "743f7c8077ab25f8624e2e948579cf77303aaf90f6fe21199c6068577437a0c4"},
+		{key128, "", "0100000000000000000000000000000002000000000000000000000000000000", "84e07e62ba83a6585417245d7ec413a9fe427d6315c09b57ce45f2e3936a94451a8e45dcd4578c667cd86847bf6155ff"},
+		{key128, "01", "0200000000000000", "1e6daba35669f4273b0a1a2560969cdf790d99759abd1508"},
+		{key128, "01", "020000000000000000000000", "296c7889fd99f41917f4462008299c5102745aaa3a0c469fad9e075a"},
+		{key128, "01", "02000000000000000000000000000000", "e2b0c5da79a901c1745f700525cb335b8f8936ec039e4e4bb97ebd8c4457441f"},
+		{key128, "01", "0200000000000000000000000000000003000000000000000000000000000000", "620048ef3c1e73e57e02bb8562c416a319e73e4caac8e96a1ecb2933145a1d71e6af6a7f87287da059a71684ed3498e1"},
+		{key256, "", "", "07f5f4169bbf55a8400cd47ea6fd400f"},
+		{key256, "", "0100000000000000", "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28"},
+		{key256, "", "01000000000000000000000000000000", "85a01b63025ba19b7fd3ddfc033b3e76c9eac6fa700942702e90862383c6c366"},
+		{key256, "", "0100000000000000000000000000000002000000000000000000000000000000", "4a6a9db4c8c6549201b9edb53006cba821ec9cf850948a7c86c68ac7539d027fe819e63abcd020b006a976397632eb5d"},
+		{key256, "01", "0200000000000000", "1de22967237a813291213f267e3b452f02d01ae33e4ec854"},
+	}
+	nonce, _ := hex.DecodeString("030000000000000000000000")
+	for _, tt := range tests {
+		key, _ := hex.DecodeString(tt.key)
+		aad, _ := hex.DecodeString(tt.aad)
+		plaintext, _ := hex.DecodeString(tt.plaintext)
+		aead, err := newAESGCMSIV(key)
+		if err != nil {
+			t.Fatalf("newAESGCMSIV(%s) failed: %v", tt.key, err)
+		}
+		sealed := aead.Seal(nil, nonce, plaintext, aad)
+		if got := hex.EncodeToString(sealed); got != tt.want {
+			t.Errorf("Seal(%s, %s, %s) = %s, want %s", tt.key, tt.plaintext, tt.aad, got, tt.want)
+		}
+		opened, err := aead.Open(nil, nonce, sealed, aad)
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("Open(%s, %s, %s) = %x, %v", tt.key, tt.want, tt.aad, opened, err)
+		}
+	}
+}
+
+func TestAESGCMSIVTamper(t *testing.T) {
+	aead, _ := newAESGCMSIV(bytes.Repeat([]byte{1}, 32))
+	nonce := bytes.Repeat([]byte{2}, 12)
+	plaintext := bytes.Repeat([]byte("pingtunnel"), 20)
+	sealed := aead.Seal(nil, nonce, plaintext, []byte("aad"))
+
+	for _, i := range []int{0, len(plaintext) - 1, len(sealed) - 1} {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 1
+		if _, err := aead.Open(nil, nonce, tampered, []byte("aad")); err == nil {
+			t.Errorf("Open with byte %d flipped should fail", i)
+		}
+	}
+	if _, err := aead.Open(nil, nonce, sealed, []byte("other")); err == nil {
+		t.Errorf("Open with other additional data should fail")
+	}
+	if _, err := aead.Open(nil, nonce, sealed[:15], nil); err == nil {
+		t.Errorf("Open of a short message should fail")
+	}
+	opened, err := aead.Open(nil, nonce, sealed, []byte("aad"))
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Errorf("Open = %v, want the plaintext back", err)
+	}
+}
+
+func BenchmarkAESGCMSIV(b *testing.B) {
+	for _, keySize := range []int{16, 32} {
+		aead, _ := newAESGCMSIV(make([]byte, keySize))
+		nonce := make([]byte, gcmSivNonceSize)
+		data := make([]byte, 1024)
+		sealed := aead.Seal(nil, nonce, data, nil)
+		buf := make([]byte, 0, len(sealed))
+
+		b.Run(fmt.Sprintf("Seal-%d", keySize*8), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				aead.Seal(buf[:0], nonce, data, nil)
+			}
+		})
+		b.Run(fmt.Sprintf("Open-%d", keySize*8), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := aead.Open(buf[:0], nonce, sealed, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
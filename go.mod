@@ -6,6 +6,7 @@ require (
 	github.com/esrrhs/gohome v0.0.0-20251230021531-10dd8849d958
 	golang.org/x/crypto v0.46.0
 	golang.org/x/net v0.48.0
+	golang.org/x/sys v0.39.0
 	google.golang.org/protobuf v1.36.11
 )
 
@@ -23,5 +24,4 @@ require (
 	github.com/tjfoc/gmsm v1.4.1 // indirect
 	github.com/xtaci/kcp-go v5.4.20+incompatible // indirect
 	github.com/xtaci/smux v1.5.50 // indirect
-	golang.org/x/sys v0.39.0 // indirect
 )
@@ -0,0 +1,182 @@
+package pingtunnel
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// HTTP_PROXY_HEADER_TIMEOUT bounds reading a proxy request's header, which a
+// local client sends at once, so idle connections do not pile up.
+const HTTP_PROXY_HEADER_TIMEOUT = 5 * time.Second
+
+// prefixConn is a TCP connection whose first bytes come from r, used to hand
+// data already consumed while parsing a request over to the tunnel.
+type prefixConn struct {
+	*net.TCPConn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// WriteTo hides the one of the TCP connection, io.Copy would skip r otherwise.
+func (c *prefixConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, c.r)
+}
+
+// httpProxyTarget returns the host:port a proxy request should be sent to.
+func httpProxyTarget(req *http.Request) (string, error) {
+	if req.Method == http.MethodConnect {
+		host := req.Host
+		if host == "" && req.URL != nil {
+			host = req.URL.Host
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			return "", fmt.Errorf("invalid CONNECT target %q: %w", host, err)
+		}
+		return host, nil
+	}
+
+	if req.URL == nil || !req.URL.IsAbs() || req.URL.Host == "" {
+		return "", fmt.Errorf("request URI is not absolute: %s", req.RequestURI)
+	}
+	if req.URL.Scheme != "http" {
+		return "", fmt.Errorf("unsupported request scheme: %s", req.URL.Scheme)
+	}
+
+	host := req.URL.Hostname()
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// checkHttpProxyAuth validates the Proxy-Authorization header against user/pass.
+func checkHttpProxyAuth(req *http.Request, user string, pass string) bool {
+	if user == "" && pass == "" {
+		return true
+	}
+
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return false
+	}
+	u, pw, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	return u == user && pw == pass
+}
+
+// buildHttpProxyRequest rewrites the head of an absolute-URI proxy request
+// into the origin form expected by the target server. The body is not read,
+// it follows from the client connection as it came, so the framing headers
+// are kept. The connection is closed after one response so later requests on
+// the same client connection can be routed again.
+func buildHttpProxyRequest(req *http.Request) ([]byte, error) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Keep-Alive")
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+	req.Header.Set("Connection", "close")
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), host)
+	if len(req.TransferEncoding) > 0 {
+		fmt.Fprintf(&buf, "Transfer-Encoding: %s\r\n", strings.Join(req.TransferEncoding, ", "))
+	} else if req.ContentLength > 0 {
+		fmt.Fprintf(&buf, "Content-Length: %d\r\n", req.ContentLength)
+	}
+	if err := req.Header.Write(&buf); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes(), nil
+}
+
+func writeHttpProxyError(w io.Writer, code int, extra string) error {
+	resp := fmt.Sprintf("HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), extra)
+	_, err := w.Write([]byte(resp))
+	return err
+}
+
+func (p *Client) AcceptHttpConn(conn *net.TCPConn) {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(HTTP_PROXY_HEADER_TIMEOUT))
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		loggo.Error("error reading http proxy request: %s", err)
+		conn.Close()
+		return
+	}
+	// the body and a CONNECT tunnel are relayed without a deadline
+	conn.SetReadDeadline(time.Time{})
+
+	settings := p.settings.Load()
+	if !checkHttpProxyAuth(req, settings.HttpUser, settings.HttpPass) {
+		loggo.Info("http proxy auth fail %s", conn.RemoteAddr().String())
+		writeHttpProxyError(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"pingtunnel\"\r\n")
+		conn.Close()
+		return
+	}
+
+	targetAddr, err := httpProxyTarget(req)
+	if err != nil {
+		loggo.Info("bad http proxy request: %s", err)
+		writeHttpProxyError(conn, http.StatusBadRequest, "")
+		conn.Close()
+		return
+	}
+
+	var tunnelConn net.Conn
+	if req.Method == http.MethodConnect {
+		_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+		if err != nil {
+			loggo.Error("send connect confirmation: %s", err)
+			conn.Close()
+			return
+		}
+		loggo.Info("accept new http connect conn: %s", targetAddr)
+		tunnelConn = &prefixConn{TCPConn: conn, r: reader}
+	} else {
+		head, err := buildHttpProxyRequest(req)
+		if err != nil {
+			loggo.Info("rewrite http proxy request fail: %s", err)
+			writeHttpProxyError(conn, http.StatusBadRequest, "")
+			conn.Close()
+			return
+		}
+		loggo.Info("accept new http proxy conn: %s %s", req.Method, targetAddr)
+		tunnelConn = &prefixConn{TCPConn: conn, r: io.MultiReader(bytes.NewReader(head), reader)}
+	}
+
+	p.routeTcpConn(tunnelConn, targetAddr)
+}
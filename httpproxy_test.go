@@ -0,0 +1,240 @@
+package pingtunnel
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readTestHttpRequest(t *testing.T, raw string) *http.Request {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("ReadRequest failed: %v", err)
+	}
+	return req
+}
+
+func TestHttpProxyTargetConnect(t *testing.T) {
+	req := readTestHttpRequest(t, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	got, err := httpProxyTarget(req)
+	if err != nil {
+		t.Fatalf("httpProxyTarget failed: %v", err)
+	}
+	if got != "example.com:443" {
+		t.Fatalf("unexpected target: %s", got)
+	}
+}
+
+func TestHttpProxyTargetAbsoluteURI(t *testing.T) {
+	req := readTestHttpRequest(t, "GET http://example.com/index.html HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	got, err := httpProxyTarget(req)
+	if err != nil {
+		t.Fatalf("httpProxyTarget failed: %v", err)
+	}
+	if got != "example.com:80" {
+		t.Fatalf("unexpected target: %s", got)
+	}
+}
+
+func TestHttpProxyTargetRejectOriginForm(t *testing.T) {
+	req := readTestHttpRequest(t, "GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if _, err := httpProxyTarget(req); err == nil {
+		t.Fatal("expected error for origin-form request")
+	}
+}
+
+func TestCheckHttpProxyAuth(t *testing.T) {
+	req := readTestHttpRequest(t, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	if !checkHttpProxyAuth(req, "", "") {
+		t.Fatal("empty credentials should not require auth")
+	}
+	if checkHttpProxyAuth(req, "user", "pass") {
+		t.Fatal("missing Proxy-Authorization should fail")
+	}
+
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+	if !checkHttpProxyAuth(req, "user", "pass") {
+		t.Fatal("valid credentials should pass")
+	}
+	if checkHttpProxyAuth(req, "user", "other") {
+		t.Fatal("wrong password should fail")
+	}
+}
+
+func TestBuildHttpProxyRequest(t *testing.T) {
+	req := readTestHttpRequest(t, "GET http://example.com/a?b=1 HTTP/1.1\r\nHost: example.com\r\n"+
+		"Proxy-Authorization: Basic eDp5\r\nProxy-Connection: keep-alive\r\n\r\n")
+	out, err := buildHttpProxyRequest(req)
+	if err != nil {
+		t.Fatalf("buildHttpProxyRequest failed: %v", err)
+	}
+	s := string(out)
+	if !strings.HasPrefix(s, "GET /a?b=1 HTTP/1.1\r\n") {
+		t.Fatalf("unexpected request line: %q", s)
+	}
+	if strings.Contains(s, "Proxy-") {
+		t.Fatalf("proxy headers should be removed: %q", s)
+	}
+	if !strings.Contains(s, "Connection: close\r\n") {
+		t.Fatalf("missing Connection: close: %q", s)
+	}
+}
+
+func TestBuildHttpProxyRequestKeepsBodyFraming(t *testing.T) {
+	req := readTestHttpRequest(t, "POST http://example.com/up HTTP/1.1\r\nHost: example.com\r\n"+
+		"Transfer-Encoding: chunked\r\nExpect: 100-continue\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+	out, err := buildHttpProxyRequest(req)
+	if err != nil {
+		t.Fatalf("buildHttpProxyRequest failed: %v", err)
+	}
+	s := string(out)
+	if !strings.HasSuffix(s, "\r\n\r\n") || strings.Contains(s, "hello") {
+		t.Fatalf("only the head should be built: %q", s)
+	}
+	for _, h := range []string{"Host: example.com\r\n", "Transfer-Encoding: chunked\r\n", "Expect: 100-continue\r\n"} {
+		if !strings.Contains(s, h) {
+			t.Fatalf("missing %q: %q", h, s)
+		}
+	}
+}
+
+// startHttpProxy serves AcceptHttpConn on a local listener, every target is
+// routed direct so no tunnel is needed.
+func startHttpProxy(t *testing.T) string {
+	table, err := ParseRouteRules(strings.NewReader("FINAL,direct"))
+	if err != nil {
+		t.Fatalf("ParseRouteRules: %v", err)
+	}
+	c, err := NewClient("", "127.0.0.1", "", 60, 0, "",
+		1, 0, 0, 0, 0,
+		0, 0, 0, nil, nil, "", "", nil,
+		1, "", "", "", nil,
+		nil, table, 0, 0, nil,
+		0, 0, 0)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go c.AcceptHttpConn(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestAcceptHttpConn(t *testing.T) {
+	t.Chdir(t.TempDir())
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+	}))
+	defer origin.Close()
+	proxy := startHttpProxy(t)
+
+	t.Run("get", func(t *testing.T) {
+		client := &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxy})},
+		}
+		resp, err := client.Get(origin.URL + "/a")
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "GET /a " {
+			t.Fatalf("unexpected response %q", body)
+		}
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		// the body must not be read before the origin asks for it
+		client := &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyURL(&url.URL{Scheme: "http", Host: proxy}),
+				ExpectContinueTimeout: time.Minute,
+			},
+		}
+		data := strings.Repeat("x", 1<<20)
+		req, _ := http.NewRequest(http.MethodPost, origin.URL+"/up", strings.NewReader(data))
+		req.Header.Set("Expect", "100-continue")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "POST /up "+data {
+			t.Fatalf("unexpected response of %d bytes", len(body))
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", proxy)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		host := strings.TrimPrefix(origin.URL, "http://")
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("connect: %v %v", resp, err)
+		}
+
+		fmt.Fprintf(conn, "GET /b HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host)
+		resp, err = http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "GET /b " {
+			t.Fatalf("unexpected response %q", body)
+		}
+	})
+}
+
+func TestAcceptHttpConnHeaderTimeout(t *testing.T) {
+	t.Chdir(t.TempDir())
+	proxy := startHttpProxy(t)
+
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// a header that never ends is dropped
+	fmt.Fprintf(conn, "GET http://example.com/ HTTP/1.1\r\n")
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(HTTP_PROXY_HEADER_TIMEOUT + 5*time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read = %v, want the proxy to close the connection", err)
+	}
+	if d := time.Since(start); d < HTTP_PROXY_HEADER_TIMEOUT-time.Second {
+		t.Errorf("closed after %s, before the header timeout", d)
+	}
+}
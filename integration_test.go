@@ -0,0 +1,423 @@
+package pingtunnel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The integration tests run a server and a client in this process, talking
+// raw ICMP over loopback, and are meant to be run with -race as well. They are
+// skipped without the privilege to open a raw socket.
+
+type tunnelOptions struct {
+	tcpmode       int
+	crypto        *CryptoConfig
+	processthread int
+	decryptthread int
+	reverse       []*ReverseConfig
+}
+
+func startTunnel(t *testing.T, o tunnelOptions, target string) (*Server, *Client, string) {
+	t.Helper()
+
+	reverseallow := 0
+	if len(o.reverse) > 0 {
+		reverseallow = 1
+	}
+	s, err := NewServer("127.0.0.1", 123456, 0, o.processthread, 1000, 1000, o.crypto, nil,
+		reverseallow, 0, nil, "", nil, nil, nil, o.decryptthread)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if err := s.Run(); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			t.Skipf("no raw icmp socket: %v", err)
+		}
+		t.Fatalf("Server.Run: %v", err)
+	}
+
+	c, err := startClient(o, target)
+	if err != nil {
+		s.Stop()
+		t.Fatal(err)
+	}
+
+	if o.tcpmode > 0 {
+		return s, c, c.tcplistenConn.Addr().String()
+	}
+	return s, c, c.listenConn.LocalAddr().String()
+}
+
+func startClient(o tunnelOptions, target string) (*Client, error) {
+	// a small window, on loopback the client also reads its own requests and
+	// the kernel's replies, which overflow the socket with large bursts
+	c, err := NewClient("127.0.0.1:0", "127.0.0.1", target, 60, 123456, "127.0.0.1",
+		o.tcpmode, 1024*1024, 16, 400, 0,
+		0, 0, 0, nil, o.crypto, "", "", o.reverse,
+		0, "", "", "", nil,
+		nil, nil, 0, 0, nil,
+		o.processthread, 1000, o.decryptthread)
+	if err != nil {
+		return nil, fmt.Errorf("NewClient: %v", err)
+	}
+	if err := c.Run(); err != nil {
+		return nil, fmt.Errorf("Client.Run: %v", err)
+	}
+	return c, nil
+}
+
+// stopTunnel fails the test when a Stop does not return, e.g. because a
+// session loop missed the cancellation.
+func stopTunnel(t *testing.T, stop ...func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		for _, f := range stop {
+			f()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("tunnel did not stop")
+	}
+}
+
+func startEchoTCP(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func startEchoUDP(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, UDP_FRAG_MAX_DATAGRAM)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], src)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func echoTCP(addr string, size int, seed int64) error {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	go c.Write(data)
+
+	got := make([]byte, size)
+	if _, err := io.ReadFull(c, got); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return errors.New("echo does not match")
+	}
+	return nil
+}
+
+func TestTunnelTCP(t *testing.T) {
+	t.Chdir(t.TempDir())
+	crypto, err := NewCryptoConfig(AES256, "integration")
+	if err != nil {
+		t.Fatalf("NewCryptoConfig: %v", err)
+	}
+	tests := []struct {
+		name string
+		opt  tunnelOptions
+	}{
+		{"plain", tunnelOptions{tcpmode: 1}},
+		{"threads", tunnelOptions{tcpmode: 1, crypto: crypto, processthread: 4, decryptthread: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, c, addr := startTunnel(t, tt.opt, startEchoTCP(t))
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 4)
+			for i := 0; i < cap(errs); i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if err := echoTCP(addr, 64*1024, int64(i)); err != nil {
+						errs <- fmt.Errorf("session %d: %v", i, err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+
+			stopTunnel(t, c.Stop, s.Stop)
+		})
+	}
+}
+
+func TestTunnelUDP(t *testing.T) {
+	t.Chdir(t.TempDir())
+	s, c, addr := startTunnel(t, tunnelOptions{}, startEchoUDP(t))
+	defer stopTunnel(t, c.Stop, s.Stop)
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// the larger datagrams are sent in fragments
+	want := make(map[string]bool)
+	for i, size := range []int{1, 100, UDP_FRAG_SIZE, UDP_FRAG_SIZE + 1, 3 * UDP_FRAG_SIZE, 10000} {
+		data := bytes.Repeat([]byte{byte('a' + i)}, size)
+		want[string(data)] = true
+		if _, err := conn.Write(data); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	// the kernel answers the echo requests on loopback as well, so the server
+	// may pass a datagram on twice
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, UDP_FRAG_MAX_DATAGRAM)
+	for len(want) > 0 {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("%d datagrams not echoed: %v", len(want), err)
+		}
+		delete(want, string(buf[:n]))
+	}
+}
+
+func TestTunnelShutdown(t *testing.T) {
+	t.Chdir(t.TempDir())
+	s, c, addr := startTunnel(t, tunnelOptions{tcpmode: 1}, startEchoTCP(t))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	var stats ShutdownStats
+	stopTunnel(t, func() { stats = c.Shutdown(5 * time.Second) }, s.Stop)
+	if stats.Sessions != 1 || stats.Remaining != 0 {
+		t.Errorf("client shutdown %s, want 1 session drained", stats)
+	}
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("local conn not closed after the shutdown: %v", err)
+	}
+}
+
+func freeTCPAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitReverseRegistered(c *Client, r *ReverseConfig, wait time.Duration) bool {
+	deadline := time.Now().Add(wait)
+	for time.Now().Before(deadline) {
+		if _, ok := c.reverseRegistered.Load(r.Id()); ok {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func TestTunnelReverse(t *testing.T) {
+	t.Chdir(t.TempDir())
+	reverse, err := ParseReverseSpec("tcp/" + freeTCPAddr(t) + "/" + startEchoTCP(t))
+	if err != nil {
+		t.Fatalf("ParseReverseSpec: %v", err)
+	}
+	r := reverse[0]
+
+	o := tunnelOptions{tcpmode: 1, reverse: reverse}
+	s, c, _ := startTunnel(t, o, startEchoTCP(t))
+	defer stopTunnel(t, c.Stop, s.Stop)
+
+	if !waitReverseRegistered(c, r, 5*time.Second) {
+		t.Fatalf("reverse %s not registered", r.Id())
+	}
+	for i := 0; i < 2; i++ {
+		if err := echoTCP(r.ListenAddr, 16*1024, int64(i)); err != nil {
+			t.Fatalf("reverse session %d: %v", i, err)
+		}
+	}
+
+	// another client may not take the listener over while it is in use
+	other, err := startClient(o, startEchoTCP(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopTunnel(t, other.Stop)
+	if waitReverseRegistered(other, r, 3*time.Second) {
+		t.Errorf("second client took over reverse %s", r.Id())
+	}
+	if err := echoTCP(r.ListenAddr, 1024, 2); err != nil {
+		t.Errorf("reverse session after the second registration: %v", err)
+	}
+
+	// late frames of the closed sessions must not dial the target again
+	deadline := time.Now().Add(5 * time.Second)
+	for c.activeConnCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := c.activeConnCount(); n != 0 {
+		t.Errorf("%d reverse sessions left after close", n)
+	}
+}
+
+func TestTunnelReload(t *testing.T) {
+	t.Chdir(t.TempDir())
+	s, c, addr := startTunnel(t, tunnelOptions{tcpmode: 1, processthread: 4}, startEchoTCP(t))
+	defer stopTunnel(t, c.Stop, s.Stop)
+
+	serverSettings := func(key int, acceptKeys ...int) *ServerSettings {
+		return &ServerSettings{Key: key, AcceptKeys: acceptKeys, ConnectTimeout: 1000}
+	}
+	clientSettings := func(key int) *ClientSettings {
+		return &ClientSettings{Key: key, Timeout: 60}
+	}
+
+	// sessions keep going while the settings are swapped under them
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := echoTCP(addr, 64*1024, int64(i)); err != nil {
+				errs <- fmt.Errorf("session %d: %v", i, err)
+			}
+		}(i)
+	}
+	for i := 0; i < 50; i++ {
+		s.Reload(serverSettings(123456))
+		c.Reload(clientSettings(123456))
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// a rotated key applies to the next session and to the open one
+	live, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer live.Close()
+	roundTrip := func(step string) {
+		t.Helper()
+		live.SetDeadline(time.Now().Add(10 * time.Second))
+		data := []byte(step)
+		if _, err := live.Write(data); err != nil {
+			t.Fatalf("open session %s: %v", step, err)
+		}
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(live, got); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("open session %s: %q %v", step, got, err)
+		}
+	}
+	roundTrip("before the rotation")
+
+	s.Reload(serverSettings(123456, 654321))
+	c.Reload(clientSettings(654321))
+	roundTrip("with the new key")
+	if err := echoTCP(addr, 1024, 2); err != nil {
+		t.Errorf("session with the new key: %v", err)
+	}
+	s.Reload(serverSettings(654321))
+	roundTrip("after the old key was dropped")
+	if err := echoTCP(addr, 1024, 3); err != nil {
+		t.Errorf("session after the old key was dropped: %v", err)
+	}
+}
+
+func TestTunnelBindDenied(t *testing.T) {
+	t.Chdir(t.TempDir())
+	s, c, _ := startTunnel(t, tunnelOptions{tcpmode: 1}, startEchoTCP(t))
+	defer stopTunnel(t, c.Stop, s.Stop)
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			return
+		}
+		c.AcceptSock5BindConn(conn, "127.0.0.1:0", nil)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	// a denied BIND fails at once instead of retrying until it gives up
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if rep, _ := readTestSocks5Reply(t, conn); rep != socks5ReplyGeneralFailure {
+		t.Fatalf("bind reply %d without -bind_allow, want %d", rep, socks5ReplyGeneralFailure)
+	}
+	<-done
+}
@@ -0,0 +1,197 @@
+package pingtunnel
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"strconv"
+	"strings"
+)
+
+const (
+	KDF_PBKDF2   = "pbkdf2"
+	KDF_ARGON2ID = "argon2id"
+	KDF_SCRYPT   = "scrypt"
+
+	KDF_SALT_SIZE     = 16
+	KDF_SALT_MIN_SIZE = 8
+
+	// argon2id defaults follow RFC 9106, 64MiB of memory
+	KDF_ARGON2ID_TIME    = 3
+	KDF_ARGON2ID_MEMORY  = 64 * 1024 // KiB
+	KDF_ARGON2ID_THREADS = 4
+
+	KDF_SCRYPT_N = 32768
+	KDF_SCRYPT_R = 8
+	KDF_SCRYPT_P = 1
+
+	// the salt and iterations used before the kdf was configurable
+	KDF_PBKDF2_SALT       = "pingtunnel-salt"
+	KDF_PBKDF2_ITERATIONS = 10000
+)
+
+// KdfConfig derives encryption keys from passphrases. Both sides must use the
+// same spec, the salt is not secret but should differ per deployment.
+type KdfConfig struct {
+	Name string
+	Salt []byte
+
+	Iterations int // pbkdf2
+
+	Time    uint32 // argon2id
+	Memory  uint32 // argon2id, KiB
+	Threads uint8  // argon2id
+
+	N int // scrypt
+	R int // scrypt
+	P int // scrypt
+}
+
+// ParseKdfSpec parses NAME[:param=value,...], e.g.
+// argon2id:t=3,m=65536,p=4,salt=BASE64 or scrypt:n=32768,r=8,p=1,salt=BASE64.
+// An empty spec is pbkdf2 with the old constant salt, argon2id and scrypt
+// need a salt.
+func ParseKdfSpec(spec string) (*KdfConfig, error) {
+	name, params, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	var k *KdfConfig
+	switch name {
+	case "", KDF_PBKDF2:
+		k = &KdfConfig{Name: KDF_PBKDF2, Salt: []byte(KDF_PBKDF2_SALT), Iterations: KDF_PBKDF2_ITERATIONS}
+	case KDF_ARGON2ID:
+		k = &KdfConfig{Name: KDF_ARGON2ID, Time: KDF_ARGON2ID_TIME, Memory: KDF_ARGON2ID_MEMORY, Threads: KDF_ARGON2ID_THREADS}
+	case KDF_SCRYPT:
+		k = &KdfConfig{Name: KDF_SCRYPT, N: KDF_SCRYPT_N, R: KDF_SCRYPT_R, P: KDF_SCRYPT_P}
+	default:
+		return nil, fmt.Errorf("unknown kdf %q, use pbkdf2, argon2id or scrypt", name)
+	}
+
+	if params != "" {
+		for _, param := range strings.Split(params, ",") {
+			key, value, ok := strings.Cut(param, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid kdf param %q, want name=value", param)
+			}
+			if err := k.set(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := k.check(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *KdfConfig) set(key string, value string) error {
+	if key == "salt" {
+		salt, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("invalid kdf salt: %v", err)
+		}
+		k.Salt = salt
+		return nil
+	}
+
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid kdf param %s=%q", key, value)
+	}
+	switch {
+	case k.Name == KDF_PBKDF2 && key == "i":
+		k.Iterations = int(n)
+	case k.Name == KDF_ARGON2ID && key == "t":
+		k.Time = uint32(n)
+	case k.Name == KDF_ARGON2ID && key == "m":
+		k.Memory = uint32(n)
+	case k.Name == KDF_ARGON2ID && key == "p":
+		if n > 255 {
+			return fmt.Errorf("invalid kdf param %s=%q, at most 255 threads", key, value)
+		}
+		k.Threads = uint8(n)
+	case k.Name == KDF_SCRYPT && key == "n":
+		k.N = int(n)
+	case k.Name == KDF_SCRYPT && key == "r":
+		k.R = int(n)
+	case k.Name == KDF_SCRYPT && key == "p":
+		k.P = int(n)
+	default:
+		return fmt.Errorf("unknown %s param %q", k.Name, key)
+	}
+	return nil
+}
+
+func (k *KdfConfig) check() error {
+	switch k.Name {
+	case KDF_PBKDF2:
+		if k.Iterations < 1 {
+			return errors.New("pbkdf2 needs at least 1 iteration")
+		}
+		return nil
+	case KDF_ARGON2ID:
+		if k.Time < 1 || k.Threads < 1 || k.Memory < 8*uint32(k.Threads) {
+			return errors.New("argon2id needs t >= 1, p >= 1 and m >= 8*p KiB")
+		}
+	case KDF_SCRYPT:
+		if k.N <= 1 || k.N&(k.N-1) != 0 || k.R < 1 || k.P < 1 || k.R*k.P >= 1<<30 {
+			return errors.New("scrypt needs n a power of 2 above 1, r >= 1, p >= 1 and r*p < 2^30")
+		}
+	}
+	if len(k.Salt) < KDF_SALT_MIN_SIZE {
+		return fmt.Errorf("%s needs a salt of at least %d bytes, generate one with pingtunnel genkey -kdf %s", k.Name, KDF_SALT_MIN_SIZE, k.Name)
+	}
+	return nil
+}
+
+// String returns the spec ParseKdfSpec reads back.
+func (k *KdfConfig) String() string {
+	salt := base64.StdEncoding.EncodeToString(k.Salt)
+	switch k.Name {
+	case KDF_ARGON2ID:
+		return fmt.Sprintf("%s:t=%d,m=%d,p=%d,salt=%s", k.Name, k.Time, k.Memory, k.Threads, salt)
+	case KDF_SCRYPT:
+		return fmt.Sprintf("%s:n=%d,r=%d,p=%d,salt=%s", k.Name, k.N, k.R, k.P, salt)
+	default:
+		return fmt.Sprintf("%s:i=%d,salt=%s", k.Name, k.Iterations, salt)
+	}
+}
+
+// Derive stretches a passphrase into a key of keySize bytes.
+func (k *KdfConfig) Derive(passphrase string, keySize int) ([]byte, error) {
+	switch k.Name {
+	case KDF_ARGON2ID:
+		return argon2.IDKey([]byte(passphrase), k.Salt, k.Time, k.Memory, k.Threads, uint32(keySize)), nil
+	case KDF_SCRYPT:
+		return scrypt.Key([]byte(passphrase), k.Salt, k.N, k.R, k.P, keySize)
+	default:
+		return pbkdf2.Key([]byte(passphrase), k.Salt, k.Iterations, keySize, sha256.New), nil
+	}
+}
+
+// NewKdfSpec returns the default spec of a kdf with a fresh random salt.
+func NewKdfSpec(name string) (*KdfConfig, error) {
+	salt := make([]byte, KDF_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	return ParseKdfSpec(name + ":salt=" + base64.StdEncoding.EncodeToString(salt))
+}
+
+// GenerateKey returns a random base64 key of the size mode uses, which is
+// taken as is instead of going through the kdf.
+func GenerateKey(mode EncryptionMode) (string, error) {
+	keySize, err := keySizeOf(mode)
+	if err != nil {
+		return "", err
+	}
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
@@ -0,0 +1,144 @@
+package pingtunnel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"golang.org/x/crypto/pbkdf2"
+	"testing"
+)
+
+func TestParseKdfSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"", "pbkdf2:i=10000,salt=cGluZ3R1bm5lbC1zYWx0"},
+		{"pbkdf2:i=600000,salt=c2FsdHNhbHQ=", "pbkdf2:i=600000,salt=c2FsdHNhbHQ="},
+		{"argon2id:salt=c2FsdHNhbHQ=", "argon2id:t=3,m=65536,p=4,salt=c2FsdHNhbHQ="},
+		{"argon2id:t=1, m=1024, p=2, salt=c2FsdHNhbHQ=", "argon2id:t=1,m=1024,p=2,salt=c2FsdHNhbHQ="},
+		{"scrypt:salt=c2FsdHNhbHQ=", "scrypt:n=32768,r=8,p=1,salt=c2FsdHNhbHQ="},
+		{"scrypt:n=1024,r=4,p=2,salt=c2FsdHNhbHQ=", "scrypt:n=1024,r=4,p=2,salt=c2FsdHNhbHQ="},
+	}
+	for _, tt := range tests {
+		k, err := ParseKdfSpec(tt.spec)
+		if err != nil {
+			t.Errorf("ParseKdfSpec(%q) unexpected error: %v", tt.spec, err)
+			continue
+		}
+		if got := k.String(); got != tt.want {
+			t.Errorf("ParseKdfSpec(%q) = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+
+	invalid := []string{
+		"bcrypt",
+		"argon2id",
+		"scrypt",
+		"argon2id:salt=c2FsdA==",
+		"argon2id:salt=not base64",
+		"argon2id:t=0,salt=c2FsdHNhbHQ=",
+		"argon2id:p=256,salt=c2FsdHNhbHQ=",
+		"argon2id:m=8,p=2,salt=c2FsdHNhbHQ=",
+		"argon2id:n=1024,salt=c2FsdHNhbHQ=",
+		"scrypt:n=1000,salt=c2FsdHNhbHQ=",
+		"scrypt:r=0,salt=c2FsdHNhbHQ=",
+		"scrypt:n,salt=c2FsdHNhbHQ=",
+		"pbkdf2:i=0",
+		"pbkdf2:i=-1",
+	}
+	for _, spec := range invalid {
+		if _, err := ParseKdfSpec(spec); err == nil {
+			t.Errorf("ParseKdfSpec(%q) expected error, got none", spec)
+		}
+	}
+}
+
+func TestKdfDerive(t *testing.T) {
+	// the default stays compatible with keys derived before the kdf was
+	// configurable
+	key, err := deriveKeyKdf("my-secret-passphrase", 32, nil)
+	if err != nil {
+		t.Fatalf("deriveKeyKdf failed: %v", err)
+	}
+	want := pbkdf2.Key([]byte("my-secret-passphrase"), []byte("pingtunnel-salt"), 10000, 32, sha256.New)
+	if !bytes.Equal(key, want) {
+		t.Fatal("default kdf does not match the old pbkdf2 derivation")
+	}
+
+	for _, spec := range []string{"argon2id:t=1,m=64,p=1,salt=c2FsdHNhbHQ=", "scrypt:n=1024,r=8,p=1,salt=c2FsdHNhbHQ="} {
+		kdf, err := ParseKdfSpec(spec)
+		if err != nil {
+			t.Fatalf("ParseKdfSpec(%q) unexpected error: %v", spec, err)
+		}
+		key1, err := deriveKeyKdf("my-secret-passphrase", 16, kdf)
+		if err != nil {
+			t.Fatalf("deriveKeyKdf(%q) failed: %v", spec, err)
+		}
+		key2, err := deriveKeyKdf("my-secret-passphrase", 16, kdf)
+		if err != nil {
+			t.Fatalf("deriveKeyKdf(%q) failed: %v", spec, err)
+		}
+		if len(key1) != 16 || !bytes.Equal(key1, key2) {
+			t.Errorf("deriveKeyKdf(%q) is not a deterministic 16 byte key", spec)
+		}
+
+		// another salt gives another key
+		other := *kdf
+		other.Salt = []byte("othersalt")
+		key3, err := deriveKeyKdf("my-secret-passphrase", 16, &other)
+		if err != nil {
+			t.Fatalf("deriveKeyKdf(%q) failed: %v", spec, err)
+		}
+		if bytes.Equal(key1, key3) {
+			t.Errorf("deriveKeyKdf(%q) ignores the salt", spec)
+		}
+
+		// base64 keys of the right size skip the kdf
+		raw := bytes.Repeat([]byte{7}, 16)
+		key4, err := deriveKeyKdf(base64.StdEncoding.EncodeToString(raw), 16, kdf)
+		if err != nil {
+			t.Fatalf("deriveKeyKdf(%q) failed: %v", spec, err)
+		}
+		if !bytes.Equal(key4, raw) {
+			t.Errorf("deriveKeyKdf(%q) changed a base64 key", spec)
+		}
+	}
+}
+
+func TestNewKdfSpec(t *testing.T) {
+	k1, err := NewKdfSpec(KDF_ARGON2ID)
+	if err != nil {
+		t.Fatalf("NewKdfSpec failed: %v", err)
+	}
+	k2, err := NewKdfSpec(KDF_ARGON2ID)
+	if err != nil {
+		t.Fatalf("NewKdfSpec failed: %v", err)
+	}
+	if len(k1.Salt) != KDF_SALT_SIZE || bytes.Equal(k1.Salt, k2.Salt) {
+		t.Errorf("NewKdfSpec salts %x and %x, want two random %d byte salts", k1.Salt, k2.Salt, KDF_SALT_SIZE)
+	}
+	if k, err := ParseKdfSpec(k1.String()); err != nil || k.String() != k1.String() {
+		t.Errorf("ParseKdfSpec(%q) does not read back the spec: %v", k1.String(), err)
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	for _, mode := range []EncryptionMode{AES128, AES256, CHACHA20} {
+		key, err := GenerateKey(mode)
+		if err != nil {
+			t.Fatalf("GenerateKey(%s) failed: %v", mode, err)
+		}
+		size, _ := keySizeOf(mode)
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(decoded) != size {
+			t.Errorf("GenerateKey(%s) = %q, want base64 of %d bytes", mode, key, size)
+		}
+		if _, err := NewCryptoConfig(mode, key); err != nil {
+			t.Errorf("NewCryptoConfig(%s, GenerateKey) failed: %v", mode, err)
+		}
+	}
+	if _, err := GenerateKey(NoEncryption); err == nil {
+		t.Errorf("GenerateKey(none) expected error, got none")
+	}
+}
@@ -0,0 +1,94 @@
+package pingtunnel
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// KICK messages carry the reason in the first byte of Data. Older peers send
+// an empty Data, which reads as KICK_REASON_NONE.
+const (
+	KICK_REASON_NONE = iota
+	KICK_REASON_REFUSED
+	KICK_REASON_UNREACHABLE
+	KICK_REASON_DNS
+	KICK_REASON_DENIED
+	KICK_REASON_TOO_MANY
+	KICK_REASON_TIMEOUT
+	KICK_REASON_SHUTDOWN
+)
+
+func kickReasonString(reason int) string {
+	switch reason {
+	case KICK_REASON_REFUSED:
+		return "connection refused"
+	case KICK_REASON_UNREACHABLE:
+		return "host unreachable"
+	case KICK_REASON_DNS:
+		return "dns failure"
+	case KICK_REASON_DENIED:
+		return "denied"
+	case KICK_REASON_TOO_MANY:
+		return "too many connections"
+	case KICK_REASON_TIMEOUT:
+		return "timeout"
+	case KICK_REASON_SHUTDOWN:
+		return "shutting down"
+	}
+	return "general failure"
+}
+
+func kickReasonData(reason int) []byte {
+	if reason == KICK_REASON_NONE {
+		return []byte{}
+	}
+	return []byte{byte(reason)}
+}
+
+func parseKickReason(data []byte) int {
+	if len(data) == 0 {
+		return KICK_REASON_NONE
+	}
+	return int(data[0])
+}
+
+// dialErrorReason classifies the error of a failed dial.
+func dialErrorReason(err error) int {
+	if err == nil {
+		return KICK_REASON_NONE
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return KICK_REASON_DNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return KICK_REASON_REFUSED
+	}
+	if errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return KICK_REASON_UNREACHABLE
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return KICK_REASON_TIMEOUT
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return KICK_REASON_TIMEOUT
+	}
+	return KICK_REASON_NONE
+}
+
+func kickReasonSocks5Reply(reason int) byte {
+	switch reason {
+	case KICK_REASON_REFUSED:
+		return socks5ReplyConnectionRefused
+	case KICK_REASON_UNREACHABLE, KICK_REASON_DNS:
+		return socks5ReplyHostUnreachable
+	case KICK_REASON_DENIED:
+		return socks5ReplyConnectionNotAllowed
+	case KICK_REASON_TIMEOUT:
+		return socks5ReplyTTLExpired
+	}
+	return socks5ReplyGeneralFailure
+}
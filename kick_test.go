@@ -0,0 +1,103 @@
+package pingtunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKickReasonData(t *testing.T) {
+	for reason := KICK_REASON_NONE; reason <= KICK_REASON_SHUTDOWN; reason++ {
+		if got := parseKickReason(kickReasonData(reason)); got != reason {
+			t.Errorf("parseKickReason(kickReasonData(%d)) = %d", reason, got)
+		}
+	}
+	if got := parseKickReason(nil); got != KICK_REASON_NONE {
+		t.Errorf("parseKickReason(nil) = %d, want %d", got, KICK_REASON_NONE)
+	}
+}
+
+func TestDialErrorReason(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, KICK_REASON_NONE},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, KICK_REASON_REFUSED},
+		{"host unreachable", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, KICK_REASON_UNREACHABLE},
+		{"network unreachable", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, KICK_REASON_UNREACHABLE},
+		{"dns", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}}, KICK_REASON_DNS},
+		{"timeout", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, KICK_REASON_TIMEOUT},
+		{"wrapped", fmt.Errorf("proxy: %w", os.NewSyscallError("connect", syscall.ECONNREFUSED)), KICK_REASON_REFUSED},
+		{"other", errors.New("boom"), KICK_REASON_NONE},
+	}
+
+	for _, tt := range tests {
+		if got := dialErrorReason(tt.err); got != tt.want {
+			t.Errorf("dialErrorReason(%s) = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKickReasonSocks5Reply(t *testing.T) {
+	tests := []struct {
+		reason int
+		want   byte
+	}{
+		{KICK_REASON_NONE, socks5ReplyGeneralFailure},
+		{KICK_REASON_REFUSED, socks5ReplyConnectionRefused},
+		{KICK_REASON_UNREACHABLE, socks5ReplyHostUnreachable},
+		{KICK_REASON_DNS, socks5ReplyHostUnreachable},
+		{KICK_REASON_DENIED, socks5ReplyConnectionNotAllowed},
+		{KICK_REASON_TOO_MANY, socks5ReplyGeneralFailure},
+		{KICK_REASON_TIMEOUT, socks5ReplyTTLExpired},
+		{KICK_REASON_SHUTDOWN, socks5ReplyGeneralFailure},
+	}
+
+	for _, tt := range tests {
+		if got := kickReasonSocks5Reply(tt.reason); got != tt.want {
+			t.Errorf("kickReasonSocks5Reply(%s) = %#x, want %#x", kickReasonString(tt.reason), got, tt.want)
+		}
+	}
+}
+
+func TestKickAfterData(t *testing.T) {
+	t.Chdir(t.TempDir())
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer target.Close()
+
+	s, err := NewServer("", 0, 0, 4, 1000, 1000, nil, nil, 0, 0, nil, "", nil, nil, nil, 0)
+	if err != nil {
+		t.Fatalf("NewServer unexpected error: %v", err)
+	}
+	c, err := net.DialUDP("udp", nil, target.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	conn := &ServerConn{conn: c, id: "kick", udpTargetAddr: target.LocalAddr().String()}
+	src := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	s.addServerConn(conn.id, conn, serverPeer{src: src})
+
+	// the KICK is handled behind the datagrams sent before it
+	const count = 200
+	for i := 0; i < count; i++ {
+		s.processPacket(&Packet{my: &MyMsg{Id: conn.id, Type: (int32)(MyMsg_DATA), Data: []byte(fmt.Sprint(i))}, src: src})
+	}
+	s.processPacket(&Packet{my: &MyMsg{Id: conn.id, Type: (int32)(MyMsg_KICK)}, src: src})
+
+	buf := make([]byte, 64)
+	for i := 0; i < count; i++ {
+		target.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := target.ReadFromUDP(buf); err != nil {
+			t.Fatalf("%d of %d datagrams before the KICK arrived: %v", i, count, err)
+		}
+	}
+}
@@ -24,10 +24,14 @@ const (
 type MyMsg_TYPE int32
 
 const (
-	MyMsg_DATA  MyMsg_TYPE = 0
-	MyMsg_PING  MyMsg_TYPE = 1
-	MyMsg_KICK  MyMsg_TYPE = 2
-	MyMsg_MAGIC MyMsg_TYPE = 57005
+	MyMsg_DATA    MyMsg_TYPE = 0
+	MyMsg_PING    MyMsg_TYPE = 1
+	MyMsg_KICK    MyMsg_TYPE = 2
+	MyMsg_REVERSE MyMsg_TYPE = 3
+	MyMsg_TUN     MyMsg_TYPE = 4
+	MyMsg_DNS     MyMsg_TYPE = 5
+	MyMsg_BIND    MyMsg_TYPE = 6
+	MyMsg_MAGIC   MyMsg_TYPE = 57005
 )
 
 // Enum value maps for MyMsg_TYPE.
@@ -36,13 +40,21 @@ var (
 		0:     "DATA",
 		1:     "PING",
 		2:     "KICK",
+		3:     "REVERSE",
+		4:     "TUN",
+		5:     "DNS",
+		6:     "BIND",
 		57005: "MAGIC",
 	}
 	MyMsg_TYPE_value = map[string]int32{
-		"DATA":  0,
-		"PING":  1,
-		"KICK":  2,
-		"MAGIC": 57005,
+		"DATA":    0,
+		"PING":    1,
+		"KICK":    2,
+		"REVERSE": 3,
+		"TUN":     4,
+		"DNS":     5,
+		"BIND":    6,
+		"MAGIC":   57005,
 	}
 )
 
@@ -89,6 +101,10 @@ type MyMsg struct {
 	TcpmodeResendTimems int32                  `protobuf:"varint,12,opt,name=tcpmode_resend_timems,json=tcpmodeResendTimems,proto3" json:"tcpmode_resend_timems,omitempty"`
 	TcpmodeCompress     int32                  `protobuf:"varint,13,opt,name=tcpmode_compress,json=tcpmodeCompress,proto3" json:"tcpmode_compress,omitempty"`
 	TcpmodeStat         int32                  `protobuf:"varint,14,opt,name=tcpmode_stat,json=tcpmodeStat,proto3" json:"tcpmode_stat,omitempty"`
+	Udpmode             int32                  `protobuf:"varint,15,opt,name=udpmode,proto3" json:"udpmode,omitempty"`
+	FragId              uint32                 `protobuf:"varint,16,opt,name=frag_id,json=fragId,proto3" json:"frag_id,omitempty"`
+	FragIndex           int32                  `protobuf:"varint,17,opt,name=frag_index,json=fragIndex,proto3" json:"frag_index,omitempty"`
+	FragCount           int32                  `protobuf:"varint,18,opt,name=frag_count,json=fragCount,proto3" json:"frag_count,omitempty"`
 	unknownFields       protoimpl.UnknownFields
 	sizeCache           protoimpl.SizeCache
 }
@@ -221,11 +237,39 @@ func (x *MyMsg) GetTcpmodeStat() int32 {
 	return 0
 }
 
+func (x *MyMsg) GetUdpmode() int32 {
+	if x != nil {
+		return x.Udpmode
+	}
+	return 0
+}
+
+func (x *MyMsg) GetFragId() uint32 {
+	if x != nil {
+		return x.FragId
+	}
+	return 0
+}
+
+func (x *MyMsg) GetFragIndex() int32 {
+	if x != nil {
+		return x.FragIndex
+	}
+	return 0
+}
+
+func (x *MyMsg) GetFragCount() int32 {
+	if x != nil {
+		return x.FragCount
+	}
+	return 0
+}
+
 var File_msg_proto protoreflect.FileDescriptor
 
 const file_msg_proto_rawDesc = "" +
 	"\n" +
-	"\tmsg.proto\"\xd6\x03\n" +
+	"\tmsg.proto\"\xf0\x04\n" +
 	"\x05MyMsg\x12\x0e\n" +
 	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
 	"\x04type\x18\x02 \x01(\x05R\x04type\x12\x16\n" +
@@ -241,11 +285,21 @@ const file_msg_proto_rawDesc = "" +
 	"\x0etcpmode_maxwin\x18\v \x01(\x05R\rtcpmodeMaxwin\x122\n" +
 	"\x15tcpmode_resend_timems\x18\f \x01(\x05R\x13tcpmodeResendTimems\x12)\n" +
 	"\x10tcpmode_compress\x18\r \x01(\x05R\x0ftcpmodeCompress\x12!\n" +
-	"\ftcpmode_stat\x18\x0e \x01(\x05R\vtcpmodeStat\"1\n" +
+	"\ftcpmode_stat\x18\x0e \x01(\x05R\vtcpmodeStat\x12\x18\n" +
+	"\audpmode\x18\x0f \x01(\x05R\audpmode\x12\x17\n" +
+	"\afrag_id\x18\x10 \x01(\rR\x06fragId\x12\x1d\n" +
+	"\n" +
+	"frag_index\x18\x11 \x01(\x05R\tfragIndex\x12\x1d\n" +
+	"\n" +
+	"frag_count\x18\x12 \x01(\x05R\tfragCount\"Z\n" +
 	"\x04TYPE\x12\b\n" +
 	"\x04DATA\x10\x00\x12\b\n" +
 	"\x04PING\x10\x01\x12\b\n" +
 	"\x04KICK\x10\x02\x12\v\n" +
+	"\aREVERSE\x10\x03\x12\a\n" +
+	"\x03TUN\x10\x04\x12\a\n" +
+	"\x03DNS\x10\x05\x12\b\n" +
+	"\x04BIND\x10\x06\x12\v\n" +
 	"\x05MAGIC\x10\xad\xbd\x03B\x0eZ\f./pingtunnelb\x06proto3"
 
 var (
@@ -1,7 +1,10 @@
 package pingtunnel
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -9,123 +12,350 @@ import (
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/loggo"
 	"golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
 	"google.golang.org/protobuf/proto"
 )
 
+// The send path reuses its messages and wire buffers: a packet is marshalled
+// once into a pooled buffer behind room for the echo header and the nonce,
+// and sealed in place, so sending allocates nothing at a steady rate.
+const (
+	ICMP_ECHO_HEADER_SIZE = 8
+	SEND_BUFFER_SIZE      = 2048
+	SEND_BUFFER_MAX_SIZE  = 64 * 1024 // larger buffers are not kept
+)
+
+const (
+	RECV_BUFFER_SIZE = 10240
+	// packets each decrypt worker may hold, read ahead of the one being passed on
+	RECV_DECRYPT_QUEUE = 16
+)
+
+// A peer with another key, kdf or salt only shows up as packets that fail to
+// decrypt, logged at debug level. DECRYPT_FAIL_HINT failures within
+// DECRYPT_FAIL_HINT_WINDOW log a warning once per window.
+const (
+	DECRYPT_FAIL_HINT        = 10
+	DECRYPT_FAIL_HINT_WINDOW = time.Minute
+)
+
+var errDecrypt = errors.New("decrypt error")
+
+var sendMsgPool = sync.Pool{
+	New: func() interface{} {
+		return &MyMsg{}
+	},
+}
+
+var sendBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, SEND_BUFFER_SIZE)
+		return &b
+	},
+}
+
 func sendICMP(id int, sequence int, conn icmp.PacketConn, server *net.IPAddr, target string,
 	connId string, msgType uint32, data []byte, sproto int, rproto int, key int,
 	tcpmode int, tcpmode_buffer_size int, tcpmode_maxwin int, tcpmode_resend_time int, tcpmode_compress int, tcpmode_stat int,
 	timeout int, cryptoConfig *CryptoConfig) {
 
-	m := &MyMsg{
-		Id:                  connId,
-		Type:                (int32)(msgType),
-		Target:              target,
-		Data:                data,
-		Rproto:              (int32)(rproto),
-		Key:                 (int32)(key),
-		Tcpmode:             (int32)(tcpmode),
-		TcpmodeBuffersize:   (int32)(tcpmode_buffer_size),
-		TcpmodeMaxwin:       (int32)(tcpmode_maxwin),
-		TcpmodeResendTimems: (int32)(tcpmode_resend_time),
-		TcpmodeCompress:     (int32)(tcpmode_compress),
-		TcpmodeStat:         (int32)(tcpmode_stat),
-		Timeout:             (int32)(timeout),
-		Magic:               (int32)(MyMsg_MAGIC),
-	}
-
-	mb, err := proto.Marshal(m)
+	m := sendMsgPool.Get().(*MyMsg)
+	m.Id = connId
+	m.Type = (int32)(msgType)
+	m.Target = target
+	m.Data = data
+	m.Rproto = (int32)(rproto)
+	m.Key = (int32)(key)
+	m.Tcpmode = (int32)(tcpmode)
+	m.TcpmodeBuffersize = (int32)(tcpmode_buffer_size)
+	m.TcpmodeMaxwin = (int32)(tcpmode_maxwin)
+	m.TcpmodeResendTimems = (int32)(tcpmode_resend_time)
+	m.TcpmodeCompress = (int32)(tcpmode_compress)
+	m.TcpmodeStat = (int32)(tcpmode_stat)
+	m.Timeout = (int32)(timeout)
+	m.Magic = (int32)(MyMsg_MAGIC)
+
+	sendICMPMsg(id, sequence, conn, server, m, sproto, cryptoConfig)
+
+	// drop the references to the caller's data before reuse
+	m.Reset()
+	sendMsgPool.Put(m)
+}
+
+// sendICMPMsg sends a message built by the caller, for fields sendICMP does not cover.
+func sendICMPMsg(id int, sequence int, conn icmp.PacketConn, server *net.IPAddr, m *MyMsg, sproto int, cryptoConfig *CryptoConfig) {
+
+	bp := sendBufferPool.Get().(*[]byte)
+	b, err := appendICMP((*bp)[:0], id, sequence, m, sproto, cryptoConfig)
 	if err != nil {
-		loggo.Error("sendICMP Marshal MyMsg error %s %s", server.String(), err)
+		loggo.Error("sendICMP error %s %s", server.String(), err)
+		sendBufferPool.Put(bp)
 		return
 	}
 
+	conn.WriteTo(b, icmpDstAddr(server))
+
+	if cap(b) <= SEND_BUFFER_MAX_SIZE {
+		*bp = b[:0]
+		sendBufferPool.Put(bp)
+	}
+}
+
+// appendICMP appends the echo packet carrying m to b, the same bytes
+// icmp.Message.Marshal gives for an encrypted proto.Marshal of m.
+func appendICMP(b []byte, id int, sequence int, m *MyMsg, sproto int, cryptoConfig *CryptoConfig) ([]byte, error) {
+	start := len(b)
+	nonceSize := 0
+	if cryptoConfig != nil {
+		nonceSize = cryptoConfig.NonceSize()
+	}
+	b = append(b, make([]byte, ICMP_ECHO_HEADER_SIZE+nonceSize)...)
+
+	b, err := proto.MarshalOptions{}.MarshalAppend(b, m)
+	if err != nil {
+		return nil, fmt.Errorf("marshal MyMsg: %v", err)
+	}
+
 	// Encrypt the marshaled data if encryption is enabled
 	if cryptoConfig != nil {
-		mb, err = cryptoConfig.Encrypt(mb)
+		b, err = cryptoConfig.EncryptInPlace(b, start+ICMP_ECHO_HEADER_SIZE)
 		if err != nil {
-			loggo.Error("sendICMP Encrypt error %s %s", server.String(), err)
-			return
+			return nil, fmt.Errorf("encrypt: %v", err)
 		}
 	}
 
-	body := &icmp.Echo{
-		ID:   id,
-		Seq:  sequence,
-		Data: mb,
-	}
+	header := b[start : start+ICMP_ECHO_HEADER_SIZE]
+	header[0] = byte(sproto)
+	header[1] = 0 // code
+	header[2] = 0
+	header[3] = 0
+	binary.BigEndian.PutUint16(header[4:6], uint16(id))
+	binary.BigEndian.PutUint16(header[6:8], uint16(sequence))
+	s := icmpChecksum(b[start:])
+	header[2] ^= byte(s)
+	header[3] ^= byte(s >> 8)
+	return b, nil
+}
 
-	msg := &icmp.Message{
-		Type: (ipv4.ICMPType)(sproto),
-		Code: 0,
-		Body: body,
+// icmpChecksum is the internet checksum summed as x/net/icmp does, over
+// little-endian words, so its low byte goes first in the header.
+func icmpChecksum(b []byte) uint16 {
+	csumcv := len(b) - 1 // checksum coverage
+	s := uint32(0)
+	for i := 0; i < csumcv; i += 2 {
+		s += uint32(b[i+1])<<8 | uint32(b[i])
 	}
-
-	bytes, err := msg.Marshal(nil)
-	if err != nil {
-		loggo.Error("sendICMP Marshal error %s %s", server.String(), err)
-		return
+	if csumcv&1 == 0 {
+		s += uint32(b[csumcv])
 	}
-
-	conn.WriteTo(bytes, icmpDstAddr(server))
+	s = s>>16 + s&0xffff
+	s = s + s>>16
+	return ^uint16(s)
 }
 
-func recvICMP(workResultLock *sync.WaitGroup, exit *bool, conn icmp.PacketConn, recv chan<- *Packet, cryptoConfig *CryptoConfig) {
+func recvICMP(ctx context.Context, workResultLock *sync.WaitGroup, conn icmp.PacketConn, recv chan<- *Packet, cryptoConfig *CryptoConfig, decryptthread int) {
 
 	defer common.CrashLog()
 
 	(*workResultLock).Add(1)
 	defer (*workResultLock).Done()
 
-	bytes := make([]byte, 10240)
-	for !*exit {
-		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
-		n, srcaddr, err := conn.ReadFrom(bytes)
+	if cryptoConfig != nil && decryptthread > 1 {
+		recvICMPParallel(ctx, &conn, recv, cryptoConfig, decryptthread)
+		return
+	}
 
-		if err != nil {
-			nerr, ok := err.(net.Error)
-			if !ok || !nerr.Timeout() {
-				loggo.Info("Error read icmp message %s", err)
-				continue
-			}
+	var failures decryptFailures
+	bytes := make([]byte, RECV_BUFFER_SIZE)
+	plain := make([]byte, 0, len(bytes))
+	for ctx.Err() == nil {
+		n, srcaddr := readICMP(&conn, bytes)
+		if n <= 0 {
+			continue
 		}
 
-		if n <= 0 {
+		packet, err := decodePacket(bytes[:n], srcaddr, plain, cryptoConfig)
+		if err != nil {
+			loggo.Debug("recvICMP %s", err)
+			failures.add(err, srcaddr)
 			continue
 		}
 
-		echoId := int(binary.BigEndian.Uint16(bytes[4:6]))
-		echoSeq := int(binary.BigEndian.Uint16(bytes[6:8]))
+		select {
+		case recv <- packet:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// recvJob carries a packet read by recvICMPParallel through the decrypt
+// workers, its buffers are reused for another packet once it is passed on.
+type recvJob struct {
+	buf    []byte
+	plain  []byte
+	n      int
+	src    net.Addr
+	packet *Packet
+	done   chan struct{}
+}
+
+// recvICMPParallel decrypts on several workers while the packets still leave
+// in the order they were read, so the packets of a session stay in order.
+// Reading stops when all RECV_DECRYPT_QUEUE jobs of every worker are in flight.
+func recvICMPParallel(ctx context.Context, conn net.PacketConn, recv chan<- *Packet, cryptoConfig *CryptoConfig, workers int) {
+
+	free := make(chan *recvJob, workers*RECV_DECRYPT_QUEUE)
+	for i := 0; i < cap(free); i++ {
+		free <- &recvJob{
+			buf:   make([]byte, RECV_BUFFER_SIZE),
+			plain: make([]byte, 0, RECV_BUFFER_SIZE),
+			done:  make(chan struct{}, 1),
+		}
+	}
+	jobs := make(chan *recvJob, cap(free))
+	order := make(chan *recvJob, cap(free))
+
+	var failures decryptFailures
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer common.CrashLog()
+			defer wg.Done()
 
-		// Extract the payload data
-		payloadData := bytes[8:n]
+			for j := range jobs {
+				packet, err := decodePacket(j.buf[:j.n], j.src, j.plain, cryptoConfig)
+				if err != nil {
+					loggo.Debug("recvICMP %s", err)
+					failures.add(err, j.src)
+				}
+				j.packet = packet
+				j.done <- struct{}{}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer common.CrashLog()
+		defer wg.Done()
 
-		// Decrypt the data if encryption is enabled
-		if cryptoConfig != nil {
-			payloadData, err = cryptoConfig.Decrypt(payloadData)
-			if err != nil {
-				loggo.Debug("recvICMP Decrypt error: %s", err)
-				continue
+		for j := range order {
+			<-j.done
+			if j.packet != nil {
+				select {
+				case recv <- j.packet:
+				case <-ctx.Done():
+				}
 			}
+			j.packet = nil
+			free <- j
 		}
+	}()
 
-		my := &MyMsg{}
-		err = proto.Unmarshal(payloadData, my)
-		if err != nil {
-			loggo.Debug("Unmarshal MyMsg error: %s", err)
+	for ctx.Err() == nil {
+		j := <-free
+		j.n, j.src = readICMP(conn, j.buf)
+		if j.n <= 0 {
+			free <- j
 			continue
 		}
+		order <- j
+		jobs <- j
+	}
+	close(jobs)
+	close(order)
+	wg.Wait()
+}
 
-		if my.Magic != (int32)(MyMsg_MAGIC) {
-			loggo.Debug("processPacket data invalid %s", my.Id)
-			continue
+// readICMP reads an echo packet into b, returning 0 on timeouts, errors and
+// packets too short to be one.
+func readICMP(conn net.PacketConn, b []byte) (int, net.Addr) {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	n, srcaddr, err := conn.ReadFrom(b)
+
+	if err != nil {
+		nerr, ok := err.(net.Error)
+		if !ok || !nerr.Timeout() {
+			loggo.Info("Error read icmp message %s", err)
 		}
+		return 0, nil
+	}
+
+	if n < ICMP_ECHO_HEADER_SIZE {
+		return 0, nil
+	}
+	return n, srcaddr
+}
+
+// decryptFailures counts the packets that failed to decrypt in the current
+// DECRYPT_FAIL_HINT_WINDOW.
+type decryptFailures struct {
+	lock  sync.Mutex
+	start time.Time
+	n     int
+}
 
-		recv <- &Packet{my: my,
-			src:    icmpSrcToIPAddr(srcaddr),
-			echoId: echoId, echoSeq: echoSeq}
+// add counts err when it is a decrypt failure, logging a hint to check the
+// encryption settings when it is the DECRYPT_FAIL_HINT-th one of the window.
+func (d *decryptFailures) add(err error, src net.Addr) {
+	if !errors.Is(err, errDecrypt) || !d.hint(time.Now()) {
+		return
 	}
+	loggo.Warn("%d packets failed to decrypt in %s, the last from %s: check that -encrypt, the encryption key and -encrypt-kdf with its salt match on both sides",
+		DECRYPT_FAIL_HINT, DECRYPT_FAIL_HINT_WINDOW, src)
+}
+
+// hint counts a failure at now and reports whether it warrants the hint.
+func (d *decryptFailures) hint(now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if now.Sub(d.start) > DECRYPT_FAIL_HINT_WINDOW {
+		d.start, d.n = now, 0
+	}
+	d.n++
+	return d.n == DECRYPT_FAIL_HINT
+}
+
+// decodePacket turns the echo packet b read from srcaddr into a Packet.
+func decodePacket(b []byte, srcaddr net.Addr, plain []byte, cryptoConfig *CryptoConfig) (*Packet, error) {
+	echoId := int(binary.BigEndian.Uint16(b[4:6]))
+	echoSeq := int(binary.BigEndian.Uint16(b[6:8]))
+
+	my, suite, err := decodeICMP(b[ICMP_ECHO_HEADER_SIZE:], plain, cryptoConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Packet{my: my,
+		src:    icmpSrcToIPAddr(srcaddr),
+		echoId: echoId, echoSeq: echoSeq, crypto: suite}, nil
+}
+
+// decodeICMP decrypts an echo payload into plain, a buffer reused across
+// packets, and unmarshals it. The message copies what it keeps, so neither
+// buffer is referenced afterwards; it goes on to other goroutines and is not
+// pooled.
+func decodeICMP(payloadData []byte, plain []byte, cryptoConfig *CryptoConfig) (*MyMsg, *CryptoConfig, error) {
+	// Decrypt the data if encryption is enabled
+	var suite *CryptoConfig
+	if cryptoConfig != nil {
+		var err error
+		payloadData, suite, err = cryptoConfig.DecryptSuiteTo(plain[:0], payloadData)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", errDecrypt, err)
+		}
+	}
+
+	my := &MyMsg{}
+	err := proto.Unmarshal(payloadData, my)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unmarshal MyMsg error: %v", err)
+	}
+
+	if my.Magic != (int32)(MyMsg_MAGIC) {
+		return nil, nil, fmt.Errorf("data invalid %s", my.Id)
+	}
+	return my, suite, nil
 }
 
 type Packet struct {
@@ -133,9 +363,24 @@ type Packet struct {
 	src     *net.IPAddr
 	echoId  int
 	echoSeq int
+	crypto  *CryptoConfig // the suite it was decrypted with, nil when not encrypted
 }
 
 const (
 	FRAME_MAX_SIZE int = 888
 	FRAME_MAX_ID   int = 1000000
 )
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite sends FIN on conn and keeps its read side open. It reports false
+// when conn can not be half closed.
+func closeWrite(conn net.Conn) bool {
+	cw, ok := conn.(closeWriter)
+	if !ok {
+		return false
+	}
+	return cw.CloseWrite() == nil
+}
@@ -1,9 +1,18 @@
 package pingtunnel
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
 	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"os"
 	"testing"
+	"time"
 )
 
 func Test0001(t *testing.T) {
@@ -25,3 +34,294 @@ func Test0001(t *testing.T) {
 	fmt.Println("my1 = ", my1)
 
 }
+
+func TestCloseWrite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer s.Close()
+
+	if !closeWrite(c) {
+		t.Fatalf("closeWrite(tcp) = false")
+	}
+	if _, err := io.ReadAll(s); err != nil {
+		t.Fatalf("peer read after closeWrite: %v", err)
+	}
+	if _, err := s.Write([]byte("back")); err != nil {
+		t.Fatalf("peer write after closeWrite: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "back" {
+		t.Errorf("read after closeWrite = %q, %v", buf, err)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if closeWrite(a) {
+		t.Errorf("closeWrite(pipe) = true")
+	}
+}
+
+func testMsg(data []byte) *MyMsg {
+	return &MyMsg{
+		Id:      "a1b2c3d4-e5f6-7890-abcd-ef0123456789",
+		Type:    (int32)(MyMsg_DATA),
+		Target:  "10.0.0.1:8080",
+		Data:    data,
+		Rproto:  8,
+		Key:     123456,
+		Tcpmode: 1,
+		Timeout: 60,
+		Magic:   (int32)(MyMsg_MAGIC),
+	}
+}
+
+func TestAppendICMP(t *testing.T) {
+	// odd and even lengths, the checksum pads the last byte
+	for _, size := range []int{0, 1, 2, 1000, 1001} {
+		m := testMsg(bytes.Repeat([]byte{0xa5}, size))
+		mb, _ := proto.Marshal(m)
+		want, err := (&icmp.Message{
+			Type: ipv4.ICMPType(8),
+			Body: &icmp.Echo{ID: 0x1234, Seq: 0xfedc, Data: mb},
+		}).Marshal(nil)
+		if err != nil {
+			t.Fatalf("icmp.Message.Marshal failed: %v", err)
+		}
+
+		prefix := []byte("junk")
+		got, err := appendICMP(prefix, 0x1234, 0xfedc, m, 8, nil)
+		if err != nil {
+			t.Fatalf("appendICMP(%d) failed: %v", size, err)
+		}
+		if !bytes.Equal(got[:len(prefix)], prefix) || !bytes.Equal(got[len(prefix):], want) {
+			t.Errorf("appendICMP(%d) = %x, want %x", size, got[len(prefix):], want)
+		}
+	}
+}
+
+func TestDecodeICMP(t *testing.T) {
+	// a suite list takes one of the modes sharing the key
+	var config *CryptoConfig
+	plain := make([]byte, 0, 64)
+	for _, legacy := range LEGACY_ENCRYPTION_MODES {
+		modes := []EncryptionMode{XCHACHA20, AES128_GCM_SIV, AES256_GCM_SIV, legacy}
+		var err error
+		config, err = NewCryptoConfigSuites(modes, []string{"my-secret-passphrase"}, nil)
+		if err != nil {
+			t.Fatalf("NewCryptoConfigSuites failed: %v", err)
+		}
+
+		for _, suite := range config.Suites() {
+			m := testMsg([]byte("hello through the tunnel"))
+			b, err := appendICMP(nil, 1, 2, m, 0, suite)
+			if err != nil {
+				t.Fatalf("appendICMP(%s) failed: %v", suite.Mode, err)
+			}
+			parsed, err := icmp.ParseMessage(1, b)
+			if err != nil {
+				t.Fatalf("icmp.ParseMessage(%s) failed: %v", suite.Mode, err)
+			}
+			if parsed.Type != ipv4.ICMPTypeEchoReply {
+				t.Errorf("appendICMP(%s) type = %v, want echo reply", suite.Mode, parsed.Type)
+			}
+
+			got, gotSuite, err := decodeICMP(b[ICMP_ECHO_HEADER_SIZE:], plain, config)
+			if err != nil {
+				t.Fatalf("decodeICMP(%s) failed: %v", suite.Mode, err)
+			}
+			if !proto.Equal(got, m) || gotSuite != suite {
+				t.Errorf("decodeICMP(%s) = %v %s, want %v %s", suite.Mode, got, gotSuite.Mode, m, suite.Mode)
+			}
+
+			// the message must not point into the reused buffer
+			plain = plain[:cap(plain)]
+			clear(plain)
+			if !bytes.Equal(got.Data, m.Data) {
+				t.Errorf("decodeICMP(%s) data aliases the decrypt buffer", suite.Mode)
+			}
+		}
+	}
+
+	if _, _, err := decodeICMP([]byte("not a packet"), plain, config); !errors.Is(err, errDecrypt) {
+		t.Errorf("decodeICMP(garbage) = %v, want a decrypt error", err)
+	}
+	b, _ := appendICMP(nil, 1, 2, &MyMsg{Id: "x"}, 8, config)
+	if _, _, err := decodeICMP(b[ICMP_ECHO_HEADER_SIZE:], plain, config); err == nil || errors.Is(err, errDecrypt) {
+		t.Errorf("decodeICMP(no magic) = %v, want an error other than decrypt", err)
+	}
+}
+
+func TestDecryptFailuresHint(t *testing.T) {
+	var d decryptFailures
+	now := time.Now()
+	for i := 1; i <= 2*DECRYPT_FAIL_HINT; i++ {
+		if got := d.hint(now); got != (i == DECRYPT_FAIL_HINT) {
+			t.Errorf("failure %d hint = %v", i, got)
+		}
+	}
+
+	// a new window counts again
+	now = now.Add(DECRYPT_FAIL_HINT_WINDOW + time.Second)
+	for i := 1; i < DECRYPT_FAIL_HINT; i++ {
+		d.hint(now)
+	}
+	if !d.hint(now) {
+		t.Errorf("no hint in the next window")
+	}
+}
+
+// packetConn feeds packets to recvICMPParallel and times out when it has none.
+type packetConn struct {
+	net.PacketConn
+	packets chan []byte
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		return copy(b, packet), &net.IPAddr{IP: net.IPv4(10, 0, 0, 1)}, nil
+	case <-time.After(10 * time.Millisecond):
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func TestRecvICMPParallel(t *testing.T) {
+	t.Chdir(t.TempDir())
+	config, err := NewCryptoConfig(CHACHA20, "my-secret-passphrase")
+	if err != nil {
+		t.Fatalf("NewCryptoConfig failed: %v", err)
+	}
+
+	// more packets than the workers hold at once, some not decryptable
+	const count = 1000
+	conn := &packetConn{packets: make(chan []byte, count)}
+	for i := 0; i < count; i++ {
+		if i%10 == 9 {
+			conn.packets <- []byte("garbage packet")
+			continue
+		}
+		b, _ := appendICMP(nil, 1, i, testMsg(make([]byte, i)), 0, config)
+		conn.packets <- b
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	recv := make(chan *Packet, count)
+	done := make(chan struct{})
+	go func() {
+		recvICMPParallel(ctx, conn, recv, config, 4)
+		close(done)
+	}()
+
+	for i := 0; i < count; i++ {
+		if i%10 == 9 {
+			continue
+		}
+		select {
+		case packet := <-recv:
+			if packet.echoSeq != i || len(packet.my.Data) != i {
+				t.Fatalf("packet %d has seq %d and %d bytes, want them in order", i, packet.echoSeq, len(packet.my.Data))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for packet %d", i)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("recvICMPParallel did not stop")
+	}
+	if len(recv) != 0 {
+		t.Errorf("recvICMPParallel passed on %d extra packets", len(recv))
+	}
+}
+
+// BenchmarkSendPathBaseline is the send path as it was, allocating the
+// marshalled message, the sealed copy and the wire packet per send.
+func BenchmarkSendPathBaseline(b *testing.B) {
+	config, _ := NewCryptoConfig(CHACHA20, "my-secret-passphrase")
+	data := make([]byte, 1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		m := testMsg(data)
+		mb, _ := proto.Marshal(m)
+		mb, _ = config.Encrypt(mb)
+		msg := &icmp.Message{
+			Type: ipv4.ICMPType(8),
+			Body: &icmp.Echo{ID: 1, Seq: i, Data: mb},
+		}
+		msg.Marshal(nil)
+	}
+}
+
+func BenchmarkSendPath(b *testing.B) {
+	config, _ := NewCryptoConfig(CHACHA20, "my-secret-passphrase")
+	data := make([]byte, 1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		m := sendMsgPool.Get().(*MyMsg)
+		m.Id = "a1b2c3d4-e5f6-7890-abcd-ef0123456789"
+		m.Type = (int32)(MyMsg_DATA)
+		m.Target = "10.0.0.1:8080"
+		m.Data = data
+		m.Magic = (int32)(MyMsg_MAGIC)
+		bp := sendBufferPool.Get().(*[]byte)
+		*bp, _ = appendICMP((*bp)[:0], 1, i, m, 8, config)
+		sendBufferPool.Put(bp)
+		m.Reset()
+		sendMsgPool.Put(m)
+	}
+}
+
+// BenchmarkRecvPathBaseline decrypts into a fresh buffer per packet as the
+// receive path did.
+func BenchmarkRecvPathBaseline(b *testing.B) {
+	config, _ := NewCryptoConfig(CHACHA20, "my-secret-passphrase")
+	packet, _ := appendICMP(nil, 1, 2, testMsg(make([]byte, 1024)), 0, config)
+	b.ReportAllocs()
+	b.SetBytes(1024)
+	for i := 0; i < b.N; i++ {
+		plain, _, err := config.DecryptSuite(packet[ICMP_ECHO_HEADER_SIZE:])
+		if err != nil {
+			b.Fatal(err)
+		}
+		my := &MyMsg{}
+		if err := proto.Unmarshal(plain, my); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRecvPath(b *testing.B) {
+	config, _ := NewCryptoConfig(CHACHA20, "my-secret-passphrase")
+	packet, _ := appendICMP(nil, 1, 2, testMsg(make([]byte, 1024)), 0, config)
+	plain := make([]byte, 0, len(packet))
+	b.ReportAllocs()
+	b.SetBytes(1024)
+	for i := 0; i < b.N; i++ {
+		if _, _, err := decodeICMP(packet[ICMP_ECHO_HEADER_SIZE:], plain, config); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package pingtunnel
+
+// ServerSettings are the server settings a reload changes in place. Live
+// sessions keep going; new sessions use the new values. The server reads them
+// through an atomic pointer, they must not be changed once handed over.
+type ServerSettings struct {
+	Key            int
+	AcceptKeys     []int
+	MaxConn        int
+	ConnectTimeout int // ms
+	ReverseAllow   int
+	BindAllow      int
+	Forward        *ForwardConfig
+	Route          *ServerRoute
+}
+
+func (p *Server) Reload(s *ServerSettings) {
+	p.settings.Store(s)
+}
+
+// ClientSettings are the client settings a reload changes in place. Live
+// sessions keep going; new sessions use the new values. The client reads them
+// through an atomic pointer, they must not be changed once handed over.
+type ClientSettings struct {
+	Key          int
+	AcceptKeys   []int // replies accepted besides Key while keys are rotated
+	MaxConn      int
+	Timeout      int
+	Sock5User    string
+	Sock5Pass    string
+	Sock5Confirm int
+	Sock5Filter  string // country code the sock5 filter sends direct
+	HttpUser     string
+	HttpPass     string
+	Route        *RouteTable
+}
+
+func (p *Client) Reload(s *ClientSettings) {
+	p.settings.Store(s)
+}
+
+// Settings returns the settings in use, e.g. for a sock5 filter.
+func (p *Client) Settings() *ClientSettings {
+	return p.settings.Load()
+}
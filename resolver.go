@@ -0,0 +1,535 @@
+package pingtunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	RESOLVER_PREFER_IPV4      = "ipv4"
+	RESOLVER_PREFER_IPV6      = "ipv6"
+	RESOLVER_PREFER_IPV4_ONLY = "ipv4_only"
+	RESOLVER_PREFER_IPV6_ONLY = "ipv6_only"
+
+	RESOLVER_CACHE_SIZE       int = 4096
+	RESOLVER_TIMEOUT              = 3 * time.Second
+	RESOLVER_SYSTEM_TTL           = time.Minute      // the system resolver reports no ttl
+	RESOLVER_NEGATIVE_TTL         = 30 * time.Second // for failures without a SOA minimum
+	RESOLVER_MAX_NEGATIVE_TTL     = 5 * time.Minute
+
+	// RFC 8305 connection attempt delay between addresses
+	HAPPY_EYEBALLS_DELAY = 250 * time.Millisecond
+)
+
+// ResolverConfig configures how the server resolves the targets it dials.
+type ResolverConfig struct {
+	Servers   []string // udp://IP:PORT, tcp://IP:PORT or tls://HOST:PORT (DoT), tried in order. Empty uses the system resolver
+	Prefer    string   // address family tried first, ipv4 by default
+	CacheSize int
+}
+
+type resolverServer struct {
+	network string // "udp", "tcp" or "tls"
+	addr    string
+	host    string // TLS server name
+}
+
+func (s *resolverServer) String() string {
+	return s.network + "://" + s.addr
+}
+
+type resolverCacheEntry struct {
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+// Resolver looks up A and AAAA records of the targets the server dials,
+// caches answers and failures by TTL and dials TCP with Happy Eyeballs.
+type Resolver struct {
+	servers   []*resolverServer
+	prefer    string
+	cacheSize int
+
+	lock  sync.Mutex
+	cache map[string]*resolverCacheEntry
+}
+
+// ParseResolverServers parses a comma separated list like
+// "udp://1.1.1.1:53,tls://dns.google:853". A bare address means udp, the port
+// defaults to 53, or 853 for tls.
+func ParseResolverServers(spec string) ([]string, error) {
+	var servers []string
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if _, err := parseResolverServer(item); err != nil {
+			return nil, err
+		}
+		servers = append(servers, item)
+	}
+	return servers, nil
+}
+
+func parseResolverServer(s string) (*resolverServer, error) {
+	network := "udp"
+	addr := s
+	if scheme, rest, ok := strings.Cut(s, "://"); ok {
+		network = strings.ToLower(scheme)
+		addr = rest
+	}
+	port := "53"
+	switch network {
+	case "udp", "tcp":
+	case "tls":
+		port = "853"
+	default:
+		return nil, fmt.Errorf("unsupported resolver %q (supported: udp://, tcp://, tls://)", s)
+	}
+
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		p = port
+	}
+	if host == "" {
+		return nil, fmt.Errorf("missing host in resolver %q", s)
+	}
+	if n, err := strconv.Atoi(p); err != nil || n <= 0 || n > 65535 {
+		return nil, fmt.Errorf("invalid port in resolver %q", s)
+	}
+	if network != "tls" && net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("resolver %q must be an IP address, only tls:// may use a name", s)
+	}
+	return &resolverServer{network: network, addr: net.JoinHostPort(host, p), host: host}, nil
+}
+
+func NewResolver(config *ResolverConfig) (*Resolver, error) {
+	if config == nil {
+		config = &ResolverConfig{}
+	}
+	r := &Resolver{
+		prefer:    config.Prefer,
+		cacheSize: config.CacheSize,
+		cache:     make(map[string]*resolverCacheEntry),
+	}
+	switch r.prefer {
+	case "":
+		r.prefer = RESOLVER_PREFER_IPV4
+	case RESOLVER_PREFER_IPV4, RESOLVER_PREFER_IPV6, RESOLVER_PREFER_IPV4_ONLY, RESOLVER_PREFER_IPV6_ONLY:
+	default:
+		return nil, fmt.Errorf("unsupported resolver preference %q (supported: ipv4, ipv6, ipv4_only, ipv6_only)", config.Prefer)
+	}
+	if r.cacheSize <= 0 {
+		r.cacheSize = RESOLVER_CACHE_SIZE
+	}
+	for _, s := range config.Servers {
+		server, err := parseResolverServer(s)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, server)
+	}
+	return r, nil
+}
+
+// Resolve returns the preferred address of host, the one udp sessions are
+// sent to.
+func (r *Resolver) Resolve(host string) (net.IP, error) {
+	ips, err := r.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+// LookupIP returns the addresses of host, preferred family first and the
+// families interleaved. Failures are returned as *net.DNSError.
+func (r *Resolver) LookupIP(host string) ([]net.IP, error) {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	now := time.Now()
+	if ips, err, ok := r.cacheGet(key, now); ok {
+		return ips, err
+	}
+
+	var ipv4, ipv6 []net.IP
+	var ttl time.Duration
+	var err error
+	if len(r.servers) == 0 {
+		ipv4, ipv6, err = r.lookupSystem(key)
+		ttl = RESOLVER_SYSTEM_TTL
+	} else {
+		ipv4, ipv6, ttl, err = r.lookupServers(key)
+	}
+
+	var ips []net.IP
+	if err == nil {
+		ips = r.sortAddrs(ipv4, ipv6)
+		if len(ips) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+	}
+
+	var dnsErr *net.DNSError
+	if err != nil && errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		if ttl <= 0 || ttl > RESOLVER_MAX_NEGATIVE_TTL {
+			ttl = RESOLVER_NEGATIVE_TTL
+		}
+		r.cachePut(key, nil, err, now.Add(ttl))
+	} else if err == nil && ttl > 0 {
+		r.cachePut(key, ips, nil, now.Add(ttl))
+	}
+	return ips, err
+}
+
+func (r *Resolver) lookupSystem(host string) ([]net.IP, []net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), RESOLVER_TIMEOUT)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ipv4, ipv6 []net.IP
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			ipv4 = append(ipv4, a.IP)
+		} else {
+			ipv6 = append(ipv6, a.IP)
+		}
+	}
+	return ipv4, ipv6, nil
+}
+
+// lookupServers queries A and AAAA at the same time. ttl is the smallest of
+// both answers, for caching either the addresses or the negative answer.
+func (r *Resolver) lookupServers(host string) ([]net.IP, []net.IP, time.Duration, error) {
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	var qtypes []dnsmessage.Type
+	if r.prefer != RESOLVER_PREFER_IPV6_ONLY {
+		qtypes = append(qtypes, dnsmessage.TypeA)
+	}
+	if r.prefer != RESOLVER_PREFER_IPV4_ONLY {
+		qtypes = append(qtypes, dnsmessage.TypeAAAA)
+	}
+
+	answers := make([]answer, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype dnsmessage.Type) {
+			defer common.CrashLog()
+			defer wg.Done()
+			answers[i].ips, answers[i].ttl, answers[i].err = r.query(host, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ipv4, ipv6 []net.IP
+	var ttl time.Duration
+	var err error
+	for i, a := range answers {
+		if a.ttl > 0 && (ttl == 0 || a.ttl < ttl) {
+			ttl = a.ttl
+		}
+		if a.err != nil {
+			err = a.err
+			continue
+		}
+		if qtypes[i] == dnsmessage.TypeA {
+			ipv4 = a.ips
+		} else {
+			ipv6 = a.ips
+		}
+	}
+	if len(ipv4) > 0 || len(ipv6) > 0 {
+		// one family is enough to connect
+		return ipv4, ipv6, ttl, nil
+	}
+	if err != nil {
+		return nil, nil, ttl, err
+	}
+	return nil, nil, ttl, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// query asks the servers in order until one answers.
+func (r *Resolver) query(host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, IsNotFound: true}
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(common.RandInt()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var lastErr error
+	for _, server := range r.servers {
+		resp, err := r.exchange(server, query)
+		if err != nil {
+			loggo.Info("resolver %s query %s fail: %s", server, host, err)
+			lastErr = &net.DNSError{Err: err.Error(), Name: host, Server: server.String(), IsTemporary: true}
+			continue
+		}
+		ips, ttl, err := parseResolverAnswer(host, resp, qtype)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				return nil, ttl, err
+			}
+			lastErr = err
+			continue
+		}
+		return ips, ttl, nil
+	}
+	return nil, 0, lastErr
+}
+
+func (r *Resolver) exchange(server *resolverServer, query []byte) ([]byte, error) {
+	switch server.network {
+	case "tcp":
+		return dnsExchangeTCP(server.addr, query, RESOLVER_TIMEOUT)
+	case "tls":
+		return dnsExchangeTLS(server.addr, server.host, query, RESOLVER_TIMEOUT)
+	}
+	return dnsExchange(server.addr, query, RESOLVER_TIMEOUT)
+}
+
+// dnsExchangeTLS sends query over DNS over TLS (RFC 7858).
+func dnsExchangeTLS(server string, serverName string, query []byte, timeout time.Duration) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", server, &tls.Config{ServerName: serverName})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeDnsTCP(conn, query); err != nil {
+		return nil, err
+	}
+	return readDnsTCP(conn)
+}
+
+// parseResolverAnswer collects the addresses of qtype in resp. An empty
+// NOERROR answer is no error, the other family may still have addresses.
+func parseResolverAnswer(host string, resp []byte, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(resp); err != nil {
+		return nil, 0, err
+	}
+	ttl := dnsResponseTTL(msg)
+
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, ttl, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server answered " + msg.Header.RCode.String(), Name: host, IsTemporary: true}
+	}
+
+	var ips []net.IP
+	for _, r := range msg.Answers {
+		switch b := r.Body.(type) {
+		case *dnsmessage.AResource:
+			if qtype == dnsmessage.TypeA {
+				ips = append(ips, net.IP(b.A[:]))
+			}
+		case *dnsmessage.AAAAResource:
+			if qtype == dnsmessage.TypeAAAA {
+				ips = append(ips, net.IP(b.AAAA[:]))
+			}
+		}
+	}
+	return ips, ttl, nil
+}
+
+// sortAddrs interleaves the families starting with the preferred one, as
+// RFC 8305 suggests, or drops the other family for the *_only preferences.
+func (r *Resolver) sortAddrs(ipv4 []net.IP, ipv6 []net.IP) []net.IP {
+	first, second := ipv4, ipv6
+	switch r.prefer {
+	case RESOLVER_PREFER_IPV6:
+		first, second = ipv6, ipv4
+	case RESOLVER_PREFER_IPV4_ONLY:
+		second = nil
+	case RESOLVER_PREFER_IPV6_ONLY:
+		first, second = ipv6, nil
+	}
+
+	ips := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ips = append(ips, first[i])
+		}
+		if i < len(second) {
+			ips = append(ips, second[i])
+		}
+	}
+	return ips
+}
+
+func (r *Resolver) cacheGet(key string, now time.Time) ([]net.IP, error, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	e, ok := r.cache[key]
+	if !ok {
+		return nil, nil, false
+	}
+	if !now.Before(e.expire) {
+		delete(r.cache, key)
+		return nil, nil, false
+	}
+	return e.ips, e.err, true
+}
+
+func (r *Resolver) cachePut(key string, ips []net.IP, err error, expire time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.cache) >= r.cacheSize {
+		now := time.Now()
+		for k, e := range r.cache {
+			if now.After(e.expire) {
+				delete(r.cache, k)
+			}
+		}
+		// still full, drop an arbitrary entry
+		for k := range r.cache {
+			if len(r.cache) < r.cacheSize {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[key] = &resolverCacheEntry{ips: ips, err: err, expire: expire}
+}
+
+// ResolveUDPAddr resolves addr to the preferred address of its host.
+func (r *Resolver) ResolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum < 0 || portNum > 65535 {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	ip, err := r.Resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: portNum}, nil
+}
+
+// DialTCP connects to addr with Happy Eyeballs (RFC 8305): the addresses are
+// tried in order, a new attempt starts every HAPPY_EYEBALLS_DELAY or as soon as
+// the previous one fails, and the first connection wins.
+func (r *Resolver) DialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	return happyEyeballsDial(ips, port, timeout, HAPPY_EYEBALLS_DELAY)
+}
+
+// DialTCPIPs is DialTCP on addresses of addr already resolved, e.g. the ones
+// the server route permits.
+func (r *Resolver) DialTCPIPs(addr string, ips []net.IP, timeout time.Duration) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return happyEyeballsDial(ips, port, timeout, HAPPY_EYEBALLS_DELAY)
+}
+
+func happyEyeballsDial(ips []net.IP, port string, timeout time.Duration, delay time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	results := make(chan result, len(ips))
+	next := 0
+	pending := 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			defer common.CrashLog()
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// the losers are cancelled, close any that connected anyway
+				go func(n int) {
+					defer common.CrashLog()
+					for i := 0; i < n; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if next < len(ips) {
+				start()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,189 @@
+package pingtunnel
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseResolverServers(t *testing.T) {
+	servers, err := ParseResolverServers("1.1.1.1, tcp://8.8.8.8:5353,tls://dns.google,tls://[2606:4700::1111]:853")
+	if err != nil {
+		t.Fatalf("ParseResolverServers unexpected error: %v", err)
+	}
+	r, err := NewResolver(&ResolverConfig{Servers: servers})
+	if err != nil {
+		t.Fatalf("NewResolver unexpected error: %v", err)
+	}
+	want := []string{"udp://1.1.1.1:53", "tcp://8.8.8.8:5353", "tls://dns.google:853", "tls://[2606:4700::1111]:853"}
+	if len(r.servers) != len(want) {
+		t.Fatalf("NewResolver has %d servers, want %d", len(r.servers), len(want))
+	}
+	for i, w := range want {
+		if got := r.servers[i].String(); got != w {
+			t.Errorf("server %d = %q, want %q", i, got, w)
+		}
+	}
+
+	for _, spec := range []string{"https://1.1.1.1", "udp://dns.google", "1.1.1.1:0", "tls://:853"} {
+		if _, err := ParseResolverServers(spec); err == nil {
+			t.Errorf("ParseResolverServers(%q) expected error, got none", spec)
+		}
+	}
+	if _, err := NewResolver(&ResolverConfig{Prefer: "ipv5"}); err == nil {
+		t.Errorf("NewResolver(prefer ipv5) expected error, got none")
+	}
+}
+
+func TestResolverSortAddrs(t *testing.T) {
+	ipv4 := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+	ipv6 := []net.IP{net.ParseIP("2001:db8::1")}
+
+	tests := []struct {
+		prefer string
+		want   string
+	}{
+		{RESOLVER_PREFER_IPV4, "[192.0.2.1 2001:db8::1 192.0.2.2]"},
+		{RESOLVER_PREFER_IPV6, "[2001:db8::1 192.0.2.1 192.0.2.2]"},
+		{RESOLVER_PREFER_IPV4_ONLY, "[192.0.2.1 192.0.2.2]"},
+		{RESOLVER_PREFER_IPV6_ONLY, "[2001:db8::1]"},
+	}
+	for _, tt := range tests {
+		r, _ := NewResolver(&ResolverConfig{Prefer: tt.prefer})
+		ips := r.sortAddrs(ipv4, ipv6)
+		if got := formatIPs(ips); got != tt.want {
+			t.Errorf("sortAddrs(%s) = %s, want %s", tt.prefer, got, tt.want)
+		}
+	}
+}
+
+func formatIPs(ips []net.IP) string {
+	s := "["
+	for i, ip := range ips {
+		if i > 0 {
+			s += " "
+		}
+		s += ip.String()
+	}
+	return s + "]"
+}
+
+// startTestDnsServer answers A queries for ok.test and NXDOMAIN for anything
+// else, counting the queries it gets.
+func startTestDnsServer(t *testing.T, queries *int32) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+			query, err := parseDnsQuery(buf[:n])
+			if err != nil {
+				continue
+			}
+			q := query.Questions[0]
+			var resp []byte
+			switch {
+			case q.Name.String() == "ok.test." && q.Type == dnsmessage.TypeA:
+				resp, _ = buildDnsReply(query, dnsmessage.RCodeSuccess, net.ParseIP("192.0.2.7"))
+			case q.Name.String() == "ok.test.":
+				resp, _ = buildDnsReply(query, dnsmessage.RCodeSuccess, nil)
+			default:
+				resp, _ = buildDnsReply(query, dnsmessage.RCodeNameError, nil)
+			}
+			conn.WriteToUDP(resp, src)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestResolverLookupIP(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var queries int32
+	server := startTestDnsServer(t, &queries)
+	r, err := NewResolver(&ResolverConfig{Servers: []string{"udp://" + server}})
+	if err != nil {
+		t.Fatalf("NewResolver unexpected error: %v", err)
+	}
+
+	ip, err := r.Resolve("ok.test")
+	if err != nil || !ip.Equal(net.ParseIP("192.0.2.7")) {
+		t.Fatalf("Resolve(ok.test) = %v, %v, want 192.0.2.7", ip, err)
+	}
+	// A and AAAA
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("queries = %d, want 2", n)
+	}
+	if _, err := r.Resolve("OK.test."); err != nil {
+		t.Errorf("Resolve(OK.test.) unexpected error: %v", err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("queries after cached lookup = %d, want 2", n)
+	}
+
+	_, err = r.Resolve("missing.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("Resolve(missing.test) error = %v, want not found", err)
+	}
+	if dialErrorReason(err) != KICK_REASON_DNS {
+		t.Errorf("dialErrorReason(%v) = %d, want KICK_REASON_DNS", err, dialErrorReason(err))
+	}
+	before := atomic.LoadInt32(&queries)
+	if _, err := r.Resolve("missing.test"); err == nil {
+		t.Errorf("Resolve(missing.test) from cache expected error, got none")
+	}
+	if n := atomic.LoadInt32(&queries); n != before {
+		t.Errorf("negative answer not cached, queries %d -> %d", before, n)
+	}
+
+	if ip, err := r.Resolve("198.51.100.1"); err != nil || ip.String() != "198.51.100.1" {
+		t.Errorf("Resolve(198.51.100.1) = %v, %v", ip, err)
+	}
+}
+
+func TestHappyEyeballsDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	// a closed port refuses at once, the next address is tried without waiting
+	closed, _ := net.Listen("tcp", "127.0.0.2:"+strconv.Itoa(port))
+	if closed != nil {
+		closed.Close()
+	}
+	ips := []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}
+
+	begin := time.Now()
+	conn, err := happyEyeballsDial(ips, strconv.Itoa(port), time.Second, time.Second)
+	if err != nil {
+		t.Fatalf("happyEyeballsDial unexpected error: %v", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Errorf("happyEyeballsDial waited %s for the second address after a refusal", elapsed)
+	}
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("happyEyeballsDial connected to %s, want 127.0.0.1", got)
+	}
+
+	if _, err := happyEyeballsDial([]net.IP{net.ParseIP("127.0.0.2")}, strconv.Itoa(port), time.Second, time.Second); err == nil {
+		t.Errorf("happyEyeballsDial to a closed port expected error, got none")
+	}
+}
@@ -0,0 +1,535 @@
+package pingtunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/network"
+)
+
+// ReverseConfig describes one reverse tunnel: the server listens on ListenAddr
+// and every session accepted there is forwarded to TargetAddr on the client side.
+type ReverseConfig struct {
+	Network    string // "tcp" or "udp"
+	ListenAddr string // address the server listens on
+	TargetAddr string // address the client dials locally
+}
+
+// Id returns the identifier used to register the reverse tunnel on the server.
+func (r *ReverseConfig) Id() string {
+	return r.Network + "/" + r.ListenAddr
+}
+
+// ParseReverseSpec parses a comma separated list of reverse tunnels like
+// "tcp/0.0.0.0:8080/127.0.0.1:80,udp/:5353/127.0.0.1:53"
+func ParseReverseSpec(spec string) ([]*ReverseConfig, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	var ret []*ReverseConfig
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.Split(item, "/")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid reverse spec %q (expected network/listen/target)", item)
+		}
+
+		network := parts[0]
+		if network != "tcp" && network != "udp" {
+			return nil, fmt.Errorf("unsupported reverse network: %s (supported: tcp, udp)", network)
+		}
+
+		if _, _, err := net.SplitHostPort(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid reverse listen address %q: %w", parts[1], err)
+		}
+		if _, _, err := net.SplitHostPort(parts[2]); err != nil {
+			return nil, fmt.Errorf("invalid reverse target address %q: %w", parts[2], err)
+		}
+
+		r := &ReverseConfig{
+			Network:    network,
+			ListenAddr: parts[1],
+			TargetAddr: parts[2],
+		}
+		if seen[r.Id()] {
+			return nil, fmt.Errorf("duplicate reverse listen address: %s", r.Id())
+		}
+		seen[r.Id()] = true
+		ret = append(ret, r)
+	}
+
+	if len(ret) == 0 {
+		return nil, errors.New("empty reverse spec")
+	}
+	return ret, nil
+}
+
+// ServerReverse is a listener opened on behalf of a client registration.
+type ServerReverse struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	id         string
+	owner      string // the client that registered it
+	listenAddr string
+	tcpmode    int
+
+	tcpmode_buffersize    int
+	tcpmode_maxwin        int
+	tcpmode_resend_timems int
+	tcpmode_compress      int
+	tcpmode_stat          int
+	timeout               int
+
+	peer       sharedPeer
+	activeTime atomicTime
+
+	tcplistener *net.TCPListener
+	udplistener *net.UDPConn
+	udpConnMap  sync.Map
+}
+
+func (p *Server) processReversePacket(packet *Packet) {
+
+	id := packet.my.Id
+	now := time.Now()
+
+	if p.settings.Load().ReverseAllow <= 0 {
+		loggo.Info("reverse not allowed %s %s", packet.src.String(), id)
+		p.reverseReply(packet, "reverse not allowed")
+		return
+	}
+
+	if p.draining.Load() {
+		p.reverseReply(packet, "server shutting down")
+		return
+	}
+
+	// the client sends a token of its own, only it may refresh the listener
+	owner := string(packet.my.Data)
+
+	r := p.getServerReverseById(id)
+	if r != nil && r.owner != owner {
+		loggo.Info("reverse %s registered by another client, refuse %s", id, packet.src.String())
+		p.reverseReply(packet, "reverse address in use")
+		return
+	}
+	if r == nil {
+		r = &ServerReverse{
+			id:                    id,
+			owner:                 owner,
+			listenAddr:            packet.my.Target,
+			tcpmode:               (int)(packet.my.Tcpmode),
+			tcpmode_buffersize:    (int)(packet.my.TcpmodeBuffersize),
+			tcpmode_maxwin:        (int)(packet.my.TcpmodeMaxwin),
+			tcpmode_resend_timems: (int)(packet.my.TcpmodeResendTimems),
+			tcpmode_compress:      (int)(packet.my.TcpmodeCompress),
+			tcpmode_stat:          (int)(packet.my.TcpmodeStat),
+			timeout:               (int)(packet.my.Timeout),
+		}
+
+		if r.tcpmode > 0 {
+			tcpaddr, err := net.ResolveTCPAddr("tcp", r.listenAddr)
+			if err == nil {
+				r.tcplistener, err = net.ListenTCP("tcp", tcpaddr)
+			}
+			if err != nil {
+				loggo.Error("Error listening for reverse tcp %s %s", id, err.Error())
+				p.reverseReply(packet, err.Error())
+				return
+			}
+		} else {
+			udpaddr, err := net.ResolveUDPAddr("udp", r.listenAddr)
+			if err == nil {
+				r.udplistener, err = net.ListenUDP("udp", udpaddr)
+			}
+			if err != nil {
+				loggo.Error("Error listening for reverse udp %s %s", id, err.Error())
+				p.reverseReply(packet, err.Error())
+				return
+			}
+		}
+
+		// the accept loops reply to the peer, it is set before they start
+		r.ctx, r.cancel = context.WithCancel(p.ctx)
+		r.peer.Store(packetPeer(packet))
+		r.activeTime.Store(now)
+
+		loggo.Info("start reverse listen %s from %s", id, packet.src.String())
+		p.reverseMap.Store(id, r)
+
+		if r.tcpmode > 0 {
+			go p.AcceptReverseTcp(r)
+		} else {
+			go p.AcceptReverseUdp(r)
+		}
+	}
+
+	r.peer.Store(packetPeer(packet))
+	r.activeTime.Store(now)
+
+	p.reverseReply(packet, "")
+}
+
+func (p *Server) reverseReply(packet *Packet, errStr string) {
+	sendICMP(packet.echoId, packet.echoSeq, *p.conn, packet.src, "", packet.my.Id, (uint32)(MyMsg_REVERSE), []byte(errStr),
+		(int)(packet.my.Rproto), -1, (int)(packet.my.Key),
+		0, 0, 0, 0, 0, 0,
+		0, packet.crypto)
+}
+
+func (p *Server) AcceptReverseTcp(r *ServerReverse) {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	loggo.Info("server waiting reverse accept tcp %s", r.id)
+
+	for r.ctx.Err() == nil {
+		r.tcplistener.SetDeadline(time.Now().Add(time.Millisecond * 1000))
+
+		conn, err := r.tcplistener.AcceptTCP()
+		if err != nil {
+			nerr, ok := err.(net.Error)
+			if !ok || !nerr.Timeout() {
+				if r.ctx.Err() != nil {
+					break
+				}
+				loggo.Info("Error accept reverse tcp %s %s", r.id, err)
+				continue
+			}
+		}
+
+		if conn == nil {
+			continue
+		}
+
+		if maxconn := p.settings.Load().MaxConn; maxconn > 0 && (int)(p.localConnMapSize.Load()) >= maxconn {
+			loggo.Info("too many connections %d, server accept new reverse tcp fail %s", p.localConnMapSize.Load(), conn.RemoteAddr().String())
+			conn.Close()
+			continue
+		}
+
+		uuid := common.UniqueId()
+
+		fm := network.NewFrameMgr(FRAME_MAX_SIZE, FRAME_MAX_ID, r.tcpmode_buffersize, r.tcpmode_maxwin, r.tcpmode_resend_timems, r.tcpmode_compress,
+			r.tcpmode_stat)
+
+		localConn := &ServerConn{timeout: r.timeout, tcpconn: conn, tcpaddrTarget: conn.RemoteAddr().(*net.TCPAddr), id: uuid,
+			fm: fm, clock: newFrameClock(r.tcpmode_resend_timems), tcpmode: r.tcpmode, reverseId: r.id,
+			activity: make(chan struct{}, 1)}
+
+		peer := r.peer.Load()
+		p.addServerConn(uuid, localConn, peer)
+		loggo.Info("server accept new reverse tcp %s %s %s", r.id, uuid, conn.RemoteAddr().String())
+
+		localConn.fm.Connect()
+		go p.RecvTCP(localConn, uuid, peer.src)
+	}
+
+	loggo.Info("server stop reverse accept tcp %s", r.id)
+}
+
+func (p *Server) AcceptReverseUdp(r *ServerReverse) {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	loggo.Info("server waiting reverse accept udp %s", r.id)
+
+	bytes := make([]byte, UDP_FRAG_MAX_DATAGRAM)
+
+	for r.ctx.Err() == nil {
+		r.udplistener.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, srcaddr, err := r.udplistener.ReadFromUDP(bytes)
+		if err != nil {
+			nerr, ok := err.(net.Error)
+			if !ok || !nerr.Timeout() {
+				if r.ctx.Err() != nil {
+					break
+				}
+				loggo.Info("Error read reverse udp %s %s", r.id, err)
+				continue
+			}
+		}
+		if n <= 0 {
+			continue
+		}
+
+		var localConn *ServerConn
+		if v, ok := r.udpConnMap.Load(srcaddr.String()); ok {
+			localConn = p.getServerConnById(v.(string))
+		}
+		if localConn == nil {
+			if maxconn := p.settings.Load().MaxConn; maxconn > 0 && (int)(p.localConnMapSize.Load()) >= maxconn {
+				loggo.Info("too many connections %d, server accept new reverse udp fail %s", p.localConnMapSize.Load(), srcaddr.String())
+				continue
+			}
+			uuid := common.UniqueId()
+			localConn = &ServerConn{timeout: r.timeout, ipaddrTarget: copyUDPAddr(srcaddr), id: uuid,
+				tcpmode: 0, reverseId: r.id, reverseUDPConn: r.udplistener}
+			p.addServerConn(uuid, localConn, r.peer.Load())
+			r.udpConnMap.Store(srcaddr.String(), uuid)
+			loggo.Info("server accept new reverse udp %s %s %s", r.id, uuid, srcaddr.String())
+		}
+
+		localConn.activeSendTime.Store(time.Now())
+
+		peer := localConn.peer.Load()
+		sendICMPUDP(peer.echoId, peer.echoSeq, *p.conn, r.peer.Load().src, r.id, localConn.id, bytes[:n],
+			peer.rproto, -1, peer.key, 0, UDP_MODE_CONNECTED, peer.crypto)
+
+		p.sendPacket.Add(1)
+		p.sendPacketSize.Add((uint64)(n))
+	}
+
+	loggo.Info("server stop reverse accept udp %s", r.id)
+}
+
+// closeReverseUDP forgets the source of a closed reverse udp session, its next
+// datagram starts a new one.
+func (p *Server) closeReverseUDP(conn *ServerConn) {
+	if v, ok := p.reverseMap.Load(conn.reverseId); ok {
+		v.(*ServerReverse).udpConnMap.CompareAndDelete(conn.ipaddrTarget.String(), conn.id)
+	}
+}
+
+func (p *Server) checkTimeoutReverse() {
+
+	tmp := make(map[string]*ServerReverse)
+	p.reverseMap.Range(func(key, value interface{}) bool {
+		tmp[key.(string)] = value.(*ServerReverse)
+		return true
+	})
+
+	now := time.Now()
+	for id, r := range tmp {
+		diff := now.Sub(r.activeTime.Load())
+		if diff > time.Second*(time.Duration(r.timeout)) {
+			loggo.Info("close inactive reverse %s", id)
+			p.closeReverse(r)
+		}
+	}
+}
+
+func (p *Server) closeReverse(r *ServerReverse) {
+	r.cancel()
+	if r.tcplistener != nil {
+		r.tcplistener.Close()
+	}
+	if r.udplistener != nil {
+		r.udplistener.Close()
+	}
+	p.reverseMap.Delete(r.id)
+}
+
+func (p *Server) getServerReverseById(id string) *ServerReverse {
+	ret, ok := p.reverseMap.Load(id)
+	if !ok {
+		return nil
+	}
+	return ret.(*ServerReverse)
+}
+
+func (p *Client) getReverseConfigById(id string) *ReverseConfig {
+	if id == "" {
+		return nil
+	}
+	for _, r := range p.reverse {
+		if r.Id() == id {
+			return r
+		}
+	}
+	return nil
+}
+
+func (p *Client) registerReverse() {
+	settings := p.settings.Load()
+	for _, r := range p.reverse {
+		tcpmode := 0
+		if r.Network == "tcp" {
+			tcpmode = 1
+		}
+		sendICMP(p.id, p.nextSequence(), *p.conn, p.ipaddrServer.Load(), r.ListenAddr, r.Id(), (uint32)(MyMsg_REVERSE), []byte(p.reverseOwner),
+			SEND_PROTO, RECV_PROTO, settings.Key,
+			tcpmode, p.tcpmode_buffersize, p.tcpmode_maxwin, p.tcpmode_resend_timems, p.tcpmode_compress, p.tcpmode_stat,
+			settings.Timeout, p.cryptoConfig.Load())
+	}
+}
+
+// checkTimeoutReverse forgets closed reverse sessions once no late frame of
+// them can arrive anymore.
+func (p *Client) checkTimeoutReverse() {
+	timeout := time.Second * time.Duration(p.settings.Load().Timeout)
+	now := time.Now()
+	p.reverseClosed.Range(func(key, value interface{}) bool {
+		if now.Sub(value.(time.Time)) > timeout {
+			p.reverseClosed.Delete(key)
+		}
+		return true
+	})
+}
+
+func (p *Client) processReverseReply(packet *Packet) {
+	r := p.getReverseConfigById(packet.my.Id)
+	if r == nil {
+		return
+	}
+	errStr := string(packet.my.Data)
+	_, registered := p.reverseRegistered.Load(r.Id())
+	if errStr != "" {
+		if registered {
+			p.reverseRegistered.Delete(r.Id())
+		}
+		loggo.Error("reverse register fail %s: %s", r.Id(), errStr)
+		return
+	}
+	if !registered {
+		p.reverseRegistered.Store(r.Id(), true)
+		loggo.Info("reverse registered %s -> %s", r.Id(), r.TargetAddr)
+	}
+}
+
+func (p *Client) acceptReverse(packet *Packet, r *ReverseConfig) *ClientConn {
+
+	id := packet.my.Id
+
+	// frames resent or late after the session closed must not dial again
+	if _, ok := p.reverseClosed.Load(id); ok {
+		loggo.Debug("reverse session already closed %s", id)
+		p.remoteError(id)
+		return nil
+	}
+
+	if p.draining.Load() {
+		loggo.Info("shutting down, client refuse new reverse %s", r.Id())
+		p.reverseClosed.Store(id, time.Now())
+		p.remoteError(id)
+		return nil
+	}
+	if maxconn := p.settings.Load().MaxConn; maxconn > 0 && (int)(p.localIdToConnMapSize.Load()) >= maxconn {
+		loggo.Info("too many connections %d, client accept new reverse fail %s", p.localIdToConnMapSize.Load(), r.Id())
+		p.reverseClosed.Store(id, time.Now())
+		p.remoteError(id)
+		return nil
+	}
+
+	if r.Network == "tcp" {
+		fm := network.NewFrameMgr(FRAME_MAX_SIZE, FRAME_MAX_ID, p.tcpmode_buffersize, p.tcpmode_maxwin, p.tcpmode_resend_timems, p.tcpmode_compress, p.tcpmode_stat)
+		clientConn := &ClientConn{id: id, tcpmode: 1, reverseId: r.Id(),
+			activity: make(chan struct{}, 1),
+			fm:       fm,
+			clock:    newFrameClock(p.tcpmode_resend_timems)}
+		p.addClientConn(id, "reverse|"+id, clientConn)
+		loggo.Info("client accept new reverse tcp %s %s -> %s", id, r.Id(), r.TargetAddr)
+
+		go p.AcceptReverseTcpConn(clientConn, r)
+		return clientConn
+	}
+
+	udpaddr, err := net.ResolveUDPAddr("udp", r.TargetAddr)
+	if err != nil {
+		loggo.Info("reverse udp ResolveUDPAddr fail: %s %s", r.TargetAddr, err.Error())
+		p.reverseClosed.Store(id, time.Now())
+		p.remoteError(id)
+		return nil
+	}
+	targetConn, err := net.DialUDP("udp", nil, udpaddr)
+	if err != nil {
+		loggo.Info("reverse udp DialUDP fail: %s %s", r.TargetAddr, err.Error())
+		p.reverseClosed.Store(id, time.Now())
+		p.remoteError(id)
+		return nil
+	}
+
+	clientConn := &ClientConn{ipaddr: udpaddr, id: id, tcpmode: 0, reverseId: r.Id(),
+		reverseConn: targetConn}
+	p.addClientConn(id, "reverse|"+id, clientConn)
+	loggo.Info("client accept new reverse udp %s %s -> %s", id, r.Id(), r.TargetAddr)
+
+	go p.RecvReverseUdp(clientConn)
+	return clientConn
+}
+
+func (p *Client) AcceptReverseTcpConn(clientConn *ClientConn, r *ReverseConfig) {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	tcpaddrTarget, err := net.ResolveTCPAddr("tcp", r.TargetAddr)
+	if err != nil {
+		loggo.Info("reverse tcp ResolveTCPAddr fail: %s %s", r.TargetAddr, err.Error())
+		p.close(clientConn)
+		p.remoteError(clientConn.id)
+		return
+	}
+
+	conn, err := net.DialTCP("tcp", nil, tcpaddrTarget)
+	if err != nil {
+		loggo.Info("reverse tcp DialTCP fail: %s %s", r.TargetAddr, err.Error())
+		p.close(clientConn)
+		p.remoteError(clientConn.id)
+		return
+	}
+
+	clientConn.tcpaddr = tcpaddrTarget
+	loggo.Info("client connected reverse tcp %s %s", clientConn.id, r.TargetAddr)
+
+	p.transferTcpConn(conn, clientConn, "")
+}
+
+func (p *Client) RecvReverseUdp(clientConn *ClientConn) {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	bytes := make([]byte, UDP_FRAG_MAX_DATAGRAM)
+
+	for clientConn.ctx.Err() == nil {
+		clientConn.reverseConn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, err := clientConn.reverseConn.Read(bytes)
+		if err != nil {
+			nerr, ok := err.(net.Error)
+			if !ok || !nerr.Timeout() {
+				if clientConn.ctx.Err() == nil {
+					loggo.Info("Error read reverse udp %s %s", clientConn.id, err)
+					clientConn.close.Store(true)
+				}
+				return
+			}
+		}
+		if n <= 0 {
+			continue
+		}
+
+		now := time.Now()
+		clientConn.activeSendTime.Store(now)
+
+		settings := p.settings.Load()
+		sendICMPUDP(p.id, p.nextSequence(), *p.conn, p.ipaddrServer.Load(), "", clientConn.id, bytes[:n],
+			SEND_PROTO, RECV_PROTO, settings.Key, settings.Timeout, UDP_MODE_CONNECTED, p.cryptoConfig.Load())
+		p.sendPacket.Add(1)
+		p.sendPacketSize.Add((uint64)(n))
+		p.touchActivity()
+	}
+}
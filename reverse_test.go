@@ -0,0 +1,108 @@
+package pingtunnel
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseReverseSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantLen int
+		wantErr bool
+	}{
+		{
+			name:    "empty string returns nil",
+			input:   "",
+			wantLen: 0,
+		},
+		{
+			name:    "single tcp reverse",
+			input:   "tcp/0.0.0.0:8080/127.0.0.1:80",
+			wantLen: 1,
+		},
+		{
+			name:    "tcp and udp reverse",
+			input:   "tcp/0.0.0.0:8080/127.0.0.1:80, udp/:5353/127.0.0.1:53",
+			wantLen: 2,
+		},
+		{
+			name:    "ipv6 addresses",
+			input:   "tcp/[::]:8080/[::1]:80",
+			wantLen: 1,
+		},
+		{
+			name:    "unsupported network",
+			input:   "icmp/0.0.0.0:8080/127.0.0.1:80",
+			wantErr: true,
+		},
+		{
+			name:    "missing target",
+			input:   "tcp/0.0.0.0:8080",
+			wantErr: true,
+		},
+		{
+			name:    "invalid listen address",
+			input:   "tcp/8080/127.0.0.1:80",
+			wantErr: true,
+		},
+		{
+			name:    "duplicate listen address",
+			input:   "tcp/:8080/127.0.0.1:80,tcp/:8080/127.0.0.1:81",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseReverseSpec(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseReverseSpec(%q) expected error, got nil", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("ParseReverseSpec(%q) unexpected error: %v", tt.input, err)
+				return
+			}
+			if len(got) != tt.wantLen {
+				t.Errorf("ParseReverseSpec(%q) len = %d, want %d", tt.input, len(got), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestReverseConfigId(t *testing.T) {
+	r := &ReverseConfig{Network: "udp", ListenAddr: ":5353", TargetAddr: "127.0.0.1:53"}
+	if r.Id() != "udp/:5353" {
+		t.Errorf("Id() = %q, want %q", r.Id(), "udp/:5353")
+	}
+}
+
+func TestCloseReverseUDP(t *testing.T) {
+	s, err := NewServer("", 0, 0, 0, 0, 1000, nil, nil, 1, 0, nil, "", nil, nil, nil, 0)
+	if err != nil {
+		t.Fatalf("NewServer unexpected error: %v", err)
+	}
+	r := &ServerReverse{id: "udp/:5353"}
+	s.reverseMap.Store(r.id, r)
+
+	src := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5353}
+	conn := &ServerConn{id: "a", ipaddrTarget: src, reverseId: r.id, reverseUDPConn: &net.UDPConn{}}
+	s.addServerConn(conn.id, conn, serverPeer{})
+	r.udpConnMap.Store(src.String(), conn.id)
+	s.close(conn)
+	if _, ok := r.udpConnMap.Load(src.String()); ok {
+		t.Errorf("closed session still maps %s", src)
+	}
+
+	// a session that took the source over keeps it
+	s.addServerConn(conn.id, conn, serverPeer{})
+	r.udpConnMap.Store(src.String(), "b")
+	s.close(conn)
+	if v, _ := r.udpConnMap.Load(src.String()); v != "b" {
+		t.Errorf("%s maps %v after an older session closed, want b", src, v)
+	}
+}
@@ -0,0 +1,313 @@
+package pingtunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/esrrhs/gohome/thirdparty"
+)
+
+const (
+	ROUTE_ACTION_TUNNEL = "tunnel"
+	ROUTE_ACTION_DIRECT = "direct"
+	ROUTE_ACTION_REJECT = "reject"
+	ROUTE_ACTION_SERVER = "server"
+	ROUTE_ACTION_PROXY  = "proxy"
+
+	ROUTE_DOMAIN         = "DOMAIN"
+	ROUTE_DOMAIN_SUFFIX  = "DOMAIN-SUFFIX"
+	ROUTE_DOMAIN_KEYWORD = "DOMAIN-KEYWORD"
+	ROUTE_DOMAIN_REGEX   = "DOMAIN-REGEX"
+	ROUTE_IP_CIDR        = "IP-CIDR"
+	ROUTE_GEOIP          = "GEOIP"
+	ROUTE_DST_PORT       = "DST-PORT"
+	ROUTE_NETWORK        = "NETWORK"
+	ROUTE_FINAL          = "FINAL"
+)
+
+// RouteRule is one line of a route file: TYPE,VALUE,ACTION, or FINAL,ACTION.
+type RouteRule struct {
+	Type   string
+	Value  string
+	Action string
+	Server *net.IPAddr // used by ROUTE_ACTION_SERVER
+	Proxy  string      // upstream name, used by ROUTE_ACTION_PROXY
+	Line   int
+
+	regex  *regexp.Regexp
+	ipnet  *net.IPNet
+	portLo int
+	portHi int
+	hits   uint64
+}
+
+// Hits returns how many sessions the rule has matched.
+func (r *RouteRule) Hits() uint64 {
+	return atomic.LoadUint64(&r.hits)
+}
+
+func (r *RouteRule) String() string {
+	action := r.Action
+	if r.Action == ROUTE_ACTION_PROXY {
+		action += ":" + r.Proxy
+	}
+	if r.Type == ROUTE_FINAL {
+		return r.Type + "," + action
+	}
+	return r.Type + "," + r.Value + "," + action
+}
+
+// RouteTable is an ordered rule list, the first matching rule wins. Sessions
+// no rule matches go through the tunnel.
+type RouteTable struct {
+	Rules []*RouteRule
+}
+
+// LoadRouteFile reads a route file, one rule per line, # starts a comment:
+//
+//	DOMAIN-SUFFIX,lan,direct
+//	DOMAIN-KEYWORD,ads,reject
+//	IP-CIDR,10.0.0.0/8,direct
+//	GEOIP,CN,direct
+//	DST-PORT,6881-6889,reject
+//	NETWORK,udp,server:backup.example.com
+//	FINAL,tunnel
+func LoadRouteFile(path string) (*RouteTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRouteRules(f)
+}
+
+func ParseRouteRules(r io.Reader) (*RouteTable, error) {
+	t := &RouteTable{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		rule, err := parseRouteRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("route line %d: %w", line, err)
+		}
+		rule.Line = line
+		t.Rules = append(t.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func parseRouteRule(text string) (*RouteRule, error) {
+	parts := strings.Split(text, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+
+	r := &RouteRule{Type: strings.ToUpper(parts[0])}
+	var action string
+	if r.Type == ROUTE_FINAL || r.Type == "MATCH" {
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rule %q (expected FINAL,action)", text)
+		}
+		r.Type = ROUTE_FINAL
+		action = parts[1]
+	} else {
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid rule %q (expected type,value,action)", text)
+		}
+		r.Value = parts[1]
+		action = parts[2]
+	}
+
+	switch r.Type {
+	case ROUTE_FINAL:
+	case ROUTE_DOMAIN, ROUTE_DOMAIN_SUFFIX, ROUTE_DOMAIN_KEYWORD:
+		r.Value = strings.ToLower(strings.TrimSuffix(r.Value, "."))
+		if r.Value == "" {
+			return nil, fmt.Errorf("empty domain in %q", text)
+		}
+	case ROUTE_DOMAIN_REGEX:
+		re, err := regexp.Compile(r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", r.Value, err)
+		}
+		r.regex = re
+	case ROUTE_IP_CIDR, "IP-CIDR6":
+		r.Type = ROUTE_IP_CIDR
+		_, ipnet, err := net.ParseCIDR(r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", r.Value, err)
+		}
+		r.ipnet = ipnet
+	case ROUTE_GEOIP:
+		r.Value = strings.ToUpper(r.Value)
+	case ROUTE_DST_PORT:
+		lo, hi, ok := strings.Cut(r.Value, "-")
+		if !ok {
+			hi = lo
+		}
+		var err1, err2 error
+		r.portLo, err1 = strconv.Atoi(lo)
+		r.portHi, err2 = strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || r.portLo < 0 || r.portHi > 65535 || r.portLo > r.portHi {
+			return nil, fmt.Errorf("invalid port %q", r.Value)
+		}
+	case ROUTE_NETWORK:
+		r.Value = strings.ToLower(r.Value)
+		if r.Value != "tcp" && r.Value != "udp" {
+			return nil, fmt.Errorf("invalid network %q (supported: tcp, udp)", r.Value)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported rule type %q", parts[0])
+	}
+
+	switch {
+	case action == ROUTE_ACTION_TUNNEL, action == ROUTE_ACTION_DIRECT, action == ROUTE_ACTION_REJECT:
+		r.Action = action
+	case strings.HasPrefix(action, ROUTE_ACTION_SERVER+":"):
+		server := strings.TrimPrefix(action, ROUTE_ACTION_SERVER+":")
+		addr, err := net.ResolveIPAddr("ip", server)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server %q: %w", server, err)
+		}
+		r.Action = ROUTE_ACTION_SERVER
+		r.Server = addr
+	case strings.HasPrefix(action, ROUTE_ACTION_PROXY+":"):
+		r.Proxy = strings.TrimPrefix(action, ROUTE_ACTION_PROXY+":")
+		if r.Proxy == "" {
+			return nil, fmt.Errorf("empty proxy name in %q", text)
+		}
+		r.Action = ROUTE_ACTION_PROXY
+	default:
+		return nil, fmt.Errorf("unsupported action %q (supported: tunnel, direct, reject, server:HOST, proxy:NAME)", action)
+	}
+	return r, nil
+}
+
+// CheckActions fails on the first rule whose action is not in actions, as
+// the client and the server each only handle some of them.
+func (t *RouteTable) CheckActions(actions ...string) error {
+	for _, r := range t.Rules {
+		ok := false
+		for _, action := range actions {
+			if r.Action == action {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("route line %d: action %q is not supported here", r.Line, r.Action)
+		}
+	}
+	return nil
+}
+
+// NeedGeoip reports whether the table has GEOIP rules.
+func (t *RouteTable) NeedGeoip() bool {
+	for _, r := range t.Rules {
+		if r.Type == ROUTE_GEOIP {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the first rule matching a session to addr, or nil. Domain
+// names are only resolved, with resolve, once an IP rule is reached.
+func (t *RouteTable) Match(network string, addr string, resolve func(host string) (net.IP, error)) *RouteRule {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	port, _ := strconv.Atoi(portStr)
+	domain := ""
+	ip := net.ParseIP(host)
+	if ip == nil {
+		domain = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	resolved := ip != nil
+
+	for _, r := range t.Rules {
+		matched := false
+		switch r.Type {
+		case ROUTE_FINAL:
+			matched = true
+		case ROUTE_DOMAIN:
+			matched = domain != "" && domain == r.Value
+		case ROUTE_DOMAIN_SUFFIX:
+			matched = domain != "" && (domain == r.Value || strings.HasSuffix(domain, "."+r.Value))
+		case ROUTE_DOMAIN_KEYWORD:
+			matched = domain != "" && strings.Contains(domain, r.Value)
+		case ROUTE_DOMAIN_REGEX:
+			matched = domain != "" && r.regex.MatchString(domain)
+		case ROUTE_DST_PORT:
+			matched = port >= r.portLo && port <= r.portHi
+		case ROUTE_NETWORK:
+			matched = network == r.Value
+		case ROUTE_IP_CIDR, ROUTE_GEOIP:
+			if !resolved {
+				resolved = true
+				if resolve != nil {
+					ip, err = resolve(host)
+					if err != nil {
+						loggo.Info("route resolve %s fail: %s", host, err)
+						ip = nil
+					}
+				}
+			}
+			if ip == nil {
+				break
+			}
+			if r.Type == ROUTE_IP_CIDR {
+				matched = r.ipnet.Contains(ip)
+			} else {
+				code, err := thirdparty.GetGeoipCountryIsoCode(ip.String())
+				matched = err == nil && strings.ToUpper(code) == r.Value
+			}
+		}
+		if matched {
+			atomic.AddUint64(&r.hits, 1)
+			return r
+		}
+	}
+	return nil
+}
+
+// ShowHits logs the hit counters of the rules that matched at least once.
+func (t *RouteTable) ShowHits() {
+	for _, r := range t.Rules {
+		if hits := r.Hits(); hits > 0 {
+			loggo.Info("route rule line %d %s hits %d", r.Line, r.String(), hits)
+		}
+	}
+}
+
+// String returns the rules one per line, so a reload can tell whether the
+// file changed.
+func (t *RouteTable) String() string {
+	lines := make([]string, 0, len(t.Rules))
+	for _, r := range t.Rules {
+		lines = append(lines, r.String())
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,117 @@
+package pingtunnel
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseRouteRules(t *testing.T) {
+	spec := `
+# comment
+DOMAIN,Example.com,direct
+domain-suffix,lan,direct   # trailing comment
+DOMAIN-KEYWORD,ads,reject
+DOMAIN-REGEX,^api[0-9]+\.test$,tunnel
+IP-CIDR,10.0.0.0/8,direct
+GEOIP,cn,direct
+DST-PORT,6881-6889,reject
+NETWORK,udp,server:127.0.0.1
+FINAL,tunnel
+`
+	table, err := ParseRouteRules(strings.NewReader(spec))
+	if err != nil {
+		t.Fatalf("ParseRouteRules unexpected error: %v", err)
+	}
+	if len(table.Rules) != 9 {
+		t.Fatalf("ParseRouteRules returned %d rules, want 9", len(table.Rules))
+	}
+	if table.Rules[0].Value != "example.com" || table.Rules[0].Line != 3 {
+		t.Errorf("rule 0 = %+v", table.Rules[0])
+	}
+	if table.Rules[7].Action != ROUTE_ACTION_SERVER || table.Rules[7].Server.String() != "127.0.0.1" {
+		t.Errorf("rule 7 = %+v", table.Rules[7])
+	}
+	if !table.NeedGeoip() {
+		t.Error("NeedGeoip() = false, want true")
+	}
+	if got := strings.Split(table.String(), "\n"); len(got) != 9 || got[1] != "DOMAIN-SUFFIX,lan,direct" {
+		t.Errorf("String() = %q", table.String())
+	}
+
+	invalid := []string{
+		"DOMAIN,example.com",
+		"DOMAIN,example.com,proxy",
+		"IP-CIDR,10.0.0.1,direct",
+		"DOMAIN-REGEX,[,direct",
+		"DST-PORT,90-80,direct",
+		"NETWORK,icmp,direct",
+		"SRC-IP,1.2.3.4,direct",
+		"FINAL,tunnel,extra",
+	}
+	for _, line := range invalid {
+		if _, err := ParseRouteRules(strings.NewReader(line)); err == nil {
+			t.Errorf("ParseRouteRules(%q) expected error, got none", line)
+		}
+	}
+}
+
+func TestRouteTableMatch(t *testing.T) {
+	spec := `
+DOMAIN,example.com,direct
+DOMAIN-SUFFIX,lan,direct
+DOMAIN-KEYWORD,ads,reject
+DOMAIN-REGEX,^api[0-9]+\.test$,direct
+DST-PORT,6881-6889,reject
+NETWORK,udp,direct
+IP-CIDR,192.168.0.0/16,direct
+`
+	table, err := ParseRouteRules(strings.NewReader(spec))
+	if err != nil {
+		t.Fatalf("ParseRouteRules unexpected error: %v", err)
+	}
+
+	// failed lookups are logged, keep the log files out of the tree
+	t.Chdir(t.TempDir())
+
+	resolve := func(host string) (net.IP, error) {
+		if host == "printer.home" {
+			return net.ParseIP("192.168.1.20"), nil
+		}
+		return nil, errors.New("not found")
+	}
+
+	tests := []struct {
+		network string
+		addr    string
+		line    int
+	}{
+		{"tcp", "example.com:443", 2},
+		{"tcp", "www.example.com:443", 0},
+		{"tcp", "nas.lan:80", 3},
+		{"tcp", "lan:80", 3},
+		{"tcp", "myads.net:80", 4},
+		{"tcp", "api12.test:80", 5},
+		{"tcp", "api.test:80", 0},
+		{"tcp", "1.2.3.4:6885", 6},
+		{"udp", "1.2.3.4:53", 7},
+		{"tcp", "192.168.3.3:22", 8},
+		{"tcp", "printer.home:631", 8},
+		{"tcp", "unknown.home:80", 0},
+	}
+	for _, test := range tests {
+		r := table.Match(test.network, test.addr, resolve)
+		line := 0
+		if r != nil {
+			line = r.Line
+		}
+		if line != test.line {
+			t.Errorf("Match(%s, %s) matched line %d, want %d", test.network, test.addr, line, test.line)
+		}
+	}
+
+	if hits := table.Rules[6].Hits(); hits != 2 {
+		t.Errorf("IP-CIDR rule hits = %d, want 2", hits)
+	}
+}
@@ -0,0 +1,85 @@
+package pingtunnel
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variables read when neither the flag nor the key file is set,
+// so keys stay out of ps and shell history.
+const (
+	KEY_ENV         = "PINGTUNNEL_KEY"
+	ENCRYPT_KEY_ENV = "PINGTUNNEL_ENCRYPT_KEY"
+)
+
+// ParseKeys parses tunnel keys separated by newlines or commas. The first key
+// is the primary one, lines starting with # are comments.
+func ParseKeys(s string) ([]int, error) {
+	var keys []int
+	for _, line := range secretLines(s) {
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			key, err := strconv.Atoi(field)
+			if err != nil || key < 0 || key > math.MaxInt32 {
+				return nil, fmt.Errorf("invalid key %q, must be a number between 0-2147483647", field)
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no key found")
+	}
+	return keys, nil
+}
+
+// ParseEncryptKeys parses encryption keys, one per line as passphrases may
+// contain commas. The first key is the primary one.
+func ParseEncryptKeys(s string) ([]string, error) {
+	keys := secretLines(s)
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption key found")
+	}
+	return keys, nil
+}
+
+// acceptKey reports whether key is primary or one of the keys accepted
+// besides it while keys are rotated.
+func acceptKey(key int32, primary int, others []int) bool {
+	if key == (int32)(primary) {
+		return true
+	}
+	for _, k := range others {
+		if key == (int32)(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadSecretFile reads a key file for ParseKeys or ParseEncryptKeys.
+func ReadSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func secretLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,70 @@
+package pingtunnel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []int
+	}{
+		{"123456", []int{123456}},
+		{"123456\n", []int{123456}},
+		{"2,1", []int{2, 1}},
+		{"# new key first\n2\n\n1\n", []int{2, 1}},
+		{" 3 , 4 \r\n5", []int{3, 4, 5}},
+		{"2147483647", []int{2147483647}},
+	}
+	for _, tt := range tests {
+		got, err := ParseKeys(tt.input)
+		if err != nil {
+			t.Errorf("ParseKeys(%q) unexpected error: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseKeys(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+
+	invalid := []string{"", "# only a comment\n", "abc", "1,x", "-1", "2147483648"}
+	for _, input := range invalid {
+		if _, err := ParseKeys(input); err == nil {
+			t.Errorf("ParseKeys(%q) expected error, got none", input)
+		}
+	}
+}
+
+func TestParseEncryptKeys(t *testing.T) {
+	got, err := ParseEncryptKeys("# rotation\nnew, passphrase\n\nMTIzNDU2Nzg5MDEyMzQ1Ng==\n")
+	if err != nil {
+		t.Fatalf("ParseEncryptKeys unexpected error: %v", err)
+	}
+	want := []string{"new, passphrase", "MTIzNDU2Nzg5MDEyMzQ1Ng=="}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseEncryptKeys = %q, want %q", got, want)
+	}
+
+	if _, err := ParseEncryptKeys("\n# nothing\n"); err == nil {
+		t.Errorf("ParseEncryptKeys(empty) expected error, got none")
+	}
+}
+
+func TestAcceptKey(t *testing.T) {
+	tests := []struct {
+		key    int32
+		others []int
+		want   bool
+	}{
+		{2, nil, true},
+		{1, nil, false},
+		{1, []int{1}, true},
+		{3, []int{1}, false},
+	}
+	for _, tt := range tests {
+		if got := acceptKey(tt.key, 2, tt.others); got != tt.want {
+			t.Errorf("acceptKey(%d, 2, %v) = %v, want %v", tt.key, tt.others, got, tt.want)
+		}
+	}
+}
@@ -1,35 +1,64 @@
 package pingtunnel
 
 import (
+	"container/list"
+	"context"
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/loggo"
 	"github.com/esrrhs/gohome/network"
 	"github.com/esrrhs/gohome/thread"
 	"golang.org/x/net/icmp"
 	"google.golang.org/protobuf/proto"
+	"io"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-func NewServer(icmpAddr string, key int, maxconn int, maxprocessthread int, maxprocessbuffer int, connecttmeout int, cryptoConfig *CryptoConfig, forwardConfig *ForwardConfig) (*Server, error) {
+func NewServer(icmpAddr string, key int, maxconn int, maxprocessthread int, maxprocessbuffer int, connecttmeout int, cryptoConfig *CryptoConfig, forwardConfig *ForwardConfig,
+	reverseallow int, bindallow int, tun *TunConfig, dnsUpstream string, route *ServerRoute, resolver *Resolver, acceptKeys []int,
+	decryptthread int) (*Server, error) {
+	if dnsUpstream == "" {
+		dnsUpstream = systemNameserver()
+	}
+	if resolver == nil {
+		var err error
+		resolver, err = NewResolver(nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	s := &Server{
 		icmpAddr:         icmpAddr,
-		exit:             false,
-		key:              key,
-		maxconn:          maxconn,
 		maxprocessthread: maxprocessthread,
 		maxprocessbuffer: maxprocessbuffer,
-		connecttmeout:    connecttmeout,
+		decryptthread:    decryptthread,
 		cryptoConfig:     cryptoConfig,
-		forwardConfig:    forwardConfig,
+		resolver:         resolver,
+		tun:              tun,
+		dnsUpstream:      dnsUpstream,
+		dnsWorker:        make(chan struct{}, DNS_MAX_WORKERS),
+		frag:             newFragAssembler(UDP_FRAG_MAX_BUFFER),
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.settings.Store(&ServerSettings{
+		Key:            key,
+		AcceptKeys:     acceptKeys,
+		MaxConn:        maxconn,
+		ConnectTimeout: connecttmeout,
+		ReverseAllow:   reverseallow,
+		BindAllow:      bindallow,
+		Forward:        forwardConfig,
+		Route:          route,
+	})
 
 	if maxprocessthread > 0 {
 		s.processtp = thread.NewThreadPool(maxprocessthread, maxprocessbuffer, func(v interface{}) {
 			packet := v.(*Packet)
-			s.processDataPacket(packet)
+			s.processSessionPacket(packet)
 		})
 	}
 
@@ -37,35 +66,45 @@ func NewServer(icmpAddr string, key int, maxconn int, maxprocessthread int, maxp
 }
 
 type Server struct {
-	exit             bool
-	key              int
+	ctx              context.Context
+	cancel           context.CancelFunc
+	draining         atomic.Bool
+	settings         atomic.Pointer[ServerSettings] // replaced whole by Reload
 	workResultLock   sync.WaitGroup
-	maxconn          int
 	maxprocessthread int
 	maxprocessbuffer int
-	connecttmeout    int
+	decryptthread    int
 	cryptoConfig     *CryptoConfig
-	forwardConfig    *ForwardConfig
+	resolver         *Resolver
+	tun              *TunConfig
+	dnsUpstream      string
+	dnsWorker        chan struct{}
+	frag             *fragAssembler
 
 	icmpAddr string
 
+	tunDev *os.File
+
 	conn *icmp.PacketConn
 
 	localConnMap sync.Map
 	connErrorMap sync.Map
+	reverseMap   sync.Map
+	tunPeerMap   sync.Map
+	bindMap      sync.Map
 
-	sendPacket       uint64
-	recvPacket       uint64
-	sendPacketSize   uint64
-	recvPacketSize   uint64
-	localConnMapSize int
+	sendPacket       atomic.Uint64
+	recvPacket       atomic.Uint64
+	sendPacketSize   atomic.Uint64
+	recvPacketSize   atomic.Uint64
+	localConnMapSize atomic.Int64
 
-	processtp   *thread.ThreadPool
-	recvcontrol chan int
+	processtp *thread.ThreadPool
 }
 
 type ServerConn struct {
-	exit           bool
+	ctx            context.Context
+	cancel         context.CancelFunc
 	timeout        int
 	ipaddrTarget   *net.UDPAddr
 	conn           *net.UDPConn
@@ -73,17 +112,22 @@ type ServerConn struct {
 	udpRelayAddr   *net.UDPAddr
 	udpViaProxy    bool
 	tcpaddrTarget  *net.TCPAddr
+	tcpTargetAddr  string
 	tcpconn        net.Conn // Changed from *net.TCPConn to support proxy connections
 	id             string
-	activeRecvTime time.Time
-	activeSendTime time.Time
-	close          bool
-	rproto         int
+	activeRecvTime atomicTime
+	activeSendTime atomicTime
+	close          atomic.Bool
 	fm             *network.FrameMgr
+	clock          *frameClock
 	tcpmode        int
-	echoId         int
-	echoSeq        int
 	activity       chan struct{}
+	reverseId      string
+	reverseUDPConn *net.UDPConn
+	udpFullCone    bool
+	udpAddrCache   map[string]*net.UDPAddr
+	udpRouteCache  map[string]bool // full-cone target -> allowed by the route
+	peer           sharedPeer      // the client and what its latest packet was sent with
 }
 
 func (p *Server) Run() error {
@@ -95,9 +139,19 @@ func (p *Server) Run() error {
 	}
 	p.conn = conn
 
+	if p.tun != nil {
+		tunDev, err := openTunDevice(p.tun, "")
+		if err != nil {
+			loggo.Error("Error open tun: %s", err.Error())
+			p.conn.Close()
+			return err
+		}
+		p.tunDev = tunDev
+		go p.RecvTun()
+	}
+
 	recv := make(chan *Packet, 10000)
-	p.recvcontrol = make(chan int, 1)
-	go recvICMP(&p.workResultLock, &p.exit, *p.conn, recv, p.cryptoConfig)
+	go recvICMP(p.ctx, &p.workResultLock, *p.conn, recv, p.cryptoConfig, p.decryptthread)
 
 	go func() {
 		defer common.CrashLog()
@@ -105,11 +159,25 @@ func (p *Server) Run() error {
 		p.workResultLock.Add(1)
 		defer p.workResultLock.Done()
 
-		for !p.exit {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		nextRouteStatAt := time.Now().Add(time.Minute)
+		for {
 			p.checkTimeoutConn()
+			p.checkTimeoutReverse()
+			p.checkTimeoutTun()
 			p.showNet()
 			p.updateConnError()
-			time.Sleep(time.Second)
+			if route := p.settings.Load().Route; route != nil && time.Now().After(nextRouteStatAt) {
+				route.Table.ShowHits()
+				nextRouteStatAt = time.Now().Add(time.Minute)
+			}
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-ticker.C:
+			}
 		}
 	}()
 
@@ -119,9 +187,9 @@ func (p *Server) Run() error {
 		p.workResultLock.Add(1)
 		defer p.workResultLock.Done()
 
-		for !p.exit {
+		for {
 			select {
-			case <-p.recvcontrol:
+			case <-p.ctx.Done():
 				return
 			case r := <-recv:
 				p.processPacket(r)
@@ -133,62 +201,177 @@ func (p *Server) Run() error {
 }
 
 func (p *Server) Stop() {
-	p.exit = true
-	p.recvcontrol <- 1
+	p.cancel()
+	p.closeListeners()
 	p.workResultLock.Wait()
-	p.processtp.Stop()
+	if p.processtp != nil {
+		p.processtp.Stop()
+	}
 	p.conn.Close()
+	if p.tunDev != nil {
+		closeTunDevice(p.tun, p.tunDev, "")
+	}
+}
+
+// Shutdown stops taking new sessions and ends the live ones: tcp sessions send
+// their queued data and a close frame, udp sessions are kicked. It waits up to
+// drain for them to finish and then stops the server.
+func (p *Server) Shutdown(drain time.Duration) ShutdownStats {
+	begin := time.Now()
+	p.draining.Store(true)
+	p.closeListeners()
+
+	stats := ShutdownStats{}
+	p.localConnMap.Range(func(key, value interface{}) bool {
+		conn := value.(*ServerConn)
+		stats.Sessions++
+		if conn.tcpmode > 0 {
+			// RecvTCP sees draining and closes the frame manager
+			notifyActivity(conn.activity)
+			return true
+		}
+		p.kickShutdown(conn)
+		return true
+	})
+	loggo.Info("server draining %d sessions", stats.Sessions)
+
+	stats.Remaining = waitDrained(drain, p.connCount)
+	// a half closed peer may never finish, kick what is left so it does not
+	// wait for its own timeout
+	p.localConnMap.Range(func(key, value interface{}) bool {
+		p.kickShutdown(value.(*ServerConn))
+		return true
+	})
+	p.Stop()
+	stats.Elapsed = time.Since(begin)
+	return stats
+}
+
+func (p *Server) kickShutdown(conn *ServerConn) {
+	if peer := conn.peer.Load(); peer.src != nil {
+		p.remoteError(peer.echoId, peer.echoSeq, conn.id, peer.rproto, peer.key, peer.crypto, peer.src, KICK_REASON_SHUTDOWN)
+	}
+	p.close(conn)
+}
+
+func (p *Server) closeListeners() {
+	p.reverseMap.Range(func(key, value interface{}) bool {
+		p.closeReverse(value.(*ServerReverse))
+		return true
+	})
+	p.closeBind()
 }
 
 func (p *Server) processPacket(packet *Packet) {
 
-	if packet.my.Key != (int32)(p.key) {
+	// a reply of a server, e.g. our own with the client on this host
+	if packet.my.Rproto < 0 {
 		return
 	}
 
+	if settings := p.settings.Load(); !acceptKey(packet.my.Key, settings.Key, settings.AcceptKeys) {
+		return
+	}
+
+	if packet.my.FragCount > 1 {
+		data := p.frag.add(packet.my.Id, packet.my.FragId, (int)(packet.my.FragIndex), (int)(packet.my.FragCount), packet.my.Data, time.Now())
+		if data == nil {
+			return
+		}
+		packet.my.Data = data
+	}
+
 	if packet.my.Type == (int32)(MyMsg_PING) {
 		t := time.Time{}
 		t.UnmarshalBinary(packet.my.Data)
 		loggo.Info("ping from %s %s %d %d %d", packet.src.String(), t.String(), packet.my.Rproto, packet.echoId, packet.echoSeq)
 		sendICMP(packet.echoId, packet.echoSeq, *p.conn, packet.src, "", "", (uint32)(MyMsg_PING), packet.my.Data,
-			(int)(packet.my.Rproto), -1, p.key,
+			(int)(packet.my.Rproto), -1, (int)(packet.my.Key),
 			0, 0, 0, 0, 0, 0,
-			0, p.cryptoConfig)
+			0, packet.crypto)
 		return
 	}
 
-	if packet.my.Type == (int32)(MyMsg_KICK) {
-		localConn := p.getServerConnById(packet.my.Id)
-		if localConn != nil {
-			p.close(localConn)
-			loggo.Info("remote kick local %s", packet.my.Id)
-		}
+	if packet.my.Type == (int32)(MyMsg_REVERSE) {
+		p.processReversePacket(packet)
+		return
+	}
+
+	if packet.my.Type == (int32)(MyMsg_TUN) {
+		p.processTunPacket(packet)
+		return
+	}
+
+	if packet.my.Type == (int32)(MyMsg_DNS) {
+		p.processDnsPacket(packet)
 		return
 	}
 
+	// a session's KICK and BIND go through its shard like its data, behind
+	// the frames that came before them
 	if p.maxprocessthread > 0 {
 		p.processtp.AddJob((int)(common.HashString(packet.my.Id)), packet)
 	} else {
+		p.processSessionPacket(packet)
+	}
+}
+
+func (p *Server) processSessionPacket(packet *Packet) {
+	switch packet.my.Type {
+	case (int32)(MyMsg_BIND):
+		p.processBindPacket(packet)
+	case (int32)(MyMsg_KICK):
+		p.processKick(packet)
+	default:
 		p.processDataPacket(packet)
 	}
 }
 
-func (p *Server) processDataPacketNewConn(id string, packet *Packet) *ServerConn {
+func (p *Server) processKick(packet *Packet) {
+	localConn := p.getServerConnById(packet.my.Id)
+	if localConn != nil {
+		p.close(localConn)
+		loggo.Info("remote kick local %s", packet.my.Id)
+	}
+}
 
-	now := common.GetNowUpdateInSecond()
+func (p *Server) processDataPacketNewConn(id string, packet *Packet) *ServerConn {
 
 	loggo.Info("start add new connect  %s %s", id, packet.my.Target)
 
-	if p.maxconn > 0 && p.localConnMapSize >= p.maxconn {
-		loggo.Info("too many connections %d, server connected target fail %s", p.localConnMapSize, packet.my.Target)
-		p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), packet.src)
+	if p.draining.Load() {
+		loggo.Info("shutting down, server refuse new connect %s %s", id, packet.my.Target)
+		p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), (int)(packet.my.Key), packet.crypto, packet.src, KICK_REASON_SHUTDOWN)
+		return nil
+	}
+
+	settings := p.settings.Load()
+	if settings.MaxConn > 0 && (int)(p.localConnMapSize.Load()) >= settings.MaxConn {
+		loggo.Info("too many connections %d, server connected target fail %s", p.localConnMapSize.Load(), packet.my.Target)
+		p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), (int)(packet.my.Key), packet.crypto, packet.src, KICK_REASON_TOO_MANY)
 		return nil
 	}
 
 	addr := packet.my.Target
-	if p.isConnError(addr) {
+	if addr == "" {
+		loggo.Info("missing target for new connect %s", id)
+		p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), (int)(packet.my.Key), packet.crypto, packet.src, KICK_REASON_NONE)
+		return nil
+	}
+	if reason, ok := p.isConnError(addr); ok {
 		loggo.Info("addr connect Error before: %s %s", id, addr)
-		p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), packet.src)
+		p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), (int)(packet.my.Key), packet.crypto, packet.src, reason)
+		return nil
+	}
+
+	proto := "udp"
+	if packet.my.Tcpmode > 0 {
+		proto = "tcp"
+	}
+	upstream, ips, ok := p.routeUpstream(settings, proto, addr)
+	if !ok {
+		loggo.Info("server route reject %s %s %s", id, proto, addr)
+		p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), (int)(packet.my.Key), packet.crypto, packet.src, KICK_REASON_DENIED)
 		return nil
 	}
 
@@ -196,106 +379,156 @@ func (p *Server) processDataPacketNewConn(id string, packet *Packet) *ServerConn
 
 		var c net.Conn
 		var err error
-		if p.forwardConfig != nil {
-			c, err = DialThroughProxy(p.forwardConfig, addr, time.Millisecond*time.Duration(p.connecttmeout))
+		if upstream != nil {
+			c, err = DialThroughProxy(upstream, addr, time.Millisecond*time.Duration(settings.ConnectTimeout))
+		} else if ips != nil {
+			c, err = p.resolver.DialTCPIPs(addr, ips, time.Millisecond*time.Duration(settings.ConnectTimeout))
 		} else {
-			c, err = net.DialTimeout("tcp", addr, time.Millisecond*time.Duration(p.connecttmeout))
+			c, err = p.resolver.DialTCP(addr, time.Millisecond*time.Duration(settings.ConnectTimeout))
 		}
 		if err != nil {
 			loggo.Error("Error listening for tcp packets: %s %s", id, err.Error())
-			p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), packet.src)
-			p.addConnError(addr)
+			reason := dialErrorReason(err)
+			p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), (int)(packet.my.Key), packet.crypto, packet.src, reason)
+			p.addConnError(addr, reason)
 			return nil
 		}
-		// For proxy connections, parse target address; for direct connections, get from remote addr
+		// The proxy resolves the target itself, only direct connections know the address
 		var ipaddrTarget *net.TCPAddr
-		if p.forwardConfig != nil {
-			// When using proxy, resolve the original target address
-			ipaddrTarget, _ = net.ResolveTCPAddr("tcp", addr)
-		} else {
+		if upstream == nil {
 			ipaddrTarget = c.RemoteAddr().(*net.TCPAddr)
 		}
 
 		fm := network.NewFrameMgr(FRAME_MAX_SIZE, FRAME_MAX_ID, (int)(packet.my.TcpmodeBuffersize), (int)(packet.my.TcpmodeMaxwin), (int)(packet.my.TcpmodeResendTimems), (int)(packet.my.TcpmodeCompress),
 			(int)(packet.my.TcpmodeStat))
 
-		localConn := &ServerConn{exit: false, timeout: (int)(packet.my.Timeout), tcpconn: c, tcpaddrTarget: ipaddrTarget, id: id, activeRecvTime: now, activeSendTime: now, close: false,
-			rproto: (int)(packet.my.Rproto), fm: fm, tcpmode: (int)(packet.my.Tcpmode), activity: make(chan struct{}, 1)}
+		localConn := &ServerConn{timeout: (int)(packet.my.Timeout), tcpconn: c, tcpaddrTarget: ipaddrTarget, tcpTargetAddr: addr, id: id,
+			fm: fm, clock: newFrameClock((int)(packet.my.TcpmodeResendTimems)),
+			tcpmode: (int)(packet.my.Tcpmode), activity: make(chan struct{}, 1)}
 
-		p.addServerConn(id, localConn)
+		p.addServerConn(id, localConn, packetPeer(packet))
 
 		go p.RecvTCP(localConn, id, packet.src)
 		return localConn
 
 	} else {
-		if p.forwardConfig != nil {
-			if p.forwardConfig.Scheme != "socks5" {
-				loggo.Error("UDP forwarding requires SOCKS5 proxy, got %s", p.forwardConfig.Scheme)
-				p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), packet.src)
-				p.addConnError(addr)
+		// a full-cone session writes every target from its own socket, it can
+		// not go through an association
+		if upstream != nil && packet.my.Udpmode == UDP_MODE_FULLCONE {
+			loggo.Info("server route refuse full cone udp through upstream %s %s", id, addr)
+			p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), (int)(packet.my.Key), packet.crypto, packet.src, KICK_REASON_DENIED)
+			return nil
+		}
+
+		if upstream != nil {
+			if last := upstream.last(); last.Scheme != "socks5" {
+				loggo.Error("UDP forwarding requires SOCKS5 proxy, got %s", last.Scheme)
+				p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), (int)(packet.my.Key), packet.crypto, packet.src, KICK_REASON_NONE)
+				p.addConnError(addr, KICK_REASON_NONE)
 				return nil
 			}
 
-			association, err := DialUDPThroughProxy(p.forwardConfig, time.Millisecond*time.Duration(p.connecttmeout))
+			association, err := DialUDPThroughProxy(upstream, time.Millisecond*time.Duration(settings.ConnectTimeout))
 			if err != nil {
 				loggo.Error("Error creating udp forward association: %s %s", id, err.Error())
-				p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), packet.src)
-				p.addConnError(addr)
+				reason := dialErrorReason(err)
+				p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), (int)(packet.my.Key), packet.crypto, packet.src, reason)
+				p.addConnError(addr, reason)
 				return nil
 			}
 
 			localConn := &ServerConn{
-				exit:           false,
-				timeout:        (int)(packet.my.Timeout),
-				conn:           association.UDPConn,
-				udpTargetAddr:  addr,
-				udpRelayAddr:   association.RelayAddr,
-				udpViaProxy:    true,
-				tcpconn:        association.ControlConn,
-				id:             id,
-				activeRecvTime: now,
-				activeSendTime: now,
-				close:          false,
-				rproto:         (int)(packet.my.Rproto),
-				tcpmode:        (int)(packet.my.Tcpmode),
+				timeout:       (int)(packet.my.Timeout),
+				conn:          association.UDPConn,
+				udpTargetAddr: addr,
+				udpRelayAddr:  association.RelayAddr,
+				udpViaProxy:   true,
+				tcpconn:       association.ControlConn,
+				id:            id,
+				tcpmode:       (int)(packet.my.Tcpmode),
 			}
 
-			p.addServerConn(id, localConn)
+			p.addServerConn(id, localConn, packetPeer(packet))
 
 			go p.Recv(localConn, id, packet.src)
 
 			return localConn
 		}
 
-		c, err := net.DialTimeout("udp", addr, time.Millisecond*time.Duration(p.connecttmeout))
+		if packet.my.Udpmode == UDP_MODE_FULLCONE {
+			return p.processFullConeNewConn(id, packet)
+		}
+
+		c, err := p.dialUDP(addr)
 		if err != nil {
 			loggo.Error("Error listening for udp packets: %s %s", id, err.Error())
-			p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), packet.src)
-			p.addConnError(addr)
+			reason := dialErrorReason(err)
+			p.remoteError(packet.echoId, packet.echoSeq, id, (int)(packet.my.Rproto), (int)(packet.my.Key), packet.crypto, packet.src, reason)
+			p.addConnError(addr, reason)
 			return nil
 		}
-		targetConn := c.(*net.UDPConn)
+		targetConn := c
 		ipaddrTarget := targetConn.RemoteAddr().(*net.UDPAddr)
 
-		localConn := &ServerConn{exit: false, timeout: (int)(packet.my.Timeout), conn: targetConn, ipaddrTarget: ipaddrTarget, id: id, activeRecvTime: now, activeSendTime: now, close: false,
-			rproto: (int)(packet.my.Rproto), tcpmode: (int)(packet.my.Tcpmode), udpTargetAddr: addr}
+		localConn := &ServerConn{timeout: (int)(packet.my.Timeout), conn: targetConn, ipaddrTarget: ipaddrTarget, id: id,
+			tcpmode: (int)(packet.my.Tcpmode), udpTargetAddr: addr}
 
-		p.addServerConn(id, localConn)
+		p.addServerConn(id, localConn, packetPeer(packet))
 
 		go p.Recv(localConn, id, packet.src)
 
 		return localConn
 	}
+}
 
-	return nil
+// routeUpstream returns the proxy a new session to addr goes through, nil to
+// dial it directly, and false when the server route rejects it. When an IP
+// rule decided on the preferred address of a name, the other addresses are
+// checked too and only the permitted ones are returned to be dialled; nil
+// leaves the addresses to the dial.
+func (p *Server) routeUpstream(settings *ServerSettings, network string, addr string) (*ForwardConfig, []net.IP, bool) {
+	if settings.Route == nil {
+		return settings.Forward, nil, true
+	}
+
+	var ips []net.IP
+	resolve := func(host string) (net.IP, error) {
+		var err error
+		ips, err = p.resolver.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		return ips[0], nil
+	}
+	upstream, ok := settings.Route.Decide(network, addr, settings.Forward, resolve)
+	if !ok || upstream != nil || len(ips) <= 1 {
+		return upstream, ips, ok
+	}
+
+	permitted := []net.IP{ips[0]}
+	for _, ip := range ips[1:] {
+		fixed := func(string) (net.IP, error) { return ip, nil }
+		if u, ok := settings.Route.Decide(network, addr, settings.Forward, fixed); ok && u == nil {
+			permitted = append(permitted, ip)
+		} else {
+			loggo.Debug("server route drop address %s of %s", ip, addr)
+		}
+	}
+	return nil, permitted, true
+}
+
+func (p *Server) dialUDP(addr string) (*net.UDPConn, error) {
+	udpaddr, err := p.resolver.ResolveUDPAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP("udp", nil, udpaddr)
 }
 
 func (p *Server) processDataPacket(packet *Packet) {
 
 	loggo.Debug("processPacket %s %s %d", packet.my.Id, packet.src.String(), len(packet.my.Data))
 
-	now := common.GetNowUpdateInSecond()
-
 	id := packet.my.Id
 	localConn := p.getServerConnById(id)
 	if localConn == nil {
@@ -305,13 +538,12 @@ func (p *Server) processDataPacket(packet *Packet) {
 		}
 	}
 
-	localConn.activeRecvTime = now
-	localConn.echoId = packet.echoId
-	localConn.echoSeq = packet.echoSeq
+	localConn.activeRecvTime.Store(time.Now())
+	localConn.peer.Store(packetPeer(packet))
 
 	if packet.my.Type == (int32)(MyMsg_DATA) {
 
-		if packet.my.Tcpmode > 0 {
+		if localConn.tcpmode > 0 {
 			f := &network.Frame{}
 			err := proto.Unmarshal(packet.my.Data, f)
 			if err != nil {
@@ -319,6 +551,7 @@ func (p *Server) processDataPacket(packet *Packet) {
 				return
 			}
 
+			localConn.clock.received(f)
 			localConn.fm.OnRecvFrame(f)
 			notifyActivity(localConn.activity)
 
@@ -335,33 +568,45 @@ func (p *Server) processDataPacket(packet *Packet) {
 				}
 				if targetAddr == "" {
 					loggo.Info("missing udp target for proxied udp conn %s", id)
-					localConn.close = true
+					localConn.close.Store(true)
 					return
 				}
 				udpPacket, packetErr := buildSocks5UDPDatagram(targetAddr, packet.my.Data)
 				if packetErr != nil {
 					loggo.Info("build socks5 udp datagram error %s", packetErr)
-					localConn.close = true
+					localConn.close.Store(true)
 					return
 				}
 				if localConn.udpRelayAddr == nil {
 					loggo.Info("missing udp relay addr for proxied udp conn %s", id)
-					localConn.close = true
+					localConn.close.Store(true)
 					return
 				}
 				_, err = localConn.conn.WriteToUDP(udpPacket, localConn.udpRelayAddr)
+			} else if localConn.reverseUDPConn != nil {
+				_, err = localConn.reverseUDPConn.WriteToUDP(packet.my.Data, localConn.ipaddrTarget)
+			} else if localConn.udpFullCone {
+				if !p.fullConeAllowed(localConn, packet.my.Target) {
+					return
+				}
+				targetAddr, resolveErr := localConn.fullConeAddr(packet.my.Target, p.resolver)
+				if resolveErr != nil {
+					loggo.Debug("resolve full cone udp target %s %s", packet.my.Target, resolveErr)
+					return
+				}
+				_, err = localConn.conn.WriteToUDP(packet.my.Data, targetAddr)
 			} else {
 				_, err = localConn.conn.Write(packet.my.Data)
 			}
 			if err != nil {
 				loggo.Info("WriteToUDP Error %s", err)
-				localConn.close = true
+				localConn.close.Store(true)
 				return
 			}
 		}
 
-		p.recvPacket++
-		p.recvPacketSize += (uint64)(len(packet.my.Data))
+		p.recvPacket.Add(1)
+		p.recvPacketSize.Add((uint64)(len(packet.my.Data)))
 	}
 }
 
@@ -372,79 +617,69 @@ func (p *Server) RecvTCP(conn *ServerConn, id string, src *net.IPAddr) {
 	p.workResultLock.Add(1)
 	defer p.workResultLock.Done()
 
-	loggo.Info("server waiting target response %s -> %s %s", conn.tcpaddrTarget.String(), conn.id, conn.tcpconn.LocalAddr().String())
+	loggo.Info("server waiting target response %s -> %s %s", conn.tcpTargetString(), conn.id, conn.tcpconn.LocalAddr().String())
+
+	loggo.Info("start wait remote connect tcp %s %s", conn.id, conn.tcpTargetString())
+	// the loops wake on frames from the client, target data and the frame
+	// manager's timers
+	defer conn.clock.stop()
 
-	loggo.Info("start wait remote connect tcp %s %s", conn.id, conn.tcpaddrTarget.String())
-	startConnectTime := common.GetNowUpdateInSecond()
-	connectWait := newAdaptiveLoopWait(2*time.Millisecond, 80*time.Millisecond)
-	for !p.exit && !conn.exit {
+	startConnectTime := time.Now()
+	for conn.ctx.Err() == nil {
 		if conn.fm.IsConnected() {
 			break
 		}
 		conn.fm.Update()
 		sendlist := conn.fm.GetSendList()
+		conn.clock.sent(sendlist, time.Now())
 		hadWork := sendlist.Len() > 0
-		for e := sendlist.Front(); e != nil; e = e.Next() {
-			f := e.Value.(*network.Frame)
-			mb, _ := conn.fm.MarshalFrame(f)
-			sendICMP(conn.echoId, conn.echoSeq, *p.conn, src, "", id, (uint32)(MyMsg_DATA), mb,
-				conn.rproto, -1, p.key, 0,
-				0, 0, 0, 0, 0,
-				0, p.cryptoConfig)
-			p.sendPacket++
-			p.sendPacketSize += (uint64)(len(mb))
-		}
-		now := common.GetNowUpdateInSecond()
+		p.sendFrames(conn, id, src, sendlist)
+		now := time.Now()
 		diffclose := now.Sub(startConnectTime)
 		if diffclose > time.Second*5 {
-			loggo.Info("can not connect remote tcp %s %s", conn.id, conn.tcpaddrTarget.String())
+			loggo.Info("can not connect remote tcp %s %s", conn.id, conn.tcpTargetString())
 			p.close(conn)
-			p.remoteError(conn.echoId, conn.echoSeq, id, conn.rproto, src)
+			peer := conn.peer.Load()
+			p.remoteError(peer.echoId, peer.echoSeq, id, peer.rproto, peer.key, peer.crypto, src, KICK_REASON_TIMEOUT)
 			return
 		}
 		if hadWork {
-			connectWait.hit()
 			continue
 		}
-		wait := connectWait.miss()
 		select {
+		case <-conn.ctx.Done():
 		case <-conn.activity:
-			connectWait.hit()
-		case <-time.After(wait):
+		case <-conn.clock.after(time.Now()):
 		}
 	}
 
-	if !conn.exit {
-		loggo.Info("remote connected tcp %s %s", conn.id, conn.tcpaddrTarget.String())
+	if conn.ctx.Err() == nil {
+		loggo.Info("remote connected tcp %s %s", conn.id, conn.tcpTargetString())
 	}
 
 	bytes := make([]byte, 10240)
 
-	tcpActiveRecvUnix := atomic.Int64{}
-	tcpActiveRecvUnix.Store(common.GetNowUpdateInSecond().UnixNano())
-	tcpActiveSendTime := common.GetNowUpdateInSecond()
+	var tcpActiveRecvTime atomicTime
+	tcpActiveRecvTime.Store(time.Now())
+	tcpActiveSendTime := time.Now()
 	readErr := make(chan error, 1)
 	stopRead := make(chan struct{})
+	// the send buffer only drains in Update, which signals room on sendSpace
+	sendSpace := make(chan struct{}, 1)
 
 	go func() {
 		defer common.CrashLog()
 
-		readWait := newAdaptiveLoopWait(2*time.Millisecond, 80*time.Millisecond)
-		for !p.exit && !conn.exit {
+		for conn.ctx.Err() == nil {
 			left := common.MinOfInt(conn.fm.GetSendBufferLeft(), len(bytes))
 			if left <= 0 {
-				wait := readWait.miss()
 				select {
 				case <-stopRead:
 					return
-				case <-conn.activity:
-					readWait.hit()
-					continue
-				case <-time.After(wait):
+				case <-sendSpace:
 					continue
 				}
 			}
-			readWait.hit()
 
 			conn.tcpconn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
 			n, err := conn.tcpconn.Read(bytes[0:left])
@@ -464,38 +699,45 @@ func (p *Server) RecvTCP(conn *ServerConn, id string, src *net.IPAddr) {
 			}
 
 			conn.fm.WriteSendBuffer(bytes[:n])
-			tcpActiveRecvUnix.Store(common.GetNowUpdateInSecond().UnixNano())
+			tcpActiveRecvTime.Store(time.Now())
 			notifyActivity(conn.activity)
 		}
 	}()
 
-	loopWait := newAdaptiveLoopWait(2*time.Millisecond, 250*time.Millisecond)
+	// a clean EOF from either side only closes that direction, the session
+	// ends once both are done
+	localEOF := false
+	remoteEOF := false
+	onReadErr := func(err error) bool {
+		if err == io.EOF && !remoteEOF {
+			loggo.Info("half closed by local conn %s %s", conn.id, conn.tcpTargetString())
+			localEOF = true
+			conn.fm.Close()
+			return false
+		}
+		if err != io.EOF {
+			loggo.Info("Error read tcp %s %s %s", conn.id, conn.tcpTargetString(), err)
+		}
+		conn.fm.Close()
+		return true
+	}
 
 mainLoop:
-	for !p.exit && !conn.exit {
-		now := common.GetNowUpdateInSecond()
+	for conn.ctx.Err() == nil {
+		now := time.Now()
 		hadWork := false
 
 		conn.fm.Update()
+		if conn.fm.GetSendBufferLeft() > 0 {
+			notifyActivity(sendSpace)
+		}
 
 		sendlist := conn.fm.GetSendList()
+		conn.clock.sent(sendlist, time.Now())
 		if sendlist.Len() > 0 {
 			hadWork = true
-			conn.activeSendTime = now
-			for e := sendlist.Front(); e != nil; e = e.Next() {
-				f := e.Value.(*network.Frame)
-				mb, err := conn.fm.MarshalFrame(f)
-				if err != nil {
-					loggo.Error("Error tcp Marshal %s %s %s", conn.id, conn.tcpaddrTarget.String(), err)
-					continue
-				}
-				sendICMP(conn.echoId, conn.echoSeq, *p.conn, src, "", id, (uint32)(MyMsg_DATA), mb,
-					conn.rproto, -1, p.key, 0,
-					0, 0, 0, 0, 0,
-					0, p.cryptoConfig)
-				p.sendPacket++
-				p.sendPacketSize += (uint64)(len(mb))
-			}
+			conn.activeSendTime.Store(now)
+			p.sendFrames(conn, id, src, sendlist)
 		}
 
 		if conn.fm.GetRecvBufferSize() > 0 {
@@ -506,7 +748,7 @@ mainLoop:
 			if err != nil {
 				nerr, ok := err.(net.Error)
 				if !ok || !nerr.Timeout() {
-					loggo.Info("Error write tcp %s %s %s", conn.id, conn.tcpaddrTarget.String(), err)
+					loggo.Info("Error write tcp %s %s %s", conn.id, conn.tcpTargetString(), err)
 					conn.fm.Close()
 					break mainLoop
 				}
@@ -519,69 +761,63 @@ mainLoop:
 
 		select {
 		case err := <-readErr:
-			if err != nil {
-				loggo.Info("Error read tcp %s %s %s", conn.id, conn.tcpaddrTarget.String(), err)
-				conn.fm.Close()
+			if err != nil && onReadErr(err) {
 				break mainLoop
 			}
 		default:
 		}
 
-		diffrecv := now.Sub(conn.activeRecvTime)
-		diffsend := now.Sub(conn.activeSendTime)
-		tcpdiffrecv := now.Sub(time.Unix(0, tcpActiveRecvUnix.Load()))
+		if p.draining.Load() {
+			loggo.Info("shutting down, close conn %s %s", conn.id, conn.tcpTargetString())
+			break
+		}
+
+		diffrecv := now.Sub(conn.activeRecvTime.Load())
+		diffsend := now.Sub(conn.activeSendTime.Load())
+		tcpdiffrecv := now.Sub(tcpActiveRecvTime.Load())
 		tcpdiffsend := now.Sub(tcpActiveSendTime)
 		if diffrecv > time.Second*(time.Duration(conn.timeout)) || diffsend > time.Second*(time.Duration(conn.timeout)) ||
 			(tcpdiffrecv > time.Second*(time.Duration(conn.timeout)) && tcpdiffsend > time.Second*(time.Duration(conn.timeout))) {
-			loggo.Info("close inactive conn %s %s", conn.id, conn.tcpaddrTarget.String())
+			loggo.Info("close inactive conn %s %s", conn.id, conn.tcpTargetString())
 			conn.fm.Close()
 			break
 		}
 
-		if conn.fm.IsRemoteClosed() {
-			loggo.Info("closed by remote conn %s %s", conn.id, conn.tcpaddrTarget.String())
-			conn.fm.Close()
-			break
+		if conn.fm.IsRemoteClosed() && conn.fm.GetRecvBufferSize() == 0 && !remoteEOF {
+			if localEOF || !closeWrite(conn.tcpconn) {
+				loggo.Info("closed by remote conn %s %s", conn.id, conn.tcpTargetString())
+				conn.fm.Close()
+				break
+			}
+			loggo.Info("half closed by remote conn %s %s", conn.id, conn.tcpTargetString())
+			remoteEOF = true
 		}
 
 		if !hadWork {
-			wait := loopWait.miss()
 			select {
+			case <-conn.ctx.Done():
 			case <-conn.activity:
-				loopWait.hit()
 			case err := <-readErr:
-				if err != nil {
-					loggo.Info("Error read tcp %s %s %s", conn.id, conn.tcpaddrTarget.String(), err)
-					conn.fm.Close()
+				if err != nil && onReadErr(err) {
 					break mainLoop
 				}
-			case <-time.After(wait):
+			case <-conn.clock.after(time.Now()):
 			}
-		} else {
-			loopWait.hit()
 		}
 	}
 	close(stopRead)
 
 	conn.fm.Close()
 
-	startCloseTime := common.GetNowUpdateInSecond()
-	for !p.exit && !conn.exit {
-		now := common.GetNowUpdateInSecond()
+	startCloseTime := time.Now()
+	for conn.ctx.Err() == nil {
+		now := time.Now()
 
 		conn.fm.Update()
 
 		sendlist := conn.fm.GetSendList()
-		for e := sendlist.Front(); e != nil; e = e.Next() {
-			f := e.Value.(*network.Frame)
-			mb, _ := conn.fm.MarshalFrame(f)
-			sendICMP(conn.echoId, conn.echoSeq, *p.conn, src, "", id, (uint32)(MyMsg_DATA), mb,
-				conn.rproto, -1, p.key, 0,
-				0, 0, 0, 0, 0,
-				0, p.cryptoConfig)
-			p.sendPacket++
-			p.sendPacketSize += (uint64)(len(mb))
-		}
+		conn.clock.sent(sendlist, time.Now())
+		p.sendFrames(conn, id, src, sendlist)
 
 		nodatarecv := true
 		if conn.fm.GetRecvBufferSize() > 0 {
@@ -596,25 +832,57 @@ mainLoop:
 
 		diffclose := now.Sub(startCloseTime)
 		if diffclose > time.Second*60 {
-			loggo.Info("close conn had timeout %s %s", conn.id, conn.tcpaddrTarget.String())
+			loggo.Info("close conn had timeout %s %s", conn.id, conn.tcpTargetString())
 			break
 		}
 
 		remoteclosed := conn.fm.IsRemoteClosed()
 		if remoteclosed && nodatarecv {
-			loggo.Info("remote conn had closed %s %s", conn.id, conn.tcpaddrTarget.String())
+			loggo.Info("remote conn had closed %s %s", conn.id, conn.tcpTargetString())
 			break
 		}
 
-		time.Sleep(time.Millisecond * 100)
+		if conn.fm.GetRecvBufferSize() == 0 {
+			select {
+			case <-conn.ctx.Done():
+			case <-conn.activity:
+			case <-conn.clock.after(time.Now()):
+			}
+		}
 	}
 
-	time.Sleep(time.Second)
+	select {
+	case <-conn.ctx.Done():
+	case <-time.After(time.Second):
+	}
 
-	loggo.Info("close tcp conn %s %s", conn.id, conn.tcpaddrTarget.String())
+	loggo.Info("close tcp conn %s %s", conn.id, conn.tcpTargetString())
 	p.close(conn)
 }
 
+// sendFrames sends the frames of a tcp session to the client, which replies
+// to the latest packet it had from it.
+func (p *Server) sendFrames(conn *ServerConn, id string, src *net.IPAddr, sendlist *list.List) {
+	if sendlist.Len() == 0 {
+		return
+	}
+	peer := conn.peer.Load()
+	for e := sendlist.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*network.Frame)
+		mb, err := conn.fm.MarshalFrame(f)
+		if err != nil {
+			loggo.Error("Error tcp Marshal %s %s %s", conn.id, conn.tcpTargetString(), err)
+			continue
+		}
+		sendICMP(peer.echoId, peer.echoSeq, *p.conn, src, conn.reverseId, id, (uint32)(MyMsg_DATA), mb,
+			peer.rproto, -1, peer.key, 0,
+			0, 0, 0, 0, 0,
+			0, peer.crypto)
+		p.sendPacket.Add(1)
+		p.sendPacketSize.Add((uint64)(len(mb)))
+	}
+}
+
 func (p *Server) Recv(conn *ServerConn, id string, src *net.IPAddr) {
 
 	defer common.CrashLog()
@@ -624,9 +892,9 @@ func (p *Server) Recv(conn *ServerConn, id string, src *net.IPAddr) {
 
 	loggo.Info("server waiting target response %s -> %s %s", conn.udpTargetString(), conn.id, conn.conn.LocalAddr().String())
 
-	bytes := make([]byte, 2000)
+	bytes := make([]byte, UDP_FRAG_MAX_DATAGRAM)
 
-	for !p.exit {
+	for conn.ctx.Err() == nil {
 
 		conn.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
 		n, srcAddr, err := conn.conn.ReadFromUDP(bytes)
@@ -634,7 +902,7 @@ func (p *Server) Recv(conn *ServerConn, id string, src *net.IPAddr) {
 			nerr, ok := err.(net.Error)
 			if !ok || !nerr.Timeout() {
 				loggo.Info("ReadFromUDP Error read udp %s", err)
-				conn.close = true
+				conn.close.Store(true)
 				return
 			}
 		}
@@ -642,12 +910,15 @@ func (p *Server) Recv(conn *ServerConn, id string, src *net.IPAddr) {
 			continue
 		}
 
-		now := common.GetNowUpdateInSecond()
-		conn.activeSendTime = now
+		conn.activeSendTime.Store(time.Now())
 
 		targetAddr := conn.udpTargetString()
 		payload := bytes[:n]
 
+		if conn.udpFullCone {
+			targetAddr = srcAddr.String()
+		}
+
 		if conn.udpViaProxy {
 			if conn.udpRelayAddr != nil && !sameUDPAddr(srcAddr, conn.udpRelayAddr) {
 				continue
@@ -661,25 +932,27 @@ func (p *Server) Recv(conn *ServerConn, id string, src *net.IPAddr) {
 			payload = parsedPayload
 		}
 
-		sendICMP(conn.echoId, conn.echoSeq, *p.conn, src, targetAddr, id, (uint32)(MyMsg_DATA), payload,
-			conn.rproto, -1, p.key, 0,
-			0, 0, 0, 0, 0,
-			0, p.cryptoConfig)
+		peer := conn.peer.Load()
+		sendICMPUDP(peer.echoId, peer.echoSeq, *p.conn, src, targetAddr, id, payload,
+			peer.rproto, -1, peer.key, 0, UDP_MODE_CONNECTED, peer.crypto)
 
-		p.sendPacket++
-		p.sendPacketSize += (uint64)(len(payload))
+		p.sendPacket.Add(1)
+		p.sendPacketSize.Add((uint64)(len(payload)))
 	}
 }
 
 func (p *Server) close(conn *ServerConn) {
 	if p.getServerConnById(conn.id) != nil {
-		conn.exit = true
+		conn.cancel()
 		if conn.conn != nil {
 			conn.conn.Close()
 		}
 		if conn.tcpconn != nil {
 			conn.tcpconn.Close()
 		}
+		if conn.reverseUDPConn != nil {
+			p.closeReverseUDP(conn)
+		}
 		p.deleteServerConn(conn.id)
 	}
 }
@@ -694,15 +967,15 @@ func (p *Server) checkTimeoutConn() {
 		return true
 	})
 
-	now := common.GetNowUpdateInSecond()
+	now := time.Now()
 	for _, conn := range tmp {
 		if conn.tcpmode > 0 {
 			continue
 		}
-		diffrecv := now.Sub(conn.activeRecvTime)
-		diffsend := now.Sub(conn.activeSendTime)
+		diffrecv := now.Sub(conn.activeRecvTime.Load())
+		diffsend := now.Sub(conn.activeSendTime.Load())
 		if diffrecv > time.Second*(time.Duration(conn.timeout)) || diffsend > time.Second*(time.Duration(conn.timeout)) {
-			conn.close = true
+			conn.close.Store(true)
 		}
 	}
 
@@ -710,13 +983,23 @@ func (p *Server) checkTimeoutConn() {
 		if conn.tcpmode > 0 {
 			continue
 		}
-		if conn.close {
+		if conn.close.Load() {
 			loggo.Info("close inactive conn %s %s", id, conn.udpTargetString())
 			p.close(conn)
 		}
 	}
 }
 
+func (conn *ServerConn) tcpTargetString() string {
+	if conn.tcpaddrTarget != nil {
+		return conn.tcpaddrTarget.String()
+	}
+	if conn.tcpTargetAddr != "" {
+		return conn.tcpTargetAddr
+	}
+	return "unknown"
+}
+
 func (conn *ServerConn) udpTargetString() string {
 	if conn.udpTargetAddr != "" {
 		return conn.udpTargetAddr
@@ -744,20 +1027,28 @@ func sameUDPAddr(a *net.UDPAddr, b *net.UDPAddr) bool {
 }
 
 func (p *Server) showNet() {
-	p.localConnMapSize = 0
+	p.localConnMapSize.Store((int64)(p.connCount()))
+	loggo.Info("send %dPacket/s %dKB/s recv %dPacket/s %dKB/s %dConnections",
+		p.sendPacket.Swap(0), p.sendPacketSize.Swap(0)/1024, p.recvPacket.Swap(0), p.recvPacketSize.Swap(0)/1024, p.localConnMapSize.Load())
+}
+
+func (p *Server) connCount() int {
+	count := 0
 	p.localConnMap.Range(func(key, value interface{}) bool {
-		p.localConnMapSize++
+		count++
 		return true
 	})
-	loggo.Info("send %dPacket/s %dKB/s recv %dPacket/s %dKB/s %dConnections",
-		p.sendPacket, p.sendPacketSize/1024, p.recvPacket, p.recvPacketSize/1024, p.localConnMapSize)
-	p.sendPacket = 0
-	p.recvPacket = 0
-	p.sendPacketSize = 0
-	p.recvPacketSize = 0
+	return count
 }
 
-func (p *Server) addServerConn(uuid string, serverConn *ServerConn) {
+// addServerConn starts the session of serverConn, which replies to peer until
+// the client sends from elsewhere.
+func (p *Server) addServerConn(uuid string, serverConn *ServerConn, peer serverPeer) {
+	now := time.Now()
+	serverConn.ctx, serverConn.cancel = context.WithCancel(p.ctx)
+	serverConn.activeRecvTime.Store(now)
+	serverConn.activeSendTime.Store(now)
+	serverConn.peer.Store(peer)
 	p.localConnMap.Store(uuid, serverConn)
 }
 
@@ -773,24 +1064,32 @@ func (p *Server) deleteServerConn(uuid string) {
 	p.localConnMap.Delete(uuid)
 }
 
-func (p *Server) remoteError(echoId int, echoSeq int, uuid string, rprpto int, src *net.IPAddr) {
-	sendICMP(echoId, echoSeq, *p.conn, src, "", uuid, (uint32)(MyMsg_KICK), []byte{},
-		rprpto, -1, p.key,
+func (p *Server) remoteError(echoId int, echoSeq int, uuid string, rprpto int, key int, crypto *CryptoConfig, src *net.IPAddr, reason int) {
+	sendICMP(echoId, echoSeq, *p.conn, src, "", uuid, (uint32)(MyMsg_KICK), kickReasonData(reason),
+		rprpto, -1, key,
 		0, 0, 0, 0, 0, 0, 0,
-		p.cryptoConfig)
+		crypto)
 }
 
-func (p *Server) addConnError(addr string) {
+type connError struct {
+	time   time.Time
+	reason int
+}
+
+func (p *Server) addConnError(addr string, reason int) {
 	_, ok := p.connErrorMap.Load(addr)
 	if !ok {
-		now := common.GetNowUpdateInSecond()
-		p.connErrorMap.Store(addr, now)
+		now := time.Now()
+		p.connErrorMap.Store(addr, &connError{time: now, reason: reason})
 	}
 }
 
-func (p *Server) isConnError(addr string) bool {
-	_, ok := p.connErrorMap.Load(addr)
-	return ok
+func (p *Server) isConnError(addr string) (int, bool) {
+	v, ok := p.connErrorMap.Load(addr)
+	if !ok {
+		return KICK_REASON_NONE, false
+	}
+	return v.(*connError).reason, true
 }
 
 func (p *Server) updateConnError() {
@@ -798,12 +1097,12 @@ func (p *Server) updateConnError() {
 	tmp := make(map[string]time.Time)
 	p.connErrorMap.Range(func(key, value interface{}) bool {
 		id := key.(string)
-		t := value.(time.Time)
+		t := value.(*connError).time
 		tmp[id] = t
 		return true
 	})
 
-	now := common.GetNowUpdateInSecond()
+	now := time.Now()
 	for id, t := range tmp {
 		diff := now.Sub(t)
 		if diff > time.Second*5 {
@@ -0,0 +1,124 @@
+package pingtunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// ServerRoute picks how the server reaches each target: directly, through one
+// of the named upstream proxies, or not at all. Sessions no rule matches use
+// the -forward proxy, or go direct without one.
+type ServerRoute struct {
+	Table     *RouteTable
+	Upstreams map[string]*ForwardConfig
+}
+
+// NewServerRoute checks table against upstreams and puts the noProxy bypass
+// rules in front of it. table may be nil when only noProxy is used.
+func NewServerRoute(table *RouteTable, upstreams map[string]*ForwardConfig, noProxy []*RouteRule) (*ServerRoute, error) {
+	rules := append([]*RouteRule{}, noProxy...)
+	if table != nil {
+		if err := table.CheckActions(ROUTE_ACTION_DIRECT, ROUTE_ACTION_REJECT, ROUTE_ACTION_PROXY); err != nil {
+			return nil, err
+		}
+		for _, r := range table.Rules {
+			if r.Action == ROUTE_ACTION_PROXY && upstreams[r.Proxy] == nil {
+				return nil, fmt.Errorf("route line %d: unknown upstream %q", r.Line, r.Proxy)
+			}
+		}
+		rules = append(rules, table.Rules...)
+	}
+	return &ServerRoute{
+		Table:     &RouteTable{Rules: rules},
+		Upstreams: upstreams,
+	}, nil
+}
+
+// ParseUpstreams parses named upstream proxies, "name=URL;name=URL". Each URL
+// is a -forward URL, so it may be a comma-separated chain.
+func ParseUpstreams(spec string) (map[string]*ForwardConfig, error) {
+	upstreams := make(map[string]*ForwardConfig)
+	for _, item := range strings.Split(spec, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, rawURL, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid upstream %q (expected name=URL)", item)
+		}
+		if upstreams[name] != nil {
+			return nil, fmt.Errorf("duplicate upstream %q", name)
+		}
+		config, err := ParseForwardURL(strings.TrimSpace(rawURL))
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", name, err)
+		}
+		if config == nil {
+			return nil, fmt.Errorf("upstream %s: missing URL", name)
+		}
+		upstreams[name] = config
+	}
+	return upstreams, nil
+}
+
+// ParseNoProxy turns a no_proxy style list into direct rules: "*" matches
+// everything, "example.com", ".example.com" and "*.example.com" match the
+// domain and its subdomains, and IPs or CIDRs match addresses.
+func ParseNoProxy(spec string) ([]*RouteRule, error) {
+	var rules []*RouteRule
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		var text string
+		host := strings.TrimSuffix(strings.TrimPrefix(item, "["), "]")
+		switch {
+		case item == "*":
+			text = ROUTE_FINAL + "," + ROUTE_ACTION_DIRECT
+		case strings.Contains(item, "/"):
+			text = ROUTE_IP_CIDR + "," + item + "," + ROUTE_ACTION_DIRECT
+		case net.ParseIP(host) != nil:
+			bits := 128
+			if net.ParseIP(host).To4() != nil {
+				bits = 32
+			}
+			text = fmt.Sprintf("%s,%s/%d,%s", ROUTE_IP_CIDR, host, bits, ROUTE_ACTION_DIRECT)
+		case strings.Contains(item, ":"):
+			return nil, fmt.Errorf("no_proxy entry %q: ports are not supported", item)
+		default:
+			domain := strings.TrimPrefix(strings.TrimPrefix(item, "*"), ".")
+			text = ROUTE_DOMAIN_SUFFIX + "," + domain + "," + ROUTE_ACTION_DIRECT
+		}
+
+		rule, err := parseRouteRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("no_proxy entry %q: %w", item, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Decide returns the proxy a session to addr goes through, nil for direct,
+// and false when it is rejected. resolve serves IP rules for domain targets.
+func (r *ServerRoute) Decide(network string, addr string, def *ForwardConfig, resolve func(host string) (net.IP, error)) (*ForwardConfig, bool) {
+	rule := r.Table.Match(network, addr, resolve)
+	if rule == nil {
+		return def, true
+	}
+	loggo.Debug("server route %s %s match line %d %s", network, addr, rule.Line, rule.String())
+	switch rule.Action {
+	case ROUTE_ACTION_DIRECT:
+		return nil, true
+	case ROUTE_ACTION_PROXY:
+		return r.Upstreams[rule.Proxy], true
+	}
+	return nil, false
+}
@@ -0,0 +1,165 @@
+package pingtunnel
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUpstreams(t *testing.T) {
+	upstreams, err := ParseUpstreams("us=socks5://10.0.0.2:1080; hk=https://u:p@proxy.example.com:443,socks5://10.0.0.3:1080")
+	if err != nil {
+		t.Fatalf("ParseUpstreams unexpected error: %v", err)
+	}
+	if len(upstreams) != 2 {
+		t.Fatalf("ParseUpstreams returned %d upstreams, want 2", len(upstreams))
+	}
+	if us := upstreams["us"]; us == nil || us.Address() != "10.0.0.2:1080" {
+		t.Errorf("upstream us = %+v", us)
+	}
+	if hk := upstreams["hk"]; hk == nil || hk.Scheme != "https" || hk.Next == nil || hk.Next.Address() != "10.0.0.3:1080" {
+		t.Errorf("upstream hk = %+v", hk)
+	}
+
+	invalid := []string{
+		"socks5://10.0.0.2:1080",
+		"=socks5://10.0.0.2:1080",
+		"us=",
+		"us=ftp://10.0.0.2:21",
+		"us=socks5://10.0.0.2:1080;us=socks5://10.0.0.3:1080",
+	}
+	for _, spec := range invalid {
+		if _, err := ParseUpstreams(spec); err == nil {
+			t.Errorf("ParseUpstreams(%q) expected error, got none", spec)
+		}
+	}
+}
+
+func TestParseNoProxy(t *testing.T) {
+	rules, err := ParseNoProxy("localhost, .corp.example,*.lan,10.0.0.0/8,192.168.1.1,[::1]")
+	if err != nil {
+		t.Fatalf("ParseNoProxy unexpected error: %v", err)
+	}
+	want := []string{
+		"DOMAIN-SUFFIX,localhost,direct",
+		"DOMAIN-SUFFIX,corp.example,direct",
+		"DOMAIN-SUFFIX,lan,direct",
+		"IP-CIDR,10.0.0.0/8,direct",
+		"IP-CIDR,192.168.1.1/32,direct",
+		"IP-CIDR,::1/128,direct",
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("ParseNoProxy returned %d rules, want %d", len(rules), len(want))
+	}
+	for i, w := range want {
+		if got := rules[i].String(); got != w {
+			t.Errorf("rule %d = %q, want %q", i, got, w)
+		}
+	}
+
+	for _, spec := range []string{"example.com:8080", "10.0.0.0/33"} {
+		if _, err := ParseNoProxy(spec); err == nil {
+			t.Errorf("ParseNoProxy(%q) expected error, got none", spec)
+		}
+	}
+}
+
+func TestServerRouteDecide(t *testing.T) {
+	t.Chdir(t.TempDir())
+	table, err := ParseRouteRules(strings.NewReader(`
+DOMAIN-SUFFIX,blocked.example,reject
+DOMAIN-SUFFIX,us.example,proxy:us
+DST-PORT,25,reject
+NETWORK,udp,direct
+`))
+	if err != nil {
+		t.Fatalf("ParseRouteRules unexpected error: %v", err)
+	}
+	upstreams, _ := ParseUpstreams("us=socks5://10.0.0.2:1080")
+	noProxy, _ := ParseNoProxy("internal.us.example,10.0.0.0/8")
+	route, err := NewServerRoute(table, upstreams, noProxy)
+	if err != nil {
+		t.Fatalf("NewServerRoute unexpected error: %v", err)
+	}
+	def := &ForwardConfig{Scheme: "http", Host: "10.0.0.9", Port: 3128}
+
+	tests := []struct {
+		network string
+		addr    string
+		want    *ForwardConfig
+		wantOk  bool
+	}{
+		{"tcp", "www.blocked.example:443", nil, false},
+		{"tcp", "api.us.example:443", upstreams["us"], true},
+		{"tcp", "db.internal.us.example:5432", nil, true},
+		{"tcp", "10.1.2.3:80", nil, true},
+		{"tcp", "mail.example.org:25", nil, false},
+		{"udp", "8.8.8.8:53", nil, true},
+		{"tcp", "8.8.8.8:443", def, true},
+	}
+	for _, tt := range tests {
+		got, ok := route.Decide(tt.network, tt.addr, def, nil)
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("Decide(%q, %q) = %v, %v, want %v, %v", tt.network, tt.addr, got, ok, tt.want, tt.wantOk)
+		}
+	}
+
+	for _, spec := range []string{"FINAL,tunnel", "FINAL,server:127.0.0.1", "FINAL,proxy:missing"} {
+		table, err := ParseRouteRules(strings.NewReader(spec))
+		if err != nil {
+			t.Fatalf("ParseRouteRules(%q) unexpected error: %v", spec, err)
+		}
+		if _, err := NewServerRoute(table, upstreams, nil); err == nil {
+			t.Errorf("NewServerRoute(%q) expected error, got none", spec)
+		}
+	}
+}
+
+func TestServerRouteUpstreamAddresses(t *testing.T) {
+	t.Chdir(t.TempDir())
+	table, err := ParseRouteRules(strings.NewReader(`
+DOMAIN,proxied.test,proxy:us
+IP-CIDR,10.0.0.0/8,reject
+FINAL,direct
+`))
+	if err != nil {
+		t.Fatalf("ParseRouteRules unexpected error: %v", err)
+	}
+	upstreams, _ := ParseUpstreams("us=socks5://127.0.0.1:1080")
+	route, err := NewServerRoute(table, upstreams, nil)
+	if err != nil {
+		t.Fatalf("NewServerRoute unexpected error: %v", err)
+	}
+	s, err := NewServer("", 0, 0, 0, 0, 1000, nil, nil, 0, 0, nil, "", route, nil, nil, 0)
+	if err != nil {
+		t.Fatalf("NewServer unexpected error: %v", err)
+	}
+	expire := time.Now().Add(time.Hour)
+	s.resolver.cachePut("mixed.test", []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}, nil, expire)
+	s.resolver.cachePut("private.test", []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("192.0.2.2")}, nil, expire)
+
+	tests := []struct {
+		addr     string
+		upstream *ForwardConfig
+		ips      string
+		ok       bool
+	}{
+		// the rejected address of a permitted name is never dialled
+		{"mixed.test:443", nil, "[192.0.2.1 2001:db8::1]", true},
+		{"private.test:443", nil, "[]", false},
+		{"proxied.test:443", upstreams["us"], "[]", true},
+		// an address literal is dialled as it is
+		{"192.0.2.3:443", nil, "[]", true},
+	}
+	for _, tt := range tests {
+		upstream, ips, ok := s.routeUpstream(s.settings.Load(), "tcp", tt.addr)
+		if !ok {
+			ips = nil
+		}
+		if upstream != tt.upstream || fmt.Sprint(ips) != tt.ips || ok != tt.ok {
+			t.Errorf("routeUpstream(%q) = %v, %v, %v, want %v, %s, %v", tt.addr, upstream, ips, ok, tt.upstream, tt.ips, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package pingtunnel
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client and Server state is shared by the packet path, the session loops,
+// the accept loops and the once a second checks. Fields written after a
+// session starts are atomics or go through the types below, everything else
+// is set before the goroutines using it are started. Stop cancels the context
+// the loops of a Client or Server run under, closing a session cancels its own.
+
+// atomicTime is a time read and written from several goroutines.
+type atomicTime struct {
+	ns atomic.Int64
+}
+
+func (t *atomicTime) Store(v time.Time) {
+	t.ns.Store(v.UnixNano())
+}
+
+func (t *atomicTime) Load() time.Time {
+	return time.Unix(0, t.ns.Load())
+}
+
+// serverPeer is where the server sends the packets of a session: the client
+// and the echo id, sequence, key and suite of the latest packet it sent.
+type serverPeer struct {
+	src     *net.IPAddr
+	echoId  int
+	echoSeq int
+	rproto  int
+	key     int
+	crypto  *CryptoConfig
+}
+
+// sharedPeer holds the serverPeer the packet path updates and the session
+// loops reply to.
+type sharedPeer struct {
+	lock sync.Mutex
+	peer serverPeer
+}
+
+func (s *sharedPeer) Store(peer serverPeer) {
+	s.lock.Lock()
+	s.peer = peer
+	s.lock.Unlock()
+}
+
+func (s *sharedPeer) Load() serverPeer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.peer
+}
+
+// packetPeer is the serverPeer of the client that sent packet.
+func packetPeer(packet *Packet) serverPeer {
+	return serverPeer{
+		src:     packet.src,
+		echoId:  packet.echoId,
+		echoSeq: packet.echoSeq,
+		rproto:  (int)(packet.my.Rproto),
+		key:     (int)(packet.my.Key),
+		crypto:  packet.crypto,
+	}
+}
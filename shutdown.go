@@ -0,0 +1,31 @@
+package pingtunnel
+
+import (
+	"fmt"
+	"time"
+)
+
+// ShutdownStats is the outcome of a graceful shutdown.
+type ShutdownStats struct {
+	Sessions  int // live sessions when the shutdown began
+	Remaining int // sessions still open when the drain period ran out
+	Elapsed   time.Duration
+}
+
+func (s ShutdownStats) String() string {
+	return fmt.Sprintf("%d sessions, %d drained, %d cut off, took %s",
+		s.Sessions, s.Sessions-s.Remaining, s.Remaining, s.Elapsed.Round(time.Millisecond))
+}
+
+// waitDrained polls count until it drops to zero or drain has passed, and
+// returns what is left.
+func waitDrained(drain time.Duration, count func() int) int {
+	deadline := time.Now().Add(drain)
+	for {
+		n := count()
+		if n == 0 || !time.Now().Before(deadline) {
+			return n
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
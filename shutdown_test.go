@@ -0,0 +1,36 @@
+package pingtunnel
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitDrained(t *testing.T) {
+	var live int32 = 3
+	go func() {
+		for atomic.LoadInt32(&live) > 0 {
+			time.Sleep(50 * time.Millisecond)
+			atomic.AddInt32(&live, -1)
+		}
+	}()
+	count := func() int { return int(atomic.LoadInt32(&live)) }
+	if n := waitDrained(5*time.Second, count); n != 0 {
+		t.Errorf("waitDrained = %d, want 0", n)
+	}
+
+	begin := time.Now()
+	if n := waitDrained(300*time.Millisecond, func() int { return 2 }); n != 2 {
+		t.Errorf("waitDrained with stuck sessions = %d, want 2", n)
+	}
+	if elapsed := time.Since(begin); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("waitDrained took %s, want about 300ms", elapsed)
+	}
+}
+
+func TestShutdownStatsString(t *testing.T) {
+	s := ShutdownStats{Sessions: 5, Remaining: 2, Elapsed: 1500 * time.Millisecond}
+	if got, want := s.String(), "5 sessions, 3 drained, 2 cut off, took 1.5s"; got != want {
+		t.Errorf("ShutdownStats.String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package pingtunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Version = 0x04
+
+	socks4CmdConnect = 0x01
+	socks4CmdBind    = 0x02
+
+	socks4ReplyGranted  = 0x5a
+	socks4ReplyRejected = 0x5b
+
+	socks4MaxFieldLen = 255
+)
+
+type socks4Request struct {
+	Command byte
+	Address string
+	UserId  string
+}
+
+// readSocks4Request reads a SOCKS4 or SOCKS4a request. A destination IP of
+// 0.0.0.x with x != 0 means the 4a form, where a domain follows the userid.
+func readSocks4Request(r io.Reader) (*socks4Request, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("read socks4 request header: %w", err)
+	}
+	if header[0] != socks4Version {
+		return nil, fmt.Errorf("unsupported socks version: %d", header[0])
+	}
+
+	port := binary.BigEndian.Uint16(header[2:4])
+	ip := net.IP(header[4:8])
+
+	userId, err := readSocks4String(r)
+	if err != nil {
+		return nil, fmt.Errorf("read socks4 userid: %w", err)
+	}
+
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err = readSocks4String(r)
+		if err != nil {
+			return nil, fmt.Errorf("read socks4a domain: %w", err)
+		}
+		if host == "" {
+			return nil, fmt.Errorf("invalid empty domain in socks4a request")
+		}
+	}
+
+	return &socks4Request{
+		Command: header[1],
+		Address: net.JoinHostPort(host, strconv.Itoa(int(port))),
+		UserId:  userId,
+	}, nil
+}
+
+// readSocks4String reads a NUL terminated field.
+func readSocks4String(r io.Reader) (string, error) {
+	var buf []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(buf), nil
+		}
+		if len(buf) >= socks4MaxFieldLen {
+			return "", fmt.Errorf("socks4 field too long")
+		}
+		buf = append(buf, b[0])
+	}
+}
+
+func writeSocks4Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{0x00, rep, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// checkSocks4Auth validates the userid field. SOCKS4 has no password, so when
+// one is configured the userid must be "user:pass".
+func checkSocks4Auth(userId string, user string, pass string) bool {
+	if user == "" && pass == "" {
+		return true
+	}
+	if pass != "" {
+		return userId == user+":"+pass
+	}
+	return userId == user
+}
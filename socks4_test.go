@@ -0,0 +1,95 @@
+package pingtunnel
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadSocks4RequestConnect(t *testing.T) {
+	reqBytes := []byte{
+		0x04, 0x01, 0x00, 0x50,
+		10, 1, 2, 3,
+		'b', 'o', 'b', 0x00,
+	}
+
+	req, err := readSocks4Request(bytes.NewReader(reqBytes))
+	if err != nil {
+		t.Fatalf("readSocks4Request failed: %v", err)
+	}
+	if req.Command != socks4CmdConnect {
+		t.Fatalf("unexpected command: %d", req.Command)
+	}
+	if req.Address != "10.1.2.3:80" {
+		t.Fatalf("unexpected address: %s", req.Address)
+	}
+	if req.UserId != "bob" {
+		t.Fatalf("unexpected userid: %s", req.UserId)
+	}
+}
+
+func TestReadSocks4aRequestDomain(t *testing.T) {
+	reqBytes := []byte{
+		0x04, 0x01, 0x01, 0xbb,
+		0, 0, 0, 1,
+		0x00,
+		'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0x00,
+	}
+
+	req, err := readSocks4Request(bytes.NewReader(reqBytes))
+	if err != nil {
+		t.Fatalf("readSocks4Request failed: %v", err)
+	}
+	if req.Address != "example.com:443" {
+		t.Fatalf("unexpected address: %s", req.Address)
+	}
+	if req.UserId != "" {
+		t.Fatalf("unexpected userid: %s", req.UserId)
+	}
+}
+
+func TestReadSocks4RequestInvalid(t *testing.T) {
+	tests := [][]byte{
+		{0x05, 0x01, 0x00, 0x50, 10, 1, 2, 3, 0x00},
+		{0x04, 0x01, 0x00, 0x50, 10, 1, 2, 3, 'b'},
+		{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1, 0x00, 0x00},
+		append([]byte{0x04, 0x01, 0x00, 0x50, 10, 1, 2, 3}, bytes.Repeat([]byte{'a'}, 300)...),
+	}
+
+	for i, reqBytes := range tests {
+		if _, err := readSocks4Request(bytes.NewReader(reqBytes)); err == nil {
+			t.Errorf("case %d: expected error, got none", i)
+		}
+	}
+}
+
+func TestCheckSocks4Auth(t *testing.T) {
+	tests := []struct {
+		userId string
+		user   string
+		pass   string
+		ok     bool
+	}{
+		{"", "", "", true},
+		{"anyone", "", "", true},
+		{"bob", "bob", "", true},
+		{"alice", "bob", "", false},
+		{"bob", "bob", "secret", false},
+		{"bob:secret", "bob", "secret", true},
+	}
+
+	for _, test := range tests {
+		if got := checkSocks4Auth(test.userId, test.user, test.pass); got != test.ok {
+			t.Errorf("checkSocks4Auth(%q, %q, %q) = %v, want %v", test.userId, test.user, test.pass, got, test.ok)
+		}
+	}
+}
+
+func TestWriteSocks4Reply(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeSocks4Reply(&buf, socks4ReplyGranted); err != nil {
+		t.Fatalf("writeSocks4Reply failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("unexpected reply: %v", buf.Bytes())
+	}
+}
@@ -11,7 +11,13 @@ import (
 const (
 	socks5Version = 0x05
 
+	socks5AuthNone         = 0x00
+	socks5AuthUserPass     = 0x02
+	socks5AuthNoAcceptable = 0xFF
+	socks5UserPassVersion  = 0x01
+
 	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
 	socks5CmdUDPAssociate = 0x03
 
 	socks5AddrIPv4   = 0x01
@@ -20,6 +26,10 @@ const (
 
 	socks5ReplySucceeded              = 0x00
 	socks5ReplyGeneralFailure         = 0x01
+	socks5ReplyConnectionNotAllowed   = 0x02
+	socks5ReplyHostUnreachable        = 0x04
+	socks5ReplyConnectionRefused      = 0x05
+	socks5ReplyTTLExpired             = 0x06
 	socks5ReplyCommandNotSupported    = 0x07
 	socks5ReplyAddressTypeUnsupported = 0x08
 )
@@ -0,0 +1,129 @@
+package pingtunnel
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+)
+
+const (
+	TRANSPARENT_REDIRECT string = "redirect"
+	TRANSPARENT_TPROXY   string = "tproxy"
+)
+
+// ParseTransparentMode validates the -transparent flag value.
+func ParseTransparentMode(s string) (string, error) {
+	switch s {
+	case "", TRANSPARENT_REDIRECT, TRANSPARENT_TPROXY:
+		return s, nil
+	default:
+		return "", fmt.Errorf("invalid transparent mode: %s (supported: redirect, tproxy)", s)
+	}
+}
+
+func (p *Client) AcceptTransparentConn(conn *net.TCPConn) {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	var dst *net.TCPAddr
+	if p.transparent == TRANSPARENT_TPROXY {
+		dst, _ = conn.LocalAddr().(*net.TCPAddr)
+	} else {
+		var err error
+		dst, err = getOriginalDst(conn)
+		if err != nil {
+			loggo.Info("get original dst fail %s %s", conn.RemoteAddr().String(), err)
+			conn.Close()
+			return
+		}
+	}
+
+	if dst == nil || p.isTransparentSelfAddr(dst) {
+		loggo.Info("drop transparent conn to self %s", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+
+	loggo.Info("accept new transparent tcp conn: %s -> %s", conn.RemoteAddr().String(), dst.String())
+
+	p.routeTcpConn(conn, dst.String())
+}
+
+// isTransparentSelfAddr reports whether dst is the listener itself, which
+// happens when a client connects to the listen port directly.
+func (p *Client) isTransparentSelfAddr(dst *net.TCPAddr) bool {
+	if p.tcpaddr == nil || dst.Port != p.tcpaddr.Port {
+		return false
+	}
+	if p.tcpaddr.IP == nil || p.tcpaddr.IP.IsUnspecified() {
+		return dst.IP.IsLoopback()
+	}
+	return dst.IP.Equal(p.tcpaddr.IP)
+}
+
+func (p *Client) AcceptTransparentUdp() error {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	loggo.Info("client waiting local accept transparent udp")
+
+	bytes := make([]byte, UDP_FRAG_MAX_DATAGRAM)
+	oob := make([]byte, 1024)
+
+	for p.ctx.Err() == nil {
+		p.listenConn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, srcaddr, dstaddr, err := readTransparentUDP(p.listenConn, bytes, oob)
+		if err != nil {
+			nerr, ok := err.(net.Error)
+			if !ok || !nerr.Timeout() {
+				loggo.Info("Error read transparent udp %s", err)
+			}
+			continue
+		}
+		if n <= 0 {
+			continue
+		}
+
+		now := time.Now()
+		settings := p.settings.Load()
+		connKey := "tproxy|" + srcaddr.String() + "|" + dstaddr.String()
+		clientConn := p.getClientConnByAddr(connKey)
+		if clientConn == nil {
+			if p.draining.Load() {
+				continue
+			}
+			if settings.MaxConn > 0 && (int)(p.localIdToConnMapSize.Load()) >= settings.MaxConn {
+				loggo.Info("too many connections %d, client accept new transparent udp fail %s", p.localIdToConnMapSize.Load(), srcaddr.String())
+				continue
+			}
+			replyConn, err := bindTransparentUDP(dstaddr)
+			if err != nil {
+				loggo.Info("bind transparent udp reply socket fail %s %s", dstaddr.String(), err)
+				continue
+			}
+			uuid := common.UniqueId()
+			clientConn = &ClientConn{ipaddr: copyUDPAddr(srcaddr), id: uuid, tcpmode: 0,
+				udpTargetAddr: dstaddr.String(), tproxyConn: replyConn}
+			p.addClientConn(uuid, connKey, clientConn)
+			loggo.Info("client accept new transparent udp %s %s -> %s", uuid, srcaddr.String(), dstaddr.String())
+		}
+
+		clientConn.activeSendTime.Store(now)
+		sendICMPUDP(p.id, p.nextSequence(), *p.conn, p.ipaddrServer.Load(), clientConn.udpTargetAddr, clientConn.id, bytes[:n],
+			SEND_PROTO, RECV_PROTO, settings.Key, settings.Timeout, UDP_MODE_CONNECTED, p.cryptoConfig.Load())
+
+		p.sendPacket.Add(1)
+		p.sendPacketSize.Add((uint64)(n))
+		p.touchActivity()
+	}
+	return nil
+}
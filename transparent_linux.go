@@ -0,0 +1,165 @@
+//go:build linux
+
+package pingtunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h
+const soOriginalDst = 80
+
+// getOriginalDst returns the destination a connection had before it was
+// redirected by an iptables REDIRECT rule.
+func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+			info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			raw := info.Addr
+			port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&raw.Port))[:])
+			addr = &net.TCPAddr{IP: append(net.IP(nil), raw.Addr[:]...), Port: int(port)}
+			return
+		}
+
+		mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		// struct sockaddr_in: family(2) port(2) addr(4)
+		raw := mreq.Multiaddr
+		port := binary.BigEndian.Uint16(raw[2:4])
+		addr = &net.TCPAddr{IP: net.IPv4(raw[4], raw[5], raw[6], raw[7]), Port: int(port)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return addr, nil
+}
+
+func setTransparentSockopt(network string, fd uintptr, recvOrigDst bool) error {
+	ipv6 := network == "tcp6" || network == "udp6"
+	if ipv6 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+			return fmt.Errorf("set IPV6_TRANSPARENT: %w", err)
+		}
+		if recvOrigDst {
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+				return fmt.Errorf("set IPV6_RECVORIGDSTADDR: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+		return fmt.Errorf("set IP_TRANSPARENT: %w", err)
+	}
+	if recvOrigDst {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
+			return fmt.Errorf("set IP_RECVORIGDSTADDR: %w", err)
+		}
+	}
+	return nil
+}
+
+func transparentListenConfig(recvOrigDst bool, reuseAddr bool) *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if reuseAddr {
+					if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+						sockErr = fmt.Errorf("set SO_REUSEADDR: %w", err)
+						return
+					}
+				}
+				sockErr = setTransparentSockopt(network, fd, recvOrigDst)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+}
+
+// listenTransparentTCP opens a TCP listener that accepts TPROXY redirected connections.
+func listenTransparentTCP(addr *net.TCPAddr) (*net.TCPListener, error) {
+	l, err := transparentListenConfig(false, false).Listen(context.Background(), "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// listenTransparentUDP opens a UDP socket that receives TPROXY redirected
+// datagrams together with their original destination.
+func listenTransparentUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	c, err := transparentListenConfig(true, false).ListenPacket(context.Background(), "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// bindTransparentUDP opens a UDP socket bound to a foreign address, used to
+// send replies that appear to come from the original destination.
+func bindTransparentUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	c, err := transparentListenConfig(false, true).ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// readTransparentUDP reads one datagram and its original destination address.
+func readTransparentUDP(conn *net.UDPConn, b []byte, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	n, oobn, _, src, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("parse control message: %w", err)
+	}
+	for i := range msgs {
+		sa, err := unix.ParseOrigDstAddr(&msgs[i])
+		if err != nil {
+			continue
+		}
+		switch v := sa.(type) {
+		case *unix.SockaddrInet4:
+			return n, src, &net.UDPAddr{IP: net.IPv4(v.Addr[0], v.Addr[1], v.Addr[2], v.Addr[3]), Port: v.Port}, nil
+		case *unix.SockaddrInet6:
+			return n, src, &net.UDPAddr{IP: append(net.IP(nil), v.Addr[:]...), Port: v.Port}, nil
+		}
+	}
+	return 0, nil, nil, errors.New("missing original destination address")
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+package pingtunnel
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentNotSupported = errors.New("transparent proxy is only supported on linux")
+
+func getOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errTransparentNotSupported
+}
+
+func listenTransparentTCP(addr *net.TCPAddr) (*net.TCPListener, error) {
+	return nil, errTransparentNotSupported
+}
+
+func listenTransparentUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentNotSupported
+}
+
+func bindTransparentUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentNotSupported
+}
+
+func readTransparentUDP(conn *net.UDPConn, b []byte, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, errTransparentNotSupported
+}
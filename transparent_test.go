@@ -0,0 +1,31 @@
+package pingtunnel
+
+import (
+	"testing"
+)
+
+func TestParseTransparentMode(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		hasError bool
+	}{
+		{"", "", false},
+		{"redirect", TRANSPARENT_REDIRECT, false},
+		{"tproxy", TRANSPARENT_TPROXY, false},
+		{"tun", "", true},
+	}
+
+	for _, test := range tests {
+		result, err := ParseTransparentMode(test.input)
+		if test.hasError && err == nil {
+			t.Fatalf("Expected error for input %s, but got none", test.input)
+		}
+		if !test.hasError && err != nil {
+			t.Fatalf("Unexpected error for input %s: %v", test.input, err)
+		}
+		if result != test.expected {
+			t.Fatalf("For input %s, expected %v, got %v", test.input, test.expected, result)
+		}
+	}
+}
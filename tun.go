@@ -0,0 +1,306 @@
+package pingtunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+)
+
+// TunConfig describes the layer-3 interface used by the -tun mode. IP packets
+// read from the interface are carried through the tunnel as TUN messages.
+type TunConfig struct {
+	Name       string     // interface name, empty lets the kernel pick one
+	IP         net.IP     // local address of the interface
+	Net        *net.IPNet // tunnel subnet, shared by the server and its clients
+	MTU        int
+	UpScript   string // shell command run after the interface is up
+	DownScript string // shell command run before the interface is removed
+}
+
+// ParseTunConfig validates the -tun flags. addr is an IPv4 CIDR such as
+// "10.0.85.2/24".
+func ParseTunConfig(name string, addr string, mtu int, up string, down string) (*TunConfig, error) {
+	if addr == "" {
+		return nil, errors.New("tun address is required")
+	}
+	ip, ipnet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tun address %q: %w", addr, err)
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("tun address must be ipv4: %s", addr)
+	}
+	if ip.Equal(ipnet.IP) {
+		return nil, fmt.Errorf("tun address can not be the network address: %s", addr)
+	}
+	if mtu < 576 || mtu > 65535 {
+		return nil, fmt.Errorf("invalid tun mtu %d (576-65535)", mtu)
+	}
+	return &TunConfig{
+		Name:       name,
+		IP:         ip.To4(),
+		Net:        ipnet,
+		MTU:        mtu,
+		UpScript:   up,
+		DownScript: down,
+	}, nil
+}
+
+// Addr returns the interface address in CIDR form.
+func (t *TunConfig) Addr() string {
+	ones, _ := t.Net.Mask.Size()
+	return t.IP.String() + "/" + strconv.Itoa(ones)
+}
+
+// tunPacketAddrs returns the source and destination of an IPv4 or IPv6 packet.
+func tunPacketAddrs(pkt []byte) (net.IP, net.IP, bool) {
+	if len(pkt) < 1 {
+		return nil, nil, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return nil, nil, false
+		}
+		return net.IP(pkt[12:16]), net.IP(pkt[16:20]), true
+	case 6:
+		if len(pkt) < 40 {
+			return nil, nil, false
+		}
+		return net.IP(pkt[8:24]), net.IP(pkt[24:40]), true
+	}
+	return nil, nil, false
+}
+
+// openTunDevice creates the interface, assigns the address and runs the up hook.
+func openTunDevice(cfg *TunConfig, server string) (*os.File, error) {
+	dev, name, err := openTun(cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Name = name
+
+	err = configureTun(cfg.Name, cfg.IP, cfg.Net.Mask, cfg.MTU)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	loggo.Info("tun %s up %s mtu %d", cfg.Name, cfg.Addr(), cfg.MTU)
+
+	err = runTunHook(cfg, cfg.UpScript, server)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+func closeTunDevice(cfg *TunConfig, dev *os.File, server string) {
+	runTunHook(cfg, cfg.DownScript, server)
+	dev.Close()
+}
+
+// runTunHook runs a route/DNS configuration command with the interface
+// details exported as PT_TUN_NAME, PT_TUN_ADDR, PT_TUN_IP, PT_TUN_NET,
+// PT_TUN_MTU and, on the client, PT_SERVER.
+func runTunHook(cfg *TunConfig, script string, server string) error {
+	if script == "" {
+		return nil
+	}
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Env = append(os.Environ(),
+		"PT_TUN_NAME="+cfg.Name,
+		"PT_TUN_ADDR="+cfg.Addr(),
+		"PT_TUN_IP="+cfg.IP.String(),
+		"PT_TUN_NET="+cfg.Net.String(),
+		"PT_TUN_MTU="+strconv.Itoa(cfg.MTU),
+		"PT_SERVER="+server,
+	)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		loggo.Info("tun hook output: %s", string(out))
+	}
+	if err != nil {
+		loggo.Error("tun hook %q fail: %s", script, err)
+		return fmt.Errorf("tun hook %q: %w", script, err)
+	}
+	return nil
+}
+
+// ServerTunPeer is a client reachable through the server's tun interface,
+// learned from the source address of the packets it sends.
+type ServerTunPeer struct {
+	ip         string
+	peer       sharedPeer
+	timeout    int
+	activeTime atomicTime
+}
+
+func (p *Client) AcceptTun() {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	loggo.Info("client waiting tun packets %s", p.tun.Name)
+
+	id := p.tun.IP.String()
+	bytes := make([]byte, 65535)
+
+	for p.ctx.Err() == nil {
+		p.tunDev.SetReadDeadline(time.Now().Add(time.Millisecond * 1000))
+		n, err := p.tunDev.Read(bytes)
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) && p.ctx.Err() == nil {
+				loggo.Info("Error read tun %s", err)
+			}
+			continue
+		}
+		// the tunnel subnet is ipv4, the server would drop ipv6 packets
+		if _, _, ok := tunPacketAddrs(bytes[:n]); !ok || bytes[0]>>4 != 4 {
+			continue
+		}
+
+		settings := p.settings.Load()
+		sendICMP(p.id, p.nextSequence(), *p.conn, p.ipaddrServer.Load(), "", id, (uint32)(MyMsg_TUN), bytes[:n],
+			SEND_PROTO, RECV_PROTO, settings.Key,
+			0, 0, 0, 0, 0, 0,
+			settings.Timeout, p.cryptoConfig.Load())
+
+		p.sendPacket.Add(1)
+		p.sendPacketSize.Add((uint64)(n))
+		p.touchActivity()
+	}
+}
+
+func (p *Client) processTunPacket(packet *Packet) {
+	if p.tunDev == nil {
+		return
+	}
+
+	_, err := p.tunDev.Write(packet.my.Data)
+	if err != nil {
+		loggo.Info("Error write tun %s", err)
+		return
+	}
+
+	p.recvPacket.Add(1)
+	p.recvPacketSize.Add((uint64)(len(packet.my.Data)))
+	p.touchActivity()
+}
+
+func (p *Server) processTunPacket(packet *Packet) {
+	if p.tunDev == nil {
+		loggo.Debug("tun not enabled, drop packet from %s", packet.src.String())
+		return
+	}
+
+	src, _, ok := tunPacketAddrs(packet.my.Data)
+	if !ok {
+		return
+	}
+	if !p.tun.Net.Contains(src) || src.Equal(p.tun.IP) || src.String() != packet.my.Id {
+		loggo.Debug("tun drop packet from %s src %s id %s", packet.src.String(), src.String(), packet.my.Id)
+		return
+	}
+
+	ip := src.String()
+
+	tunPeer := p.getServerTunPeerByIp(ip)
+	if tunPeer == nil {
+		tunPeer = &ServerTunPeer{ip: ip, timeout: (int)(packet.my.Timeout)}
+		tunPeer.peer.Store(packetPeer(packet))
+		tunPeer.activeTime.Store(time.Now())
+		p.tunPeerMap.Store(ip, tunPeer)
+		loggo.Info("tun add peer %s from %s", ip, packet.src.String())
+	} else if old := tunPeer.peer.Load().src; old.String() != packet.src.String() {
+		loggo.Info("tun peer %s moved from %s to %s", ip, old.String(), packet.src.String())
+	}
+	tunPeer.peer.Store(packetPeer(packet))
+	tunPeer.activeTime.Store(time.Now())
+
+	_, err := p.tunDev.Write(packet.my.Data)
+	if err != nil {
+		loggo.Info("Error write tun %s", err)
+		return
+	}
+
+	p.recvPacket.Add(1)
+	p.recvPacketSize.Add((uint64)(len(packet.my.Data)))
+}
+
+func (p *Server) RecvTun() {
+
+	defer common.CrashLog()
+
+	p.workResultLock.Add(1)
+	defer p.workResultLock.Done()
+
+	loggo.Info("server waiting tun packets %s", p.tun.Name)
+
+	bytes := make([]byte, 65535)
+
+	for p.ctx.Err() == nil {
+		p.tunDev.SetReadDeadline(time.Now().Add(time.Millisecond * 1000))
+		n, err := p.tunDev.Read(bytes)
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) && p.ctx.Err() == nil {
+				loggo.Info("Error read tun %s", err)
+			}
+			continue
+		}
+
+		_, dst, ok := tunPacketAddrs(bytes[:n])
+		if !ok {
+			continue
+		}
+		tunPeer := p.getServerTunPeerByIp(dst.String())
+		if tunPeer == nil {
+			loggo.Debug("tun no peer for %s", dst.String())
+			continue
+		}
+
+		peer := tunPeer.peer.Load()
+		sendICMP(peer.echoId, peer.echoSeq, *p.conn, peer.src, "", tunPeer.ip, (uint32)(MyMsg_TUN), bytes[:n],
+			peer.rproto, -1, peer.key,
+			0, 0, 0, 0, 0, 0,
+			0, peer.crypto)
+
+		p.sendPacket.Add(1)
+		p.sendPacketSize.Add((uint64)(n))
+	}
+}
+
+func (p *Server) checkTimeoutTun() {
+
+	tmp := make(map[string]*ServerTunPeer)
+	p.tunPeerMap.Range(func(key, value interface{}) bool {
+		tmp[key.(string)] = value.(*ServerTunPeer)
+		return true
+	})
+
+	now := time.Now()
+	for ip, peer := range tmp {
+		diff := now.Sub(peer.activeTime.Load())
+		if diff > time.Second*(time.Duration(peer.timeout)) {
+			loggo.Info("close inactive tun peer %s", ip)
+			p.tunPeerMap.Delete(ip)
+		}
+	}
+}
+
+func (p *Server) getServerTunPeerByIp(ip string) *ServerTunPeer {
+	ret, ok := p.tunPeerMap.Load(ip)
+	if !ok {
+		return nil
+	}
+	return ret.(*ServerTunPeer)
+}
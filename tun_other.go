@@ -0,0 +1,19 @@
+//go:build !linux
+
+package pingtunnel
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+var errTunNotSupported = errors.New("tun mode is only supported on linux")
+
+func openTun(name string) (*os.File, string, error) {
+	return nil, "", errTunNotSupported
+}
+
+func configureTun(name string, ip net.IP, mask net.IPMask, mtu int) error {
+	return errTunNotSupported
+}
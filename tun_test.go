@@ -0,0 +1,72 @@
+package pingtunnel
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseTunConfig(t *testing.T) {
+	tests := []struct {
+		addr     string
+		mtu      int
+		ip       string
+		network  string
+		hasError bool
+	}{
+		{"10.0.85.2/24", 1300, "10.0.85.2", "10.0.85.0/24", false},
+		{"192.168.200.1/30", 1500, "192.168.200.1", "192.168.200.0/30", false},
+		{"", 1300, "", "", true},
+		{"10.0.85.2", 1300, "", "", true},
+		{"10.0.85.0/24", 1300, "", "", true},
+		{"fd00::2/64", 1300, "", "", true},
+		{"10.0.85.2/24", 100, "", "", true},
+	}
+
+	for _, test := range tests {
+		cfg, err := ParseTunConfig("pt0", test.addr, test.mtu, "", "")
+		if test.hasError {
+			if err == nil {
+				t.Errorf("ParseTunConfig(%q, %d) expected error, got none", test.addr, test.mtu)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTunConfig(%q, %d) unexpected error: %v", test.addr, test.mtu, err)
+			continue
+		}
+		if cfg.IP.String() != test.ip || cfg.Net.String() != test.network {
+			t.Errorf("ParseTunConfig(%q) = %s %s, want %s %s", test.addr, cfg.IP, cfg.Net, test.ip, test.network)
+		}
+		if cfg.Addr() != test.addr {
+			t.Errorf("Addr() = %s, want %s", cfg.Addr(), test.addr)
+		}
+	}
+}
+
+func TestTunPacketAddrs(t *testing.T) {
+	v4 := make([]byte, 20)
+	v4[0] = 0x45
+	copy(v4[12:16], net.ParseIP("10.0.85.2").To4())
+	copy(v4[16:20], net.ParseIP("8.8.8.8").To4())
+
+	src, dst, ok := tunPacketAddrs(v4)
+	if !ok || src.String() != "10.0.85.2" || dst.String() != "8.8.8.8" {
+		t.Errorf("tunPacketAddrs(ipv4) = %v %v %v", src, dst, ok)
+	}
+
+	v6 := make([]byte, 40)
+	v6[0] = 0x60
+	copy(v6[8:24], net.ParseIP("fd00::2"))
+	copy(v6[24:40], net.ParseIP("2001:db8::1"))
+
+	src, dst, ok = tunPacketAddrs(v6)
+	if !ok || src.String() != "fd00::2" || dst.String() != "2001:db8::1" {
+		t.Errorf("tunPacketAddrs(ipv6) = %v %v %v", src, dst, ok)
+	}
+
+	for _, pkt := range [][]byte{nil, {0x45, 0}, v6[:20], {0x10}} {
+		if _, _, ok := tunPacketAddrs(pkt); ok {
+			t.Errorf("tunPacketAddrs(%x) expected failure", pkt)
+		}
+	}
+}